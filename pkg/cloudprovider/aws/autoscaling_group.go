@@ -1,15 +1,25 @@
 package aws
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/eks"
+	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/autoscaler/cluster-autoscaler/config/dynamic"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
@@ -17,6 +27,16 @@ const (
 	scaleToZeroSupported           = true
 	placeholderInstanceNamePrefix  = "i-placeholder"
 	placeholderUnfulfillableStatus = "placeholder-cannot-be-fulfilled"
+	nodeTemplateMinSizeTag         = "k8s.io/cluster-autoscaler/node-template/min"
+	nodeTemplateMaxSizeTag         = "k8s.io/cluster-autoscaler/node-template/max"
+	scalingProcessLaunch           = "Launch"
+	scalingProcessTerminate        = "Terminate"
+	eksNodegroupNameTag            = "eks:nodegroup-name"
+	eksClusterNameTag              = "eks:cluster-name"
+	lifecycleActionBackoff         = 1 * time.Second
+	maxLifecycleActionAttempts     = 6
+	// autoscalingEnabledTag set to false opts an ASG out of auto discovery
+	autoscalingEnabledTag = "k8s.io/cluster-autoscaler/enabled"
 )
 
 type asgCache struct {
@@ -25,13 +45,60 @@ type asgCache struct {
 	instanceToAsg        map[AwsInstanceRef]*asg
 	instanceStatus       map[AwsInstanceRef]*string
 	instanceLifecycle    map[AwsInstanceRef]*string
+	instanceProtected    map[AwsInstanceRef]bool
 	asgInstanceTypeCache *instanceTypeExpirationStore
-	mutex                sync.Mutex
-	awsService           *awsWrapper
-	interrupt            chan struct{}
-
-	explicitlyConfigured map[AwsRef]bool
-	autoscalingOptions   map[AwsRef]map[string]string
+	// mutex guards the maps of the cache and the fields of the registered ASGs, which
+	// regenerate swaps and updates while the cloud provider reads them
+	mutex      sync.RWMutex
+	awsService *awsWrapper
+	interrupt  chan struct{}
+	// regionalServices are the AWS services of the additional regions by region, whose
+	// auto-discovered ASGs are cached along with the ones of awsService
+	regionalServices map[string]*awsWrapper
+
+	asgAutoDiscoverySpecs []asgAutoDiscoveryConfig
+	explicitlyConfigured  map[AwsRef]bool
+	autoscalingOptions    map[AwsRef]map[string]string
+	// asgRefreshTime is when each ASG was last fetched from AWS
+	asgRefreshTime map[AwsRef]time.Time
+
+	// warmPoolAware excludes warm pool instances from the instances of an ASG
+	warmPoolAware bool
+	// detachOnDelete detaches deleted instances from their ASG instead of terminating them
+	detachOnDelete bool
+	// instanceTagLabelKeys are the instance tags mirrored as template labels
+	instanceTagLabelKeys []string
+	instanceTagLabels    map[AwsRef]map[string]string
+	// dryRun logs the changes to ASGs and applies them to the cache only, without calling AWS
+	dryRun bool
+	// maxNodeGroups caps the number of tracked ASGs, 0 means no limit
+	maxNodeGroups int
+	// excludedAsgs match the names of the ASGs dropped from auto discovery
+	excludedAsgs []*regexp.Regexp
+	// failOnSuspendedProcesses fails size changes the suspended processes of the ASG would stall
+	failOnSuspendedProcesses bool
+	// resumeSuspendedProcesses resumes the suspended process of the ASG that would stall a
+	// size change, and resuspendProcesses suspends it again once the size is set
+	resumeSuspendedProcesses bool
+	resuspendProcesses       bool
+	// eksNodegroupAware takes the sizes of ASGs backing EKS managed node groups from the
+	// scaling config of the node group
+	eksNodegroupAware bool
+	eksNodegroupCache cache.Store
+	// completeTerminationHooks completes the termination lifecycle actions of deleted
+	// instances, so they don't wait for the hook timeout
+	completeTerminationHooks bool
+	// lifecycleActionBackoff is the first delay between the attempts to complete a lifecycle
+	// action that hasn't started yet, it doubles after each attempt
+	lifecycleActionBackoff time.Duration
+	// terminationTagPrefix prefixes the tags set on instances before they are deleted,
+	// empty disables tagging
+	terminationTagPrefix string
+	// trackLaunchTimes describes the launch time of new instances on refresh
+	trackLaunchTimes   bool
+	instanceLaunchTime map[AwsInstanceRef]time.Time
+	// publishedGauges are the names of the ASGs whose instance counts are published
+	publishedGauges map[string]bool
 }
 
 type launchTemplate struct {
@@ -43,6 +110,9 @@ type mixedInstancesPolicy struct {
 	launchTemplate                *launchTemplate
 	instanceTypesOverrides        []string
 	instanceRequirementsOverrides *autoscaling.InstanceRequirements
+	instancesDistribution         *autoscaling.InstancesDistribution
+	// instanceTypeWeights holds the WeightedCapacity of the instance type overrides
+	instanceTypeWeights map[string]int64
 }
 
 type asg struct {
@@ -52,26 +122,52 @@ type asg struct {
 	maxSize        int
 	curSize        int
 	lastUpdateTime time.Time
+	// lastScaleUpTime is when the autoscaler last increased the size of the ASG
+	lastScaleUpTime time.Time
 
 	AvailabilityZones       []string
 	LaunchConfigurationName string
 	LaunchTemplate          *launchTemplate
 	MixedInstancesPolicy    *mixedInstancesPolicy
 	Tags                    []*autoscaling.TagDescription
+
+	// CapacityReservationTargeted is true when the launch template of the ASG targets
+	// an On-Demand Capacity Reservation, i.e. the ASG has guaranteed capacity
+	CapacityReservationTargeted bool
+	// IPFamily is the primary IP family of the instances launched by the ASG, detected
+	// from its launch template
+	IPFamily apiv1.IPFamily
+	// RootVolume is the EBS root volume set by the launch template of the ASG, nil if
+	// it has none or doesn't set it
+	RootVolume *EbsVolume
+	// SuspendedProcesses are the names of the scaling processes suspended on the ASG
+	SuspendedProcesses []string
+	// SpotAllocationStrategy of the mixed instances policy, empty without a policy
+	SpotAllocationStrategy string
+	// TerminationPolicies AWS uses to pick the instances to terminate on scale-in
+	TerminationPolicies []string
+	// SubnetIds the ASG launches instances in
+	SubnetIds []string
 }
 
-func newASGCache(awsService *awsWrapper, explicitSpecs []string) (*asgCache, error) {
+func newASGCache(awsService *awsWrapper, explicitSpecs []string, autoDiscoverySpecs []asgAutoDiscoveryConfig) (*asgCache, error) {
 	registry := &asgCache{
-		registeredAsgs:       make(map[AwsRef]*asg, 0),
-		awsService:           awsService,
-		asgToInstances:       make(map[AwsRef][]AwsInstanceRef),
-		instanceToAsg:        make(map[AwsInstanceRef]*asg),
-		instanceStatus:       make(map[AwsInstanceRef]*string),
-		instanceLifecycle:    make(map[AwsInstanceRef]*string),
-		asgInstanceTypeCache: newAsgInstanceTypeCache(awsService),
-		interrupt:            make(chan struct{}),
-		explicitlyConfigured: make(map[AwsRef]bool),
-		autoscalingOptions:   make(map[AwsRef]map[string]string),
+		registeredAsgs:         make(map[AwsRef]*asg, 0),
+		awsService:             awsService,
+		asgToInstances:         make(map[AwsRef][]AwsInstanceRef),
+		instanceToAsg:          make(map[AwsInstanceRef]*asg),
+		instanceStatus:         make(map[AwsInstanceRef]*string),
+		instanceLifecycle:      make(map[AwsInstanceRef]*string),
+		instanceProtected:      make(map[AwsInstanceRef]bool),
+		asgInstanceTypeCache:   newAsgInstanceTypeCache(awsService),
+		interrupt:              make(chan struct{}),
+		asgAutoDiscoverySpecs:  autoDiscoverySpecs,
+		explicitlyConfigured:   make(map[AwsRef]bool),
+		autoscalingOptions:     make(map[AwsRef]map[string]string),
+		asgRefreshTime:         make(map[AwsRef]time.Time),
+		lifecycleActionBackoff: lifecycleActionBackoff,
+		eksNodegroupCache:      newEksNodegroupCache(),
+		instanceLaunchTime:     make(map[AwsInstanceRef]time.Time),
 	}
 
 	if err := registry.parseExplicitAsgs(explicitSpecs); err != nil {
@@ -83,11 +179,14 @@ func newASGCache(awsService *awsWrapper, explicitSpecs []string) (*asgCache, err
 
 // Use a function variable for ease of testing
 var getInstanceTypeForAsg = func(m *asgCache, group *asg) (string, error) {
-	if obj, found, _ := m.asgInstanceTypeCache.GetByKey(group.AwsRef.Name); found {
+	if obj, found, _ := m.asgInstanceTypeCache.GetByKey(group.AwsRef.Id()); found {
 		return obj.(instanceTypeCachedObject).instanceType, nil
 	}
 
-	result, err := m.awsService.getInstanceTypesForAsgs([]*asg{group})
+	m.mutex.RLock()
+	service := m.serviceFor(group.AwsRef)
+	m.mutex.RUnlock()
+	result, err := service.getInstanceTypesForAsgs([]*asg{group})
 	if err != nil {
 		return "", fmt.Errorf("could not get instance type for %s: %w", group.AwsRef.Name, err)
 	}
@@ -137,6 +236,10 @@ func (m *asgCache) register(asg *asg) *asg {
 		existing.LaunchTemplate = asg.LaunchTemplate
 		existing.MixedInstancesPolicy = asg.MixedInstancesPolicy
 		existing.Tags = asg.Tags
+		existing.SuspendedProcesses = asg.SuspendedProcesses
+		existing.SpotAllocationStrategy = asg.SpotAllocationStrategy
+		existing.TerminationPolicies = asg.TerminationPolicies
+		existing.SubnetIds = asg.SubnetIds
 
 		klog.V(4).Infof("Updated ASG cache for %s. min/max/current is %d/%d/%d", asg.AwsRef.Name, existing.minSize, existing.maxSize, existing.curSize)
 
@@ -156,6 +259,94 @@ func (m *asgCache) unregister(a *asg) *asg {
 	return a
 }
 
+// addRegionalService adds the AWS services of an additional region to the cache.
+func (m *asgCache) addRegionalService(awsService *awsWrapper) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, found := m.regionalServices[awsService.region]; found {
+		return fmt.Errorf("AWS region %s is already managed", awsService.region)
+	}
+	if m.regionalServices == nil {
+		m.regionalServices = make(map[string]*awsWrapper)
+	}
+	m.regionalServices[awsService.region] = awsService
+	return nil
+}
+
+// regionalService returns the AWS services of the given additional region, or nil if it
+// isn't one.
+func (m *asgCache) regionalService(region string) *awsWrapper {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.regionalServices[region]
+}
+
+// regionalServiceList returns the AWS services of the additional regions, sorted by region.
+func (m *asgCache) regionalServiceList() []*awsWrapper {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.services()[1:]
+}
+
+// services returns the AWS services of the region of the cache, followed by the ones of
+// the additional regions sorted by region.
+func (m *asgCache) services() []*awsWrapper {
+	regions := make([]string, 0, len(m.regionalServices))
+	for region := range m.regionalServices {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	services := []*awsWrapper{m.awsService}
+	for _, region := range regions {
+		services = append(services, m.regionalServices[region])
+	}
+	return services
+}
+
+// serviceFor returns the AWS services of the region of the ASG.
+func (m *asgCache) serviceFor(ref AwsRef) *awsWrapper {
+	if service, found := m.regionalServices[ref.Region]; found && ref.Region != "" {
+		return service
+	}
+	return m.awsService
+}
+
+// refForGroup returns the ref of the ASG. ASGs of the additional regions are told apart
+// by the region of their ARN.
+func (m *asgCache) refForGroup(group *autoscaling.Group) AwsRef {
+	ref := AwsRef{Name: aws.StringValue(group.AutoScalingGroupName)}
+	if len(m.regionalServices) == 0 {
+		return ref
+	}
+	if parsed, err := arn.Parse(aws.StringValue(group.AutoScalingGroupARN)); err == nil {
+		if _, found := m.regionalServices[parsed.Region]; found {
+			ref.Region = parsed.Region
+		}
+	}
+	return ref
+}
+
+// instanceIdsByRegion groups the IDs of the given instances by the region of their ASG,
+// placeholders excluded.
+func (m *asgCache) instanceIdsByRegion(instances []AwsInstanceRef) map[string][]string {
+	instanceIds := make(map[string][]string)
+	for _, instance := range instances {
+		if m.isPlaceholderInstance(&instance) {
+			continue
+		}
+		region := ""
+		if asg, found := m.instanceToAsg[instance]; found {
+			region = asg.Region
+		}
+		instanceIds[region] = append(instanceIds[region], instance.Name)
+	}
+	return instanceIds
+}
+
 func (m *asgCache) buildAsgFromSpec(spec string) (*asg, error) {
 	s, err := dynamic.SpecFromString(spec, scaleToZeroSupported)
 	if err != nil {
@@ -169,29 +360,98 @@ func (m *asgCache) buildAsgFromSpec(spec string) (*asg, error) {
 	return asg, nil
 }
 
-// Get returns the currently registered ASGs
+// Get returns a copy of the map of the currently registered ASGs, which refreshes
+// update in place.
 func (m *asgCache) Get() map[AwsRef]*asg {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	asgs := make(map[AwsRef]*asg, len(m.registeredAsgs))
+	for ref, asg := range m.registeredAsgs {
+		asgs[ref] = asg
+	}
+	return asgs
+}
+
+// sizes returns the min, max and desired sizes of the ASG, which refreshes update in place.
+func (m *asgCache) sizes(asg *asg) (minSize, maxSize, curSize int) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return asg.minSize, asg.maxSize, asg.curSize
+}
+
+// snapshot returns a copy of the ASG taken under the lock, so callers can read the
+// fields that refreshes update in place without racing with them. Refreshes replace
+// the slices, maps and pointers of the ASG rather than modifying them, so the copy
+// stays consistent.
+func (m *asgCache) snapshot(asg *asg) *asg {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	copied := *asg
+	return &copied
+}
+
+// LastScaleUp returns when the size of the ASG was last increased, or the zero time if
+// it wasn't since the autoscaler started.
+func (m *asgCache) LastScaleUp(asg *asg) time.Time {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
-	return m.registeredAsgs
+	return asg.lastScaleUpTime
+}
+
+// names returns the names of the registered ASGs.
+func (m *asgCache) names() map[string]bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	names := make(map[string]bool, len(m.registeredAsgs))
+	for ref := range m.registeredAsgs {
+		names[ref.Name] = true
+	}
+	return names
 }
 
 // GetAutoscalingOptions return autoscaling options strings obtained from ASG tags.
 func (m *asgCache) GetAutoscalingOptions(ref AwsRef) map[string]string {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	return m.autoscalingOptions[ref]
 }
 
+// LastRefreshed returns when the ASG was last fetched from AWS, or the zero time
+// if it never was.
+func (m *asgCache) LastRefreshed(ref AwsRef) time.Time {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.asgRefreshTime[ref]
+}
+
 // FindForInstance returns AsgConfig of the given Instance
 func (m *asgCache) FindForInstance(instance AwsInstanceRef) *asg {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
 	return m.findForInstance(instance)
 }
 
+// FindForInstances returns the ASGs of the given instances, omitting the ones not
+// part of any ASG.
+func (m *asgCache) FindForInstances(instances []AwsInstanceRef) map[AwsInstanceRef]*asg {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	asgs := make(map[AwsInstanceRef]*asg, len(instances))
+	for _, instance := range instances {
+		if asg := m.findForInstance(instance); asg != nil {
+			asgs[instance] = asg
+		}
+	}
+	return asgs
+}
+
 func (m *asgCache) findForInstance(instance AwsInstanceRef) *asg {
 	if asg, found := m.instanceToAsg[instance]; found {
 		return asg
@@ -200,21 +460,23 @@ func (m *asgCache) findForInstance(instance AwsInstanceRef) *asg {
 	return nil
 }
 
-// InstancesByAsg returns the nodes of an ASG
+// InstancesByAsg returns a copy of the nodes of an ASG
 func (m *asgCache) InstancesByAsg(ref AwsRef) ([]AwsInstanceRef, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
 	if instances, found := m.asgToInstances[ref]; found {
-		return instances, nil
+		copied := make([]AwsInstanceRef, len(instances))
+		copy(copied, instances)
+		return copied, nil
 	}
 
 	return nil, fmt.Errorf("error while looking for instances of ASG: %s", ref)
 }
 
 func (m *asgCache) InstanceStatus(ref AwsInstanceRef) (*string, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
 	if status, found := m.instanceStatus[ref]; found {
 		return status, nil
@@ -223,6 +485,90 @@ func (m *asgCache) InstanceStatus(ref AwsInstanceRef) (*string, error) {
 	return nil, fmt.Errorf("could not find instance %v", ref)
 }
 
+// InstanceState is the health and lifecycle state of an ASG instance, as last reported
+// by AWS. Both are empty for placeholders of instances that haven't been launched.
+type InstanceState struct {
+	// HealthStatus is either Healthy or Unhealthy
+	HealthStatus string
+	// LifecycleState is one of the autoscaling.LifecycleState* values, e.g. InService
+	LifecycleState string
+}
+
+// GoingAway returns whether the instance is unhealthy or being terminated, so it
+// shouldn't be counted as capacity of its ASG.
+func (s InstanceState) GoingAway() bool {
+	return s.HealthStatus == "Unhealthy" || isTerminatingLifecycle(&s.LifecycleState)
+}
+
+// InstanceStates returns the state of each instance of the ASG.
+func (m *asgCache) InstanceStates(ref AwsRef) (map[AwsInstanceRef]InstanceState, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	instances, found := m.asgToInstances[ref]
+	if !found {
+		return nil, fmt.Errorf("error while looking for instances of ASG: %s", ref)
+	}
+	states := make(map[AwsInstanceRef]InstanceState, len(instances))
+	for _, instance := range instances {
+		states[instance] = InstanceState{
+			HealthStatus:   aws.StringValue(m.instanceStatus[instance]),
+			LifecycleState: aws.StringValue(m.instanceLifecycle[instance]),
+		}
+	}
+	return states, nil
+}
+
+// RefreshInstanceStates updates the cached health, lifecycle and scale-in protection of
+// the given instances from AWS, without refreshing their whole ASGs.
+func (m *asgCache) RefreshInstanceStates(ctx context.Context, instances []AwsInstanceRef) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	details := make(map[string]*autoscaling.InstanceDetails, len(instances))
+	for region, instanceIds := range m.instanceIdsByRegion(instances) {
+		regionDetails, err := m.serviceFor(AwsRef{Region: region}).getAutoScalingInstances(ctx, instanceIds)
+		if err != nil {
+			return err
+		}
+		for id, detail := range regionDetails {
+			details[id] = detail
+		}
+	}
+
+	for _, instance := range instances {
+		detail, found := details[instance.Name]
+		if !found {
+			continue
+		}
+		m.instanceStatus[instance] = detail.HealthStatus
+		m.instanceLifecycle[instance] = detail.LifecycleState
+		m.instanceProtected[instance] = aws.BoolValue(detail.ProtectedFromScaleIn)
+	}
+	return nil
+}
+
+// IsInstanceProtected returns whether the instance is protected from scale-in by its ASG
+func (m *asgCache) IsInstanceProtected(ref AwsInstanceRef) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.instanceProtected[ref]
+}
+
+// IsInstanceLaunching returns whether the cached lifecycle state of the instance is one of
+// an instance still being launched, i.e. Pending, Pending:Wait or Pending:Proceed.
+func (m *asgCache) IsInstanceLaunching(ref AwsInstanceRef) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	switch aws.StringValue(m.instanceLifecycle[ref]) {
+	case autoscaling.LifecycleStatePending, autoscaling.LifecycleStatePendingWait, autoscaling.LifecycleStatePendingProceed:
+		return true
+	}
+	return false
+}
+
 func (m *asgCache) findInstanceLifecycle(ref AwsInstanceRef) (*string, error) {
 	if lifecycle, found := m.instanceLifecycle[ref]; found {
 		return lifecycle, nil
@@ -231,37 +577,365 @@ func (m *asgCache) findInstanceLifecycle(ref AwsInstanceRef) (*string, error) {
 	return nil, fmt.Errorf("could not find instance %v", ref)
 }
 
-func (m *asgCache) SetAsgSize(asg *asg, size int) error {
+// SetAsgSize sets the desired number of instances of the ASG. For ASGs with weighted
+// instance type overrides the size is converted to capacity units.
+func (m *asgCache) SetAsgSize(ctx context.Context, asg *asg, size int) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	return m.setAsgSizeNoLock(asg, size)
+	return m.setAsgSizeNoLock(ctx, asg, size)
 }
 
-func (m *asgCache) setAsgSizeNoLock(asg *asg, size int) error {
+func (m *asgCache) setAsgSizeNoLock(ctx context.Context, asg *asg, size int) error {
+	resumed, err := m.resumeBlockingProcess(ctx, asg, size)
+	if err != nil {
+		return newScalingError(asg.Name, "ResumeProcesses", size, err)
+	}
+	if resumed != "" && m.resuspendProcesses {
+		defer m.resuspendProcess(ctx, asg, resumed)
+	}
+	if err := m.checkSuspendedProcesses(asg, size); err != nil {
+		return err
+	}
+
 	params := &autoscaling.SetDesiredCapacityInput{
 		AutoScalingGroupName: aws.String(asg.Name),
-		DesiredCapacity:      aws.Int64(int64(size)),
+		DesiredCapacity:      aws.Int64(int64(size * asg.capacityWeight())),
 		HonorCooldown:        aws.Bool(false),
 	}
 
-	_, err := m.awsService.SetDesiredCapacity(params)
-	if err != nil {
-		return err
+	start := time.Now()
+	if m.dryRun {
+		klog.InfoS("Dry run: would set ASG size", "asg", asg.Name, "oldSize", asg.curSize, "newSize", size)
+	} else if _, err := m.serviceFor(asg.AwsRef).SetDesiredCapacityWithContext(ctx, params); err != nil {
+		if isAsgNotFoundError(err) {
+			return newScalingError(asg.Name, "SetDesiredCapacity", size, m.forgetAsgNoLock(asg, err))
+		}
+		return newScalingError(asg.Name, "SetDesiredCapacity", size, m.withFailedScalingActivity(ctx, asg, err))
+	}
+
+	if !m.dryRun {
+		klog.V(2).InfoS("Set ASG size", "asg", asg.Name, "oldSize", asg.curSize, "newSize", size)
 	}
 
 	// Proactively set the ASG size so autoscaler makes better decisions
+	asg.lastUpdateTime = start
+	if size > asg.curSize {
+		asg.lastScaleUpTime = start
+	}
 	asg.curSize = size
+	m.updatePlaceholdersNoLock(asg)
+
+	return nil
+}
+
+// AtomicIncreaseAsgSize adds delta instances to the ASG, only if all of them can be
+// launched. The instances are launched with an instant EC2 fleet from the launch template
+// of the ASG, then attached to it.
+func (m *asgCache) AtomicIncreaseAsgSize(ctx context.Context, asg *asg, delta int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lt := asg.effectiveLaunchTemplate()
+	if lt == nil {
+		return fmt.Errorf("ASG %s has no launch template, atomic scale-up is not supported", asg.Name)
+	}
+	if delta > maxInstancesPerAttach {
+		return fmt.Errorf("can't atomically add %d instances to ASG %s, at most %d can be attached at once", delta, asg.Name, maxInstancesPerAttach)
+	}
+	if err := m.checkSuspendedProcesses(asg, asg.curSize+delta); err != nil {
+		return err
+	}
+
+	if m.dryRun {
+		klog.Infof("Dry run: would atomically increase size of ASG %s from %d to %d", asg.Name, asg.curSize, asg.curSize+delta)
+	} else {
+		service := m.serviceFor(asg.AwsRef)
+		instanceIds, err := service.launchInstantFleet(ctx, lt, asg.SubnetIds, delta)
+		if err == nil {
+			_, err = service.AttachInstancesWithContext(ctx, &autoscaling.AttachInstancesInput{
+				AutoScalingGroupName: aws.String(asg.Name),
+				InstanceIds:          aws.StringSlice(instanceIds),
+			})
+		}
+		if err != nil {
+			if len(instanceIds) > 0 {
+				if terminateErr := service.terminateInstances(ctx, instanceIds); terminateErr != nil {
+					klog.Errorf("Failed to terminate instances %v launched for ASG %s: %v", instanceIds, asg.Name, terminateErr)
+				}
+			}
+			return newScalingError(asg.Name, "AtomicIncreaseSize", asg.curSize+delta, err)
+		}
+	}
+
+	asg.lastUpdateTime = time.Now()
+	asg.lastScaleUpTime = asg.lastUpdateTime
+	asg.curSize += delta
+	m.updatePlaceholdersNoLock(asg)
+	return nil
+}
 
+// effectiveLaunchTemplate returns the launch template instances of the ASG are launched
+// from, or nil if it uses a launch configuration.
+func (a *asg) effectiveLaunchTemplate() *launchTemplate {
+	if a.MixedInstancesPolicy != nil && a.MixedInstancesPolicy.launchTemplate != nil {
+		return a.MixedInstancesPolicy.launchTemplate
+	}
+	return a.LaunchTemplate
+}
+
+// checkSuspendedProcesses warns when a size change can't be carried out because the
+// Launch or Terminate process of the ASG is suspended, or fails if configured to.
+func (m *asgCache) checkSuspendedProcesses(asg *asg, size int) error {
+	process := asg.blockingProcess(size)
+	if process == "" {
+		return nil
+	}
+
+	if m.failOnSuspendedProcesses {
+		return fmt.Errorf("can't set size of ASG %s from %d to %d: the %s process is suspended", asg.Name, asg.curSize, size, process)
+	}
+	klog.Warningf("Setting size of ASG %s from %d to %d, but its %s process is suspended: the change won't take effect until it is resumed", asg.Name, asg.curSize, size, process)
 	return nil
 }
 
-func (m *asgCache) decreaseAsgSizeByOneNoLock(asg *asg) error {
-	return m.setAsgSizeNoLock(asg, asg.curSize-1)
+// blockingProcess returns the suspended scaling process of the ASG that would stall a
+// change of its size to the given one, empty if none would.
+func (a *asg) blockingProcess(size int) string {
+	if size > a.curSize && a.isProcessSuspended(scalingProcessLaunch) {
+		return scalingProcessLaunch
+	}
+	if size < a.curSize && a.isProcessSuspended(scalingProcessTerminate) {
+		return scalingProcessTerminate
+	}
+	return ""
+}
+
+// resumeBlockingProcess resumes the suspended scaling process of the ASG that would stall
+// a change of its size to the given one, when enabled. It returns the resumed process,
+// empty if none was.
+func (m *asgCache) resumeBlockingProcess(ctx context.Context, asg *asg, size int) (string, error) {
+	process := asg.blockingProcess(size)
+	if process == "" || !m.resumeSuspendedProcesses {
+		return "", nil
+	}
+
+	if m.dryRun {
+		klog.InfoS("Dry run: would resume suspended process", "asg", asg.Name, "process", process)
+	} else {
+		klog.Warningf("Resuming the suspended %s process of ASG %s to set its size from %d to %d", process, asg.Name, asg.curSize, size)
+		if err := m.serviceFor(asg.AwsRef).resumeProcesses(ctx, asg.Name, []string{process}); err != nil {
+			return "", err
+		}
+	}
+	asg.SuspendedProcesses = removeString(asg.SuspendedProcesses, process)
+	return process, nil
+}
+
+// resuspendProcess suspends again a process resumed by resumeBlockingProcess. Activities
+// already started by the size change complete, but the ones not started yet won't until
+// the process is resumed again.
+func (m *asgCache) resuspendProcess(ctx context.Context, asg *asg, process string) {
+	if m.dryRun {
+		klog.InfoS("Dry run: would suspend process again", "asg", asg.Name, "process", process)
+	} else {
+		klog.Warningf("Suspending the %s process of ASG %s again", process, asg.Name)
+		if err := m.serviceFor(asg.AwsRef).suspendProcesses(ctx, asg.Name, []string{process}); err != nil {
+			klog.Errorf("Failed to suspend the %s process of ASG %s again, it stays resumed: %v", process, asg.Name, err)
+			return
+		}
+	}
+	asg.SuspendedProcesses = append(asg.SuspendedProcesses, process)
+}
+
+// hasCustomTerminationPolicies returns whether the ASG picks the instances to terminate
+// with other policies than the default one.
+func (a *asg) hasCustomTerminationPolicies() bool {
+	for _, policy := range a.TerminationPolicies {
+		if policy != "Default" {
+			return true
+		}
+	}
+	return false
+}
+
+// isProcessSuspended returns whether the given scaling process is suspended on the ASG.
+func (a *asg) isProcessSuspended(process string) bool {
+	for _, suspended := range a.SuspendedProcesses {
+		if suspended == process {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString returns a copy of the values without the given value.
+func removeString(values []string, value string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// ScalingError is returned when an AWS call changing the size of an ASG fails. The
+// underlying error, e.g. a ScalingActivityError, can be retrieved with errors.As.
+type ScalingError struct {
+	AsgName     string
+	Operation   string
+	DesiredSize int
+	// RequestID of the failed AWS request, empty if the request wasn't sent
+	RequestID string
+	Err       error
+}
+
+// ErrASGNotFound is wrapped by the errors of operations on an ASG that no longer exists
+// in AWS. The ASG is dropped from the cache, so callers can skip it until the next refresh.
+var ErrASGNotFound = errors.New("ASG not found")
+
+// isAsgNotFoundError returns whether err is the validation error AWS returns for
+// operations on an ASG that doesn't exist.
+func isAsgNotFoundError(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == "ValidationError" &&
+		strings.Contains(awsErr.Message(), "AutoScalingGroup name not found")
+}
+
+// forgetAsgNoLock drops the instances of an ASG that no longer exists in AWS from the
+// cache, and unregisters the ASG if it was auto-discovered. Explicitly configured ASGs
+// are never unregistered, like on refreshes. It returns err wrapped with ErrASGNotFound.
+func (m *asgCache) forgetAsgNoLock(asg *asg, err error) error {
+	if m.explicitlyConfigured[asg.AwsRef] {
+		klog.Warningf("Explicitly configured ASG %s no longer exists, forgetting its instances", asg.Name)
+	} else {
+		klog.Warningf("ASG %s no longer exists, removing it from the cache", asg.Name)
+		m.unregister(asg)
+	}
+	for _, instance := range m.asgToInstances[asg.AwsRef] {
+		delete(m.instanceToAsg, instance)
+		delete(m.instanceStatus, instance)
+		delete(m.instanceLifecycle, instance)
+		delete(m.instanceProtected, instance)
+	}
+	delete(m.asgToInstances, asg.AwsRef)
+	delete(m.autoscalingOptions, asg.AwsRef)
+	delete(m.asgRefreshTime, asg.AwsRef)
+	return fmt.Errorf("%w: %s: %v", ErrASGNotFound, asg.Name, err)
+}
+
+func newScalingError(asgName, operation string, desiredSize int, err error) *ScalingError {
+	scalingErr := &ScalingError{
+		AsgName:     asgName,
+		Operation:   operation,
+		DesiredSize: desiredSize,
+		Err:         err,
+	}
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) {
+		scalingErr.RequestID = requestErr.RequestID()
+	}
+	return scalingErr
+}
+
+func (e *ScalingError) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("%s on ASG %s to size %d failed: %v", e.Operation, e.AsgName, e.DesiredSize, e.Err)
+	}
+	return fmt.Sprintf("%s on ASG %s to size %d failed (request ID %s): %v", e.Operation, e.AsgName, e.DesiredSize, e.RequestID, e.Err)
+}
+
+func (e *ScalingError) Unwrap() error {
+	return e.Err
+}
+
+// ScalingActivityError is returned when changing the size of an ASG failed along with
+// its latest scaling activity, so that the activity can be looked up in the AWS console.
+type ScalingActivityError struct {
+	AsgName       string
+	ActivityId    string
+	StatusMessage string
+	Err           error
+}
+
+func (e *ScalingActivityError) Error() string {
+	return fmt.Sprintf("%v (scaling activity %s of ASG %s: %s)", e.Err, e.ActivityId, e.AsgName, e.StatusMessage)
+}
+
+func (e *ScalingActivityError) Unwrap() error {
+	return e.Err
+}
+
+// withFailedScalingActivity returns a ScalingActivityError wrapping err if the latest
+// scaling activity of the ASG failed, and err unchanged otherwise.
+func (m *asgCache) withFailedScalingActivity(ctx context.Context, asg *asg, err error) error {
+	response, describeErr := m.serviceFor(asg.AwsRef).DescribeScalingActivitiesWithContext(ctx, &autoscaling.DescribeScalingActivitiesInput{
+		AutoScalingGroupName: aws.String(asg.Name),
+		MaxRecords:           aws.Int64(1),
+	})
+	if describeErr != nil {
+		klog.Warningf("Failed to describe scaling activities of ASG %s: %v", asg.Name, describeErr)
+		return err
+	}
+	if len(response.Activities) == 0 {
+		return err
+	}
+
+	activity := response.Activities[0]
+	if aws.StringValue(activity.StatusCode) != autoscaling.ScalingActivityStatusCodeFailed {
+		return err
+	}
+	return &ScalingActivityError{
+		AsgName:       asg.Name,
+		ActivityId:    aws.StringValue(activity.ActivityId),
+		StatusMessage: aws.StringValue(activity.StatusMessage),
+		Err:           err,
+	}
+}
+
+// updatePlaceholdersNoLock adds or removes placeholder instances so that the cached
+// instances of the ASG match its requested size until the next refresh reconciles them
+// with the real instances.
+func (m *asgCache) updatePlaceholdersNoLock(asg *asg) {
+	current := m.asgToInstances[asg.AwsRef]
+	if len(current) == asg.curSize || len(asg.AvailabilityZones) == 0 {
+		return
+	}
+
+	instances := make([]AwsInstanceRef, 0, asg.curSize)
+	for _, instance := range current {
+		if len(instances) >= asg.curSize && m.isPlaceholderInstance(&instance) {
+			delete(m.instanceToAsg, instance)
+			delete(m.instanceStatus, instance)
+			delete(m.instanceLifecycle, instance)
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	for i := len(instances); i < asg.curSize; i++ {
+		id := placeholderInstanceId(asg.Name, i)
+		ref := m.buildInstanceRefFromAWS(&autoscaling.Instance{
+			InstanceId:       &id,
+			AvailabilityZone: aws.String(asg.AvailabilityZones[0]),
+		})
+		m.instanceToAsg[ref] = asg
+		m.instanceStatus[ref] = aws.String("")
+		instances = append(instances, ref)
+	}
+	m.asgToInstances[asg.AwsRef] = instances
+}
+
+func placeholderInstanceId(asgName string, index int) string {
+	return fmt.Sprintf("%s-%s-%d", placeholderInstanceNamePrefix, asgName, index)
+}
+
+func (m *asgCache) decreaseAsgSizeByOneNoLock(ctx context.Context, asg *asg) error {
+	return m.setAsgSizeNoLock(ctx, asg, asg.curSize-1)
 }
 
 // DeleteInstances deletes the given instances. All instances must be controlled by the same ASG.
-func (m *asgCache) DeleteInstances(instances []*AwsInstanceRef) error {
+func (m *asgCache) DeleteInstances(ctx context.Context, instances []*AwsInstanceRef) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
@@ -285,13 +959,24 @@ func (m *asgCache) DeleteInstances(instances []*AwsInstanceRef) error {
 		}
 	}
 
+	klog.V(2).InfoS("Deleting instances", "asg", commonAsg.Name, "count", len(instances), "dryRun", m.dryRun)
+
+	// Termination lifecycle hooks of the ASG, described when the first instance is terminated
+	var terminationHooks []string
+	terminationHooksFetched := false
+
+	if commonAsg.hasCustomTerminationPolicies() && !m.detachOnDelete {
+		klog.V(2).Infof("Terminating specific instances of ASG %s, bypassing its termination policies %v",
+			commonAsg.Name, commonAsg.TerminationPolicies)
+	}
+
 	for _, instance := range instances {
 		// check if the instance is a placeholder - a requested instance that was never created by the node group
 		// if it is, just decrease the size of the node group, as there's no specific instance we can remove
 		if m.isPlaceholderInstance(instance) {
 			klog.V(4).Infof("instance %s is detected as a placeholder, decreasing ASG requested size instead "+
 				"of deleting instance", instance.Name)
-			m.decreaseAsgSizeByOneNoLock(commonAsg)
+			m.decreaseAsgSizeByOneNoLock(ctx, commonAsg)
 		} else {
 			// check if the instance is already terminating - if it is, don't bother terminating again
 			// as doing so causes unnecessary API calls and can cause the curSize cached value to decrement
@@ -301,25 +986,49 @@ func (m *asgCache) DeleteInstances(instances []*AwsInstanceRef) error {
 				return err
 			}
 
-			if lifecycle != nil &&
-				*lifecycle == autoscaling.LifecycleStateTerminated ||
-				*lifecycle == autoscaling.LifecycleStateTerminating ||
-				*lifecycle == autoscaling.LifecycleStateTerminatingWait ||
-				*lifecycle == autoscaling.LifecycleStateTerminatingProceed {
-				klog.V(2).Infof("instance %s is already terminating in state %s, will skip instead", instance.Name, *lifecycle)
+			if isTerminatingLifecycle(lifecycle) {
+				klog.V(4).Infof("instance %s is already terminating in state %s, will skip instead", instance.Name, *lifecycle)
 				continue
 			}
 
-			params := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
-				InstanceId:                     aws.String(instance.Name),
-				ShouldDecrementDesiredCapacity: aws.Bool(true),
+			if !m.dryRun && m.terminationTagPrefix != "" {
+				m.tagInstanceForTermination(ctx, commonAsg, instance)
 			}
 
-			resp, err := m.awsService.TerminateInstanceInAutoScalingGroup(params)
-			if err != nil {
-				return err
+			if m.dryRun {
+				klog.InfoS("Dry run: would delete instance", "asg", commonAsg.Name, "instance", instance.Name,
+					"oldSize", commonAsg.curSize, "newSize", commonAsg.curSize-1)
+			} else if m.detachOnDelete {
+				if err := m.detachInstanceNoLock(ctx, commonAsg, instance); err != nil {
+					return err
+				}
+			} else {
+				params := &autoscaling.TerminateInstanceInAutoScalingGroupInput{
+					InstanceId:                     aws.String(instance.Name),
+					ShouldDecrementDesiredCapacity: aws.Bool(true),
+				}
+
+				resp, err := m.serviceFor(commonAsg.AwsRef).TerminateInstanceInAutoScalingGroupWithContext(ctx, params)
+				if err == nil && m.completeTerminationHooks {
+					if !terminationHooksFetched {
+						terminationHooks = m.getTerminationHooks(ctx, commonAsg)
+						terminationHooksFetched = true
+					}
+					if len(terminationHooks) > 0 {
+						// The lifecycle actions start shortly after the termination, complete them
+						// in the background rather than holding the cache lock while waiting
+						go completeTerminationLifecycleActions(context.WithoutCancel(ctx), m.serviceFor(commonAsg.AwsRef),
+							commonAsg.Name, instance.Name, terminationHooks, m.lifecycleActionBackoff)
+					}
+				}
+				if err != nil {
+					if isAsgNotFoundError(err) {
+						err = m.forgetAsgNoLock(commonAsg, err)
+					}
+					return newScalingError(commonAsg.Name, "TerminateInstanceInAutoScalingGroup", commonAsg.curSize-1, err)
+				}
+				klog.V(4).Infof(*resp.Activity.Description)
 			}
-			klog.V(4).Infof(*resp.Activity.Description)
 
 			// Proactively decrement the size so autoscaler makes better decisions
 			commonAsg.curSize--
@@ -328,58 +1037,396 @@ func (m *asgCache) DeleteInstances(instances []*AwsInstanceRef) error {
 	return nil
 }
 
-// isPlaceholderInstance checks if the given instance is only a placeholder
-func (m *asgCache) isPlaceholderInstance(instance *AwsInstanceRef) bool {
-	return strings.HasPrefix(instance.Name, placeholderInstanceNamePrefix)
+// getTerminationHooks returns the termination lifecycle hooks of the ASG, or none if
+// they can't be described.
+func (m *asgCache) getTerminationHooks(ctx context.Context, asg *asg) []string {
+	hooks, err := m.serviceFor(asg.AwsRef).getTerminationLifecycleHooks(ctx, asg.Name)
+	if err != nil {
+		klog.Warningf("Failed to describe lifecycle hooks of ASG %s: %v", asg.Name, err)
+		return nil
+	}
+	return hooks
 }
 
-func (m *asgCache) buildAsgNames() []string {
-	refreshNames := make([]string, len(m.explicitlyConfigured))
-	i := 0
-	for k := range m.explicitlyConfigured {
-		refreshNames[i] = k.Name
-		i++
+// completeTerminationLifecycleActions lets the instance terminate without waiting for the
+// timeouts of the given termination lifecycle hooks. The lifecycle actions only exist once
+// the instance is Terminating:Wait, so completions are retried with exponential backoff
+// while AWS reports no active action. Failures are only logged.
+func completeTerminationLifecycleActions(ctx context.Context, awsService *awsWrapper, asgName, instanceId string, hooks []string, backoff time.Duration) {
+	for _, hook := range hooks {
+		delay := backoff
+		for attempt := 1; ; attempt++ {
+			_, err := awsService.CompleteLifecycleActionWithContext(ctx, &autoscaling.CompleteLifecycleActionInput{
+				AutoScalingGroupName:  aws.String(asgName),
+				LifecycleHookName:     aws.String(hook),
+				InstanceId:            aws.String(instanceId),
+				LifecycleActionResult: aws.String("CONTINUE"),
+			})
+			if err == nil {
+				klog.V(2).Infof("Completed lifecycle hook %s of ASG %s for instance %s", hook, asgName, instanceId)
+				break
+			}
+			if !isNoActiveLifecycleActionError(err) || attempt >= maxLifecycleActionAttempts {
+				klog.Warningf("Failed to complete lifecycle hook %s of ASG %s for instance %s: %v", hook, asgName, instanceId, err)
+				break
+			}
+
+			klog.V(4).Infof("Lifecycle hook %s of ASG %s hasn't started for instance %s yet, retrying in %v", hook, asgName, instanceId, delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
 	}
+}
 
-	return refreshNames
+// isNoActiveLifecycleActionError returns whether err is the validation error AWS returns
+// when completing a lifecycle action that hasn't started.
+func isNoActiveLifecycleActionError(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == "ValidationError" &&
+		strings.Contains(awsErr.Message(), "No active Lifecycle Action found")
 }
 
-// regenerate the cached view of explicitly configured and auto-discovered ASGs
-func (m *asgCache) regenerate() error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// tagInstanceForTermination records when and why the instance is deleted on the instance
+// itself, so it can be correlated after termination. Failures are only logged.
+func (m *asgCache) tagInstanceForTermination(ctx context.Context, asg *asg, instance *AwsInstanceRef) {
+	tags := map[string]string{
+		m.terminationTagPrefix + "/terminated-at":      time.Now().UTC().Format(time.RFC3339),
+		m.terminationTagPrefix + "/termination-reason": "scale-down of " + asg.Name,
+	}
+	if err := m.serviceFor(asg.AwsRef).tagInstance(ctx, instance.Name, tags); err != nil {
+		klog.Warningf("Failed to tag instance %s before deleting it: %v", instance.Name, err)
+	}
+}
 
-	newInstanceToAsgCache := make(map[AwsInstanceRef]*asg)
-	newAsgToInstancesCache := make(map[AwsRef][]AwsInstanceRef)
-	newInstanceStatusMap := make(map[AwsInstanceRef]*string)
+// isTerminatingLifecycle returns whether the lifecycle state is one of an instance
+// that is already being terminated or is terminated.
+func isTerminatingLifecycle(lifecycle *string) bool {
+	if lifecycle == nil {
+		return false
+	}
+	switch *lifecycle {
+	case autoscaling.LifecycleStateTerminated,
+		autoscaling.LifecycleStateTerminating,
+		autoscaling.LifecycleStateTerminatingWait,
+		autoscaling.LifecycleStateTerminatingProceed:
+		return true
+	}
+	return false
+}
+
+// detachInstanceNoLock detaches the instance from the ASG and decrements its desired
+// capacity, leaving the termination of the instance to the caller.
+func (m *asgCache) detachInstanceNoLock(ctx context.Context, asg *asg, instance *AwsInstanceRef) error {
+	params := &autoscaling.DetachInstancesInput{
+		AutoScalingGroupName:           aws.String(asg.Name),
+		InstanceIds:                    []*string{aws.String(instance.Name)},
+		ShouldDecrementDesiredCapacity: aws.Bool(true),
+	}
+
+	resp, err := m.serviceFor(asg.AwsRef).DetachInstancesWithContext(ctx, params)
+	if err != nil {
+		if isAsgNotFoundError(err) {
+			err = m.forgetAsgNoLock(asg, err)
+		}
+		return newScalingError(asg.Name, "DetachInstances", asg.curSize-1, err)
+	}
+	for _, activity := range resp.Activities {
+		klog.V(4).Infof(aws.StringValue(activity.Description))
+	}
+	return nil
+}
+
+// isPlaceholderInstance checks if the given instance is only a placeholder
+func (m *asgCache) isPlaceholderInstance(instance *AwsInstanceRef) bool {
+	return strings.HasPrefix(instance.Name, placeholderInstanceNamePrefix)
+}
+
+func (m *asgCache) buildAsgNames() []string {
+	refreshNames := make([]string, len(m.explicitlyConfigured))
+	i := 0
+	for k := range m.explicitlyConfigured {
+		refreshNames[i] = k.Name
+		i++
+	}
+
+	return refreshNames
+}
+
+// RefreshAsg refreshes the cached size and instances of a single ASG from AWS,
+// without waiting for the next full regeneration of the cache.
+func (m *asgCache) RefreshAsg(ctx context.Context, ref AwsRef) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	groups, err := m.serviceFor(ref).getAutoscalingGroupsByNames(ctx, []string{ref.Name})
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		return fmt.Errorf("ASG %s not found", ref.Name)
+	}
+	groups = groups[:1]
+	if m.warmPoolAware {
+		m.excludeWarmPoolInstances(ctx, groups)
+	}
+	groups = m.createPlaceholdersForDesiredNonStartedInstances(ctx, groups)
+
+	asg, err := m.buildAsgFromAWS(groups[0])
+	if err != nil {
+		return err
+	}
+	if m.eksNodegroupAware {
+		m.applyEksNodegroupScalingConfig(ctx, asg)
+	}
+	asg = m.register(asg)
+	m.autoscalingOptions[asg.AwsRef] = extractAutoscalingOptionsFromTags(groups[0].Tags)
+	m.asgRefreshTime[asg.AwsRef] = time.Now()
+
+	for _, instance := range m.asgToInstances[asg.AwsRef] {
+		delete(m.instanceToAsg, instance)
+		delete(m.instanceStatus, instance)
+		delete(m.instanceLifecycle, instance)
+		delete(m.instanceProtected, instance)
+	}
+	instances := make([]AwsInstanceRef, len(groups[0].Instances))
+	for i, instance := range groups[0].Instances {
+		ref := m.buildInstanceRefFromAWS(instance)
+		m.instanceToAsg[ref] = asg
+		m.instanceStatus[ref] = instance.HealthStatus
+		m.instanceLifecycle[ref] = instance.LifecycleState
+		m.instanceProtected[ref] = aws.BoolValue(instance.ProtectedFromScaleIn)
+		instances[i] = ref
+	}
+	m.asgToInstances[asg.AwsRef] = instances
+
+	return nil
+}
+
+// AsgDrift is a difference between the cached size of an ASG and its desired capacity
+// in AWS, e.g. after the ASG was resized outside of the autoscaler.
+type AsgDrift struct {
+	AsgName    string
+	CachedSize int
+	ActualSize int
+}
+
+// DetectDrift compares the cached size of the registered ASGs with their desired capacity
+// in AWS, and returns the ASGs whose sizes differ. When correct is true the cached sizes
+// are set to the actual ones, along with their placeholders. ASGs that no longer exist
+// are left to the next refresh.
+func (m *asgCache) DetectDrift(ctx context.Context, correct bool) ([]AsgDrift, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	namesByRegion := make(map[string][]string)
+	for ref := range m.registeredAsgs {
+		namesByRegion[ref.Region] = append(namesByRegion[ref.Region], ref.Name)
+	}
+	var groups []*autoscaling.Group
+	for region, names := range namesByRegion {
+		sort.Strings(names)
+		regionGroups, err := m.serviceFor(AwsRef{Region: region}).getAutoscalingGroupsByNames(ctx, names)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, regionGroups...)
+	}
+
+	drifts := []AsgDrift{}
+	for _, group := range groups {
+		asg, found := m.registeredAsgs[m.refForGroup(group)]
+		if !found {
+			continue
+		}
+		actual := unitsToInstances(int(aws.Int64Value(group.DesiredCapacity)), asg.capacityWeight())
+		if actual == asg.curSize {
+			continue
+		}
+		klog.Warningf("Cached size %d of ASG %s drifted from its desired capacity %d in AWS", asg.curSize, asg.Name, actual)
+		drifts = append(drifts, AsgDrift{AsgName: asg.Name, CachedSize: asg.curSize, ActualSize: actual})
+		if correct {
+			asg.curSize = actual
+			m.updatePlaceholdersNoLock(asg)
+		}
+	}
+	return drifts, nil
+}
+
+// buildAsgTags merges the tags of all auto discovery specs. All the merged
+// constraints must be satisfied by an ASG for it to be discovered.
+func (m *asgCache) buildAsgTags() map[string]string {
+	groupTags := map[string]string{}
+	for _, spec := range m.asgAutoDiscoverySpecs {
+		for k, v := range spec.Tags {
+			if existing, found := groupTags[k]; found && existing != v {
+				klog.Warningf("Conflicting values %q and %q for ASG auto discovery tag %s, using %q", existing, v, k, v)
+			}
+			groupTags[k] = v
+		}
+	}
+	return groupTags
+}
+
+// buildAsgNamePatterns returns the name patterns of all auto discovery specs.
+func (m *asgCache) buildAsgNamePatterns() []*regexp.Regexp {
+	patterns := []*regexp.Regexp{}
+	for _, spec := range m.asgAutoDiscoverySpecs {
+		if spec.NamePattern != nil {
+			patterns = append(patterns, spec.NamePattern)
+		}
+	}
+	return patterns
+}
+
+// dropExcludedAsgs removes the auto-discovered ASGs matching an exclusion or tagged with
+// k8s.io/cluster-autoscaler/enabled=false, even if they match the auto discovery tags.
+func (m *asgCache) dropExcludedAsgs(groups []*autoscaling.Group) []*autoscaling.Group {
+	kept := make([]*autoscaling.Group, 0, len(groups))
+	for _, group := range groups {
+		name := aws.StringValue(group.AutoScalingGroupName)
+		if m.isExcludedAsg(name) {
+			klog.V(2).Infof("Excluding auto-discovered ASG %s", name)
+			continue
+		}
+		if isAutoscalingDisabled(group) {
+			klog.V(2).Infof("Excluding auto-discovered ASG %s, it is tagged %s=false", name, autoscalingEnabledTag)
+			continue
+		}
+		kept = append(kept, group)
+	}
+	return kept
+}
+
+// isAutoscalingDisabled returns whether the ASG is tagged k8s.io/cluster-autoscaler/enabled=false.
+func isAutoscalingDisabled(group *autoscaling.Group) bool {
+	for _, tag := range group.Tags {
+		if aws.StringValue(tag.Key) == autoscalingEnabledTag && aws.StringValue(tag.Value) == "false" {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *asgCache) isExcludedAsg(name string) bool {
+	for _, pattern := range m.excludedAsgs {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// regenerate the cached view of explicitly configured and auto-discovered ASGs
+func (m *asgCache) regenerate(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	newInstanceToAsgCache := make(map[AwsInstanceRef]*asg)
+	newAsgToInstancesCache := make(map[AwsRef][]AwsInstanceRef)
+	newInstanceStatusMap := make(map[AwsInstanceRef]*string)
 	newInstanceLifecycleMap := make(map[AwsInstanceRef]*string)
+	newInstanceProtectedMap := make(map[AwsInstanceRef]bool)
+	newAutoscalingOptions := make(map[AwsRef]map[string]string)
+	newAsgRefreshTime := make(map[AwsRef]time.Time)
 
 	// Fetch details of all ASGs
 	refreshNames := m.buildAsgNames()
 	klog.V(4).Infof("Regenerating instance to ASG map for ASG names: %v", refreshNames)
-	namedGroups, err := m.awsService.getAutoscalingGroupsByNames(refreshNames)
+	namedGroups, err := m.awsService.getAutoscalingGroupsByNamesIsolatingFailures(ctx, refreshNames)
 	if err != nil {
-		return err
+		if len(namedGroups) == 0 {
+			return err
+		}
+		// Keep the cached state of the ASGs that couldn't be described, rather than
+		// letting them take down the refresh of all the others
+		klog.Errorf("Failed to describe some ASGs, keeping their last known state: %v", err)
+	}
+	failed := make(map[AwsRef]bool)
+	for _, name := range refreshNames {
+		failed[AwsRef{Name: name}] = err != nil
+	}
+	for _, group := range namedGroups {
+		delete(failed, m.refForGroup(group))
 	}
 
-	groups := namedGroups
+	// Fetch auto-discovered ASGs, in the region of the cache and the additional ones
+	refreshTags := m.buildAsgTags()
+	klog.V(4).Infof("Regenerating instance to ASG map for ASG tags: %v", refreshTags)
+	var taggedGroups []*autoscaling.Group
+	for _, service := range m.services() {
+		regionGroups, err := service.getAutoscalingGroupsByTags(ctx, refreshTags)
+		if err != nil {
+			return err
+		}
+		taggedGroups = append(taggedGroups, regionGroups...)
+	}
+	taggedGroups = m.dropExcludedAsgs(taggedGroups)
+
+	groups := append(namedGroups, taggedGroups...)
+
+	// Fetch ASGs auto-discovered by name, skipping the ones that are already known
+	refreshPatterns := m.buildAsgNamePatterns()
+	var patternGroups []*autoscaling.Group
+	for _, service := range m.services() {
+		regionGroups, err := service.getAutoscalingGroupsByNamePatterns(ctx, refreshPatterns)
+		if err != nil {
+			return err
+		}
+		patternGroups = append(patternGroups, regionGroups...)
+	}
+	patternGroups = m.dropExcludedAsgs(patternGroups)
+	fetched := make(map[AwsRef]bool, len(groups))
+	for _, group := range groups {
+		fetched[m.refForGroup(group)] = true
+	}
+	for _, group := range patternGroups {
+		if !fetched[m.refForGroup(group)] {
+			groups = append(groups, group)
+		}
+	}
+
+	// The describe calls follow NextToken through all the pages, so this is the full list
+	klog.V(4).Infof("Fetched %d ASGs (%d by name, %d by tags, %d by name pattern)", len(groups), len(namedGroups), len(taggedGroups), len(patternGroups))
+	groups = m.capNodeGroups(groups)
+
+	if m.warmPoolAware {
+		m.excludeWarmPoolInstances(ctx, groups)
+	}
 
 	// If currently any ASG has more Desired than running Instances, introduce placeholders
 	// for the instances to come up. This is required to track Desired instances that
 	// will never come up, like with Spot Request that can't be fulfilled
-	groups = m.createPlaceholdersForDesiredNonStartedInstances(groups)
+	groups = m.createPlaceholdersForDesiredNonStartedInstances(ctx, groups)
 
 	// Register or update ASGs
+	refreshTime := time.Now()
 	exists := make(map[AwsRef]bool)
+	// Launch templates are regional, so are the properties looked up
+	launchTemplateProps := make(map[string]map[launchTemplate]launchTemplateProperties)
 	for _, group := range groups {
 		asg, err := m.buildAsgFromAWS(group)
 		if err != nil {
-			return err
+			klog.Errorf("Failed to build ASG %s, keeping its last known state: %v", aws.StringValue(group.AutoScalingGroupName), err)
+			failed[m.refForGroup(group)] = true
+			continue
+		}
+		if m.eksNodegroupAware {
+			m.applyEksNodegroupScalingConfig(ctx, asg)
 		}
 		exists[asg.AwsRef] = true
 
 		asg = m.register(asg)
 
+		newAutoscalingOptions[asg.AwsRef] = extractAutoscalingOptionsFromTags(group.Tags)
+		newAsgRefreshTime[asg.AwsRef] = refreshTime
+		if launchTemplateProps[asg.Region] == nil {
+			launchTemplateProps[asg.Region] = make(map[launchTemplate]launchTemplateProperties)
+		}
+		m.updateLaunchTemplateProperties(ctx, asg, launchTemplateProps[asg.Region])
 		newAsgToInstancesCache[asg.AwsRef] = make([]AwsInstanceRef, len(group.Instances))
 
 		for i, instance := range group.Instances {
@@ -388,6 +1435,25 @@ func (m *asgCache) regenerate() error {
 			newAsgToInstancesCache[asg.AwsRef][i] = ref
 			newInstanceStatusMap[ref] = instance.HealthStatus
 			newInstanceLifecycleMap[ref] = instance.LifecycleState
+			newInstanceProtectedMap[ref] = aws.BoolValue(instance.ProtectedFromScaleIn)
+		}
+	}
+
+	for ref, keep := range failed {
+		if _, registered := m.registeredAsgs[ref]; !keep || !registered {
+			continue
+		}
+		exists[ref] = true
+		newAutoscalingOptions[ref] = m.autoscalingOptions[ref]
+		if refreshTime, found := m.asgRefreshTime[ref]; found {
+			newAsgRefreshTime[ref] = refreshTime
+		}
+		newAsgToInstancesCache[ref] = m.asgToInstances[ref]
+		for _, instance := range m.asgToInstances[ref] {
+			newInstanceToAsgCache[instance] = m.instanceToAsg[instance]
+			newInstanceStatusMap[instance] = m.instanceStatus[instance]
+			newInstanceLifecycleMap[instance] = m.instanceLifecycle[instance]
+			newInstanceProtectedMap[instance] = m.instanceProtected[instance]
 		}
 	}
 
@@ -398,7 +1464,7 @@ func (m *asgCache) regenerate() error {
 		}
 	}
 
-	err = m.asgInstanceTypeCache.populate(m.registeredAsgs)
+	err = m.asgInstanceTypeCache.populate(m.registeredAsgs, m.serviceFor)
 	if err != nil {
 		klog.Warningf("Failed to fully populate ASG->instanceType mapping: %v", err)
 	}
@@ -407,12 +1473,266 @@ func (m *asgCache) regenerate() error {
 	m.instanceToAsg = newInstanceToAsgCache
 	m.instanceStatus = newInstanceStatusMap
 	m.instanceLifecycle = newInstanceLifecycleMap
+	m.instanceProtected = newInstanceProtectedMap
+	m.autoscalingOptions = newAutoscalingOptions
+	m.asgRefreshTime = newAsgRefreshTime
+	m.instanceTagLabels = m.buildInstanceTagLabels(ctx)
+	m.instanceLaunchTime = m.buildInstanceLaunchTimes(ctx)
+	m.publishInstanceCounts()
 	return nil
 }
 
-func (m *asgCache) createPlaceholdersForDesiredNonStartedInstances(groups []*autoscaling.Group) []*autoscaling.Group {
+// buildInstanceLaunchTimes returns the launch time of the cached instances when launch
+// times are tracked. Only the instances new since the last refresh are described, the
+// ones that fail to be are retried on the next refresh.
+func (m *asgCache) buildInstanceLaunchTimes(ctx context.Context) map[AwsInstanceRef]time.Time {
+	launchTimes := make(map[AwsInstanceRef]time.Time)
+	if !m.trackLaunchTimes {
+		return launchTimes
+	}
+
+	var missing []AwsInstanceRef
+	for instance := range m.instanceToAsg {
+		if launchTime, found := m.instanceLaunchTime[instance]; found {
+			launchTimes[instance] = launchTime
+		} else {
+			missing = append(missing, instance)
+		}
+	}
+
+	described := make(map[string]time.Time)
+	for region, instanceIds := range m.instanceIdsByRegion(missing) {
+		regionDescribed, err := m.serviceFor(AwsRef{Region: region}).getInstanceLaunchTimes(ctx, instanceIds)
+		if err != nil {
+			klog.Warningf("Failed to describe the launch time of %d instances: %v", len(instanceIds), err)
+			continue
+		}
+		for id, launchTime := range regionDescribed {
+			described[id] = launchTime
+		}
+	}
+	for instance := range m.instanceToAsg {
+		if launchTime, found := described[instance.Name]; found {
+			launchTimes[instance] = launchTime
+		}
+	}
+	return launchTimes
+}
+
+// InstanceLaunchTime returns the launch time of the instance, if launch times are tracked
+// and it was described.
+func (m *asgCache) InstanceLaunchTime(ref AwsInstanceRef) (time.Time, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	launchTime, found := m.instanceLaunchTime[ref]
+	return launchTime, found
+}
+
+// buildInstanceTagLabels returns the template labels of each ASG taken from the tags of
+// its instances. A tag is only used when all the instances of the ASG carrying it agree.
+func (m *asgCache) buildInstanceTagLabels(ctx context.Context) map[AwsRef]map[string]string {
+	result := make(map[AwsRef]map[string]string)
+	if len(m.instanceTagLabelKeys) == 0 {
+		return result
+	}
+
+	instances := make([]AwsInstanceRef, 0, len(m.instanceToAsg))
+	for ref := range m.instanceToAsg {
+		instances = append(instances, ref)
+	}
+	tags := make(map[string]map[string]string)
+	for region, instanceIds := range m.instanceIdsByRegion(instances) {
+		regionTags, err := m.serviceFor(AwsRef{Region: region}).getInstanceTags(ctx, instanceIds, m.instanceTagLabelKeys)
+		if err != nil {
+			klog.Warningf("Failed to describe instance tags, keeping the previous instance tag labels: %v", err)
+			return m.instanceTagLabels
+		}
+		for id, instanceTags := range regionTags {
+			tags[id] = instanceTags
+		}
+	}
+
+	conflicts := make(map[AwsRef]map[string]bool)
+	for ref, asg := range m.instanceToAsg {
+		if _, found := result[asg.AwsRef]; !found {
+			result[asg.AwsRef] = make(map[string]string)
+			conflicts[asg.AwsRef] = make(map[string]bool)
+		}
+		for key, value := range tags[ref.Name] {
+			if existing, found := result[asg.AwsRef][key]; found && existing != value {
+				conflicts[asg.AwsRef][key] = true
+			}
+			result[asg.AwsRef][key] = value
+		}
+	}
+	for asgRef, keys := range conflicts {
+		for key := range keys {
+			klog.V(4).Infof("Instances of ASG %s have different values for tag %s, not using it as a label", asgRef.Name, key)
+			delete(result[asgRef], key)
+		}
+	}
+	return result
+}
+
+// InstanceTagLabels returns a copy of the template labels of the ASG taken from the tags
+// of its instances.
+func (m *asgCache) InstanceTagLabels(ref AwsRef) map[string]string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	labels := make(map[string]string, len(m.instanceTagLabels[ref]))
+	for k, v := range m.instanceTagLabels[ref] {
+		labels[k] = v
+	}
+	return labels
+}
+
+// applyEksNodegroupScalingConfig sets the min and max sizes of an ASG backing an EKS
+// managed node group from the scaling config of the node group, which EKS enforces over
+// the ASG. The desired size is still the one of the ASG, which is what the node group
+// scales. ASGs not created by EKS are left untouched, as are the sizes of node groups
+// that can't be described. Described node groups are cached for eksNodegroupCacheTTL.
+func (m *asgCache) applyEksNodegroupScalingConfig(ctx context.Context, asg *asg) {
+	nodegroupName, found := asg.tagValue(eksNodegroupNameTag)
+	if !found {
+		return
+	}
+	clusterName, found := asg.tagValue(eksClusterNameTag)
+	if !found {
+		klog.Warningf("ASG %s of EKS node group %s has no %s tag, using the ASG sizes", asg.Name, nodegroupName, eksClusterNameTag)
+		return
+	}
+
+	nodegroup, err := m.getEksNodegroup(ctx, asg.AwsRef, clusterName, nodegroupName)
+	if err != nil {
+		klog.Warningf("Failed to describe EKS node group %s of cluster %s, using the sizes of ASG %s: %v", nodegroupName, clusterName, asg.Name, err)
+		return
+	}
+	backed := false
+	if nodegroup.Resources != nil {
+		for _, group := range nodegroup.Resources.AutoScalingGroups {
+			if aws.StringValue(group.Name) == asg.Name {
+				backed = true
+				break
+			}
+		}
+	}
+	if !backed {
+		klog.Warningf("EKS node group %s of cluster %s is not backed by ASG %s, using the ASG sizes", nodegroupName, clusterName, asg.Name)
+		return
+	}
+	if nodegroup.ScalingConfig == nil {
+		return
+	}
+
+	asg.minSize = int(aws.Int64Value(nodegroup.ScalingConfig.MinSize))
+	asg.maxSize = int(aws.Int64Value(nodegroup.ScalingConfig.MaxSize))
+	klog.V(4).Infof("ASG %s sized by EKS node group %s: min %d, max %d", asg.Name, nodegroupName, asg.minSize, asg.maxSize)
+}
+
+// getEksNodegroup returns the EKS managed node group of the region of the ASG, from the
+// cache if it was described within eksNodegroupCacheTTL.
+func (m *asgCache) getEksNodegroup(ctx context.Context, ref AwsRef, clusterName, nodegroupName string) (*eks.Nodegroup, error) {
+	key := eksNodegroupKey(ref.Region, clusterName, nodegroupName)
+	if obj, found, _ := m.eksNodegroupCache.GetByKey(key); found {
+		return obj.(eksNodegroupCachedObject).nodegroup, nil
+	}
+	nodegroup, err := m.serviceFor(ref).getEksNodegroup(ctx, clusterName, nodegroupName)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.eksNodegroupCache.Add(eksNodegroupCachedObject{key: key, nodegroup: nodegroup}); err != nil {
+		klog.Warningf("Failed to cache EKS node group %s of cluster %s: %v", nodegroupName, clusterName, err)
+	}
+	return nodegroup, nil
+}
+
+// updateLaunchTemplateProperties sets whether the launch template of the ASG targets a
+// capacity reservation and the IP family of its instances. Launch templates already
+// looked up are taken from the given map. The properties are left unchanged when the
+// launch template can't be described.
+func (m *asgCache) updateLaunchTemplateProperties(ctx context.Context, asg *asg, cache map[launchTemplate]launchTemplateProperties) {
+	lt := asg.effectiveLaunchTemplate()
+	if lt == nil {
+		asg.CapacityReservationTargeted = false
+		asg.IPFamily = apiv1.IPv4Protocol
+		asg.RootVolume = nil
+		return
+	}
+
+	props, found := cache[*lt]
+	if !found {
+		var err error
+		props, err = m.serviceFor(asg.AwsRef).getLaunchTemplateProperties(ctx, lt)
+		if err != nil {
+			klog.Warningf("Failed to check capacity reservation and IP family of launch template %s of ASG %s, keeping the previous ones: %v", lt.name, asg.Name, err)
+			return
+		}
+		cache[*lt] = props
+	}
+	asg.CapacityReservationTargeted = props.capacityReservationTargeted
+	asg.IPFamily = props.ipFamily
+	asg.RootVolume = props.rootVolume
+}
+
+// capNodeGroups keeps at most maxNodeGroups ASGs. Explicitly configured ASGs are kept
+// first, then the auto-discovered ones in name order, so the result doesn't depend on
+// the order in which AWS returned them.
+func (m *asgCache) capNodeGroups(groups []*autoscaling.Group) []*autoscaling.Group {
+	if m.maxNodeGroups <= 0 || len(groups) <= m.maxNodeGroups {
+		return groups
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		iRef, jRef := m.refForGroup(groups[i]), m.refForGroup(groups[j])
+		iExplicit, jExplicit := m.explicitlyConfigured[iRef], m.explicitlyConfigured[jRef]
+		if iExplicit != jExplicit {
+			return iExplicit
+		}
+		return iRef.Id() < jRef.Id()
+	})
+
+	dropped := make([]string, 0, len(groups)-m.maxNodeGroups)
+	for _, group := range groups[m.maxNodeGroups:] {
+		dropped = append(dropped, m.refForGroup(group).Id())
+	}
+	klog.Warningf("Found %d ASGs, more than the maximum of %d node groups, ignoring: %v", len(groups), m.maxNodeGroups, dropped)
+	return groups[:m.maxNodeGroups]
+}
+
+// excludeWarmPoolInstances removes the instances kept in the warm pool of an ASG
+// from its instances, as they don't count towards the desired capacity.
+func (m *asgCache) excludeWarmPoolInstances(ctx context.Context, groups []*autoscaling.Group) {
+	for _, g := range groups {
+		if g.WarmPoolConfiguration == nil {
+			continue
+		}
+
+		warmPoolInstanceIds, err := m.serviceFor(m.refForGroup(g)).getWarmPoolInstanceIds(ctx, aws.StringValue(g.AutoScalingGroupName))
+		if err != nil {
+			klog.Warningf("Failed to describe warm pool of ASG %s, using all instances: %v", aws.StringValue(g.AutoScalingGroupName), err)
+			warmPoolInstanceIds = map[string]bool{}
+		}
+
+		instances := make([]*autoscaling.Instance, 0, len(g.Instances))
+		for _, instance := range g.Instances {
+			if warmPoolInstanceIds[aws.StringValue(instance.InstanceId)] ||
+				strings.HasPrefix(aws.StringValue(instance.LifecycleState), "Warmed:") {
+				continue
+			}
+			instances = append(instances, instance)
+		}
+		if excluded := len(g.Instances) - len(instances); excluded > 0 {
+			klog.V(4).Infof("Excluded %d warm pool instances of ASG %s", excluded, aws.StringValue(g.AutoScalingGroupName))
+		}
+		g.Instances = instances
+	}
+}
+
+func (m *asgCache) createPlaceholdersForDesiredNonStartedInstances(ctx context.Context, groups []*autoscaling.Group) []*autoscaling.Group {
 	for _, g := range groups {
-		desired := *g.DesiredCapacity
+		desired := int64(unitsToInstances(int(aws.Int64Value(g.DesiredCapacity)), groupCapacityWeight(g)))
 		realInstances := int64(len(g.Instances))
 		if desired <= realInstances {
 			continue
@@ -422,16 +1742,19 @@ func (m *asgCache) createPlaceholdersForDesiredNonStartedInstances(groups []*aut
 			"Creating placeholder instances.", *g.AutoScalingGroupName, realInstances, desired)
 
 		healthStatus := ""
-		isAvailable, err := m.isNodeGroupAvailable(g)
+		isAvailable, reason, err := m.isNodeGroupAvailable(ctx, g)
 		if err != nil {
 			klog.V(4).Infof("Could not check instance availability, creating placeholder node anyways: %v", err)
 		} else if !isAvailable {
 			klog.Warningf("Instance group %s cannot provision any more nodes!", *g.AutoScalingGroupName)
 			healthStatus = placeholderUnfulfillableStatus
+			if reason != "" {
+				healthStatus = fmt.Sprintf("%s: %s", placeholderUnfulfillableStatus, reason)
+			}
 		}
 
 		for i := realInstances; i < desired; i++ {
-			id := fmt.Sprintf("%s-%s-%d", placeholderInstanceNamePrefix, *g.AutoScalingGroupName, i)
+			id := placeholderInstanceId(*g.AutoScalingGroupName, int(i))
 			g.Instances = append(g.Instances, &autoscaling.Instance{
 				InstanceId:       &id,
 				AvailabilityZone: g.AvailabilityZones[0],
@@ -442,31 +1765,42 @@ func (m *asgCache) createPlaceholdersForDesiredNonStartedInstances(groups []*aut
 	return groups
 }
 
-func (m *asgCache) isNodeGroupAvailable(group *autoscaling.Group) (bool, error) {
+// isNodeGroupAvailable checks the scaling activities of the ASG since its last size
+// update, and returns false with the status message of the activity if one failed.
+func (m *asgCache) isNodeGroupAvailable(ctx context.Context, group *autoscaling.Group) (bool, string, error) {
 	input := &autoscaling.DescribeScalingActivitiesInput{
 		AutoScalingGroupName: group.AutoScalingGroupName,
 	}
 
-	response, err := m.awsService.DescribeScalingActivities(input)
+	asgRef := m.refForGroup(group)
+	response, err := m.serviceFor(asgRef).DescribeScalingActivitiesWithContext(ctx, input)
 	if err != nil {
-		return true, err // If we can't describe the scaling activities we assume the node group is available
+		return true, "", err // If we can't describe the scaling activities we assume the node group is available
 	}
 
 	for _, activity := range response.Activities {
-		asgRef := AwsRef{Name: *group.AutoScalingGroupName}
 		if a, ok := m.registeredAsgs[asgRef]; ok {
 			lut := a.lastUpdateTime
 			if activity.StartTime.Before(lut) {
 				break
 			} else if *activity.StatusCode == "Failed" {
 				klog.Warningf("ASG %s scaling failed with %s", asgRef.Name, *activity)
-				return false, nil
+				return false, aws.StringValue(activity.StatusMessage), nil
 			}
 		} else {
 			klog.V(4).Infof("asg %v is not registered yet, skipping DescribeScalingActivities check", asgRef.Name)
 		}
 	}
-	return true, nil
+	return true, "", nil
+}
+
+// unfulfillablePlaceholderReason returns whether the given instance status is the one of
+// a placeholder that cannot be fulfilled, and the reason of the failure if known.
+func unfulfillablePlaceholderReason(status *string) (string, bool) {
+	if status == nil || !strings.HasPrefix(*status, placeholderUnfulfillableStatus) {
+		return "", false
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(*status, placeholderUnfulfillableStatus), ": "), true
 }
 
 func (m *asgCache) buildAsgFromAWS(g *autoscaling.Group) (*asg, error) {
@@ -482,7 +1816,7 @@ func (m *asgCache) buildAsgFromAWS(g *autoscaling.Group) (*asg, error) {
 	}
 
 	asg := &asg{
-		AwsRef:  AwsRef{Name: spec.Name},
+		AwsRef:  m.refForGroup(g),
 		minSize: spec.MinSize,
 		maxSize: spec.MaxSize,
 
@@ -490,6 +1824,19 @@ func (m *asgCache) buildAsgFromAWS(g *autoscaling.Group) (*asg, error) {
 		AvailabilityZones:       aws.StringValueSlice(g.AvailabilityZones),
 		LaunchConfigurationName: aws.StringValue(g.LaunchConfigurationName),
 		Tags:                    g.Tags,
+		TerminationPolicies:     aws.StringValueSlice(g.TerminationPolicies),
+	}
+
+	if subnets := aws.StringValue(g.VPCZoneIdentifier); subnets != "" {
+		asg.SubnetIds = strings.Split(subnets, ",")
+	}
+
+	for _, process := range g.SuspendedProcesses {
+		asg.SuspendedProcesses = append(asg.SuspendedProcesses, aws.StringValue(process.ProcessName))
+	}
+
+	if g.LaunchTemplate != nil {
+		asg.LaunchTemplate = buildLaunchTemplateFromSpec(g.LaunchTemplate)
 	}
 
 	if g.MixedInstancesPolicy != nil {
@@ -511,8 +1858,14 @@ func (m *asgCache) buildAsgFromAWS(g *autoscaling.Group) (*asg, error) {
 		}
 
 		asg.MixedInstancesPolicy = &mixedInstancesPolicy{
+			launchTemplate:                buildLaunchTemplateFromSpec(g.MixedInstancesPolicy.LaunchTemplate.LaunchTemplateSpecification),
 			instanceTypesOverrides:        getInstanceTypes(g.MixedInstancesPolicy.LaunchTemplate.Overrides),
 			instanceRequirementsOverrides: getInstanceTypeRequirements(g.MixedInstancesPolicy.LaunchTemplate.Overrides),
+			instancesDistribution:         g.MixedInstancesPolicy.InstancesDistribution,
+			instanceTypeWeights:           getInstanceTypeWeights(asg.Name, g.MixedInstancesPolicy.LaunchTemplate.Overrides),
+		}
+		if distribution := g.MixedInstancesPolicy.InstancesDistribution; distribution != nil {
+			asg.SpotAllocationStrategy = aws.StringValue(distribution.SpotAllocationStrategy)
 		}
 
 		if len(asg.MixedInstancesPolicy.instanceTypesOverrides) != 0 && asg.MixedInstancesPolicy.instanceRequirementsOverrides != nil {
@@ -520,9 +1873,152 @@ func (m *asgCache) buildAsgFromAWS(g *autoscaling.Group) (*asg, error) {
 		}
 	}
 
+	// AWS sizes are in capacity units when the overrides are weighted, the cache keeps instances
+	if weight := asg.capacityWeight(); weight > 1 {
+		asg.minSize = unitsToInstances(asg.minSize, weight)
+		asg.maxSize = asg.maxSize / weight
+		asg.curSize = unitsToInstances(asg.curSize, weight)
+	}
+
+	asg.minSize, asg.maxSize = sizeOverridesFromTags(asg.Name, g.Tags, asg.minSize, asg.maxSize)
+
 	return asg, nil
 }
 
+// getInstanceTypeWeights returns the WeightedCapacity of the overrides by instance type.
+// Overrides without a valid weight count as one unit.
+func getInstanceTypeWeights(asgName string, overrides []*autoscaling.LaunchTemplateOverrides) map[string]int64 {
+	weights := map[string]int64{}
+	for _, override := range overrides {
+		if override.InstanceType == nil || override.WeightedCapacity == nil {
+			continue
+		}
+		weight, err := strconv.ParseInt(aws.StringValue(override.WeightedCapacity), 10, 64)
+		if err != nil || weight < 1 {
+			klog.Warningf("Ignoring invalid weighted capacity %q of instance type %s in ASG %s",
+				aws.StringValue(override.WeightedCapacity), aws.StringValue(override.InstanceType), asgName)
+			continue
+		}
+		weights[aws.StringValue(override.InstanceType)] = weight
+	}
+	return weights
+}
+
+// diversifiedCapacity returns whether the ASG launches spot instances of any of its
+// instance type overrides depending on the available capacity, rather than the first one.
+func (a *asg) diversifiedCapacity() bool {
+	if a.MixedInstancesPolicy == nil || len(a.MixedInstancesPolicy.instanceTypesOverrides) < 2 {
+		return false
+	}
+	switch a.SpotAllocationStrategy {
+	case "capacity-optimized", "capacity-optimized-prioritized", "price-capacity-optimized":
+		return true
+	}
+	return false
+}
+
+// capacityWeight returns the number of capacity units provided by one instance of the ASG.
+// The node group is modelled after the first instance type override, so its weight is
+// used for the whole ASG.
+func (a *asg) capacityWeight() int {
+	if a.MixedInstancesPolicy == nil || len(a.MixedInstancesPolicy.instanceTypesOverrides) == 0 {
+		return 1
+	}
+	if weight, found := a.MixedInstancesPolicy.instanceTypeWeights[a.MixedInstancesPolicy.instanceTypesOverrides[0]]; found {
+		return int(weight)
+	}
+	return 1
+}
+
+// groupCapacityWeight returns the capacity weight of an ASG as described by AWS, before
+// it's built into the cache. See capacityWeight.
+func groupCapacityWeight(g *autoscaling.Group) int {
+	if g.MixedInstancesPolicy == nil || g.MixedInstancesPolicy.LaunchTemplate == nil {
+		return 1
+	}
+	for _, override := range g.MixedInstancesPolicy.LaunchTemplate.Overrides {
+		if override.InstanceType == nil {
+			continue
+		}
+		weight, err := strconv.Atoi(aws.StringValue(override.WeightedCapacity))
+		if err != nil || weight < 1 {
+			return 1
+		}
+		return weight
+	}
+	return 1
+}
+
+// unitsToInstances converts capacity units to the number of instances providing them.
+func unitsToInstances(units, weight int) int {
+	return (units + weight - 1) / weight
+}
+
+// ipFamily returns the primary IP family of the instances of the ASG. It is IPv4 until
+// the launch template of the ASG has been looked up, and for launch configurations.
+func (a *asg) ipFamily() apiv1.IPFamily {
+	if a.IPFamily == "" {
+		return apiv1.IPv4Protocol
+	}
+	return a.IPFamily
+}
+
+// tagValue returns the value of the given ASG tag and whether the tag is present.
+func (a *asg) tagValue(key string) (string, bool) {
+	for _, tag := range a.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), true
+		}
+	}
+	return "", false
+}
+
+// sizeOverridesFromTags returns the min and max sizes of an ASG, overridden by the
+// node-template min/max tags when present. Malformed tags are ignored with a warning
+// and the given defaults are kept.
+func sizeOverridesFromTags(name string, tags []*autoscaling.TagDescription, minSize, maxSize int) (int, int) {
+	newMin, newMax := minSize, maxSize
+	for _, tag := range tags {
+		key := aws.StringValue(tag.Key)
+		if key != nodeTemplateMinSizeTag && key != nodeTemplateMaxSizeTag {
+			continue
+		}
+		value, err := strconv.Atoi(aws.StringValue(tag.Value))
+		if err != nil || value < 0 {
+			klog.Warningf("Ignoring size overrides of ASG %s: invalid value %q for tag %s", name, aws.StringValue(tag.Value), key)
+			return minSize, maxSize
+		}
+		if key == nodeTemplateMinSizeTag {
+			newMin = value
+		} else {
+			newMax = value
+		}
+	}
+	if newMin > newMax {
+		klog.Warningf("Ignoring size overrides of ASG %s: min size %d is greater than max size %d", name, newMin, newMax)
+		return minSize, maxSize
+	}
+	return newMin, newMax
+}
+
+// extractAutoscalingOptionsFromTags returns the autoscaling options set on the ASG
+// through optionsTagsPrefix tags, keyed by option name.
+func extractAutoscalingOptionsFromTags(tags []*autoscaling.TagDescription) map[string]string {
+	options := make(map[string]string)
+	for _, tag := range tags {
+		key := aws.StringValue(tag.Key)
+		if !strings.HasPrefix(key, optionsTagsPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, optionsTagsPrefix)
+		if name == "" {
+			continue
+		}
+		options[name] = aws.StringValue(tag.Value)
+	}
+	return options
+}
+
 func (m *asgCache) buildInstanceRefFromAWS(instance *autoscaling.Instance) AwsInstanceRef {
 	providerID := fmt.Sprintf("aws:///%s/%s", aws.StringValue(instance.AvailabilityZone), aws.StringValue(instance.InstanceId))
 	return AwsInstanceRef{
@@ -531,6 +2027,66 @@ func (m *asgCache) buildInstanceRefFromAWS(instance *autoscaling.Instance) AwsIn
 	}
 }
 
+// InstancesPerZone returns the number of instances of the ASG in each availability zone.
+// Placeholders for instances that are not created yet are not counted.
+func (m *asgCache) InstancesPerZone(ref AwsRef) map[string]int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for _, instance := range m.asgToInstances[ref] {
+		if m.isPlaceholderInstance(&instance) {
+			continue
+		}
+		counts[zoneFromProviderId(instance.ProviderID)]++
+	}
+	return counts
+}
+
+// AsgSnapshot is the cached view of the sizes of an ASG, for debugging.
+type AsgSnapshot struct {
+	Name    string `json:"name"`
+	Min     int    `json:"min"`
+	Max     int    `json:"max"`
+	Desired int    `json:"desired"`
+	// InstanceCount excludes placeholders of instances that haven't been launched
+	InstanceCount int      `json:"instanceCount"`
+	Zones         []string `json:"zones"`
+}
+
+// Snapshot returns the cached sizes of all the registered ASGs, sorted by name.
+func (m *asgCache) Snapshot() []AsgSnapshot {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	snapshots := make([]AsgSnapshot, 0, len(m.registeredAsgs))
+	for ref, asg := range m.registeredAsgs {
+		instanceCount := 0
+		for _, instance := range m.asgToInstances[ref] {
+			if !m.isPlaceholderInstance(&instance) {
+				instanceCount++
+			}
+		}
+		snapshots = append(snapshots, AsgSnapshot{
+			Name:          asg.Name,
+			Min:           asg.minSize,
+			Max:           asg.maxSize,
+			Desired:       asg.curSize,
+			InstanceCount: instanceCount,
+			Zones:         append([]string(nil), asg.AvailabilityZones...),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+	return snapshots
+}
+
+// zoneFromProviderId returns the zone of a provider ID in format aws:///<zone>/<name>.
+func zoneFromProviderId(providerID string) string {
+	return strings.SplitN(strings.TrimPrefix(providerID, "aws:///"), "/", 2)[0]
+}
+
 // Cleanup closes the channel to signal the go routine to stop that is handling the cache
 func (m *asgCache) Cleanup() {
 	close(m.interrupt)
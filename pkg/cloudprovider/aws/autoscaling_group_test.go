@@ -0,0 +1,544 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/eks"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// sortedNames returns the sorted names of the node groups of the manager.
+func sortedNames(manager *AwsManager) []string {
+	names, _ := diffNames(map[string]bool{}, manager.asgCache.names())
+	return names
+}
+
+func TestRegenerateCapsNodeGroups(t *testing.T) {
+	autoScaling := &fakeAutoScaling{}
+	for i := 5; i >= 1; i-- {
+		autoScaling.groups = append(autoScaling.groups, testGroup(fmt.Sprintf("asg-%d", i), 0, 0, 5))
+	}
+	manager := newTestManager(t, autoScaling, nil)
+	if err := manager.SetMaxNodeGroups(3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The first ASGs by name are kept, whatever order AWS returns them in
+	if names := sortedNames(manager); !reflect.DeepEqual(names, []string{"asg-1", "asg-2", "asg-3"}) {
+		t.Errorf("expected the cap to keep asg-1 to asg-3, got %v", names)
+	}
+}
+
+func TestSetAsgSizeReportsFailedScalingActivity(t *testing.T) {
+	autoScaling := &fakeAutoScaling{
+		groups:                []*autoscaling.Group{testGroup("asg-1", 0, 1, 5, "i-1")},
+		setDesiredCapacityErr: errors.New("ScalingActivityInProgress"),
+		activities: map[string][]*autoscaling.Activity{"asg-1": {{
+			ActivityId:    aws.String("activity-123"),
+			StatusCode:    aws.String(autoscaling.ScalingActivityStatusCodeFailed),
+			StatusMessage: aws.String("We currently do not have sufficient capacity"),
+		}}},
+	}
+	manager := newTestManager(t, autoScaling, nil)
+
+	err := testNodeGroup(t, manager, "asg-1").IncreaseSize(1)
+	var activityErr *ScalingActivityError
+	if !errors.As(err, &activityErr) || activityErr.ActivityId != "activity-123" {
+		t.Fatalf("expected a ScalingActivityError of activity-123, got %v", err)
+	}
+	if !errorContains(err, "activity-123", "sufficient capacity") {
+		t.Errorf("expected the activity ID and status message in the error, got %v", err)
+	}
+}
+
+func TestSetAsgSizeResumesSuspendedProcesses(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		resume, resuspend bool
+		suspendedAfter    bool
+	}{
+		{name: "disabled", suspendedAfter: true},
+		{name: "resume", resume: true},
+		{name: "resume and resuspend", resume: true, resuspend: true, suspendedAfter: true},
+	} {
+		group := testGroup("asg-1", 0, 1, 5, "i-1")
+		group.SuspendedProcesses = []*autoscaling.SuspendedProcess{{ProcessName: aws.String(scalingProcessLaunch)}}
+		autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{group}}
+		manager := newTestManager(t, autoScaling, nil)
+		manager.SetFailOnSuspendedProcesses(true)
+		manager.SetResumeSuspendedProcesses(tc.resume, tc.resuspend)
+		nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+		err := nodeGroup.IncreaseSize(1)
+		if tc.resume && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if !tc.resume && !errorContains(err, "Launch process is suspended") {
+			t.Errorf("%s: expected the size change to fail, got %v", tc.name, err)
+		}
+
+		expectedCalls := map[string]int{"SetDesiredCapacity": 0, "ResumeProcesses": 0, "SuspendProcesses": 0}
+		if tc.resume {
+			expectedCalls["SetDesiredCapacity"] = 1
+			expectedCalls["ResumeProcesses"] = 1
+		}
+		if tc.resuspend {
+			expectedCalls["SuspendProcesses"] = 1
+		}
+		for method, expected := range expectedCalls {
+			if calls := autoScaling.callCount(method); calls != expected {
+				t.Errorf("%s: expected %d %s calls, got %d", tc.name, expected, method, calls)
+			}
+		}
+		if suspended := len(autoScaling.group("asg-1").SuspendedProcesses) > 0; suspended != tc.suspendedAfter {
+			t.Errorf("%s: expected the Launch process to be suspended: %v, got %v", tc.name, tc.suspendedAfter, suspended)
+		}
+		if suspended := nodeGroup.LaunchSuspended(); suspended != tc.suspendedAfter {
+			t.Errorf("%s: expected the cached Launch process to be suspended: %v, got %v", tc.name, tc.suspendedAfter, suspended)
+		}
+	}
+}
+
+func TestRegenerateFollowsAllPages(t *testing.T) {
+	autoScaling := &fakeAutoScaling{pageSize: 2}
+	for i := 1; i <= 5; i++ {
+		autoScaling.groups = append(autoScaling.groups, testGroup(fmt.Sprintf("asg-%d", i), 0, 0, 5))
+	}
+	manager := newTestManager(t, autoScaling, nil)
+
+	asgs := manager.asgCache.Get()
+	if len(asgs) != 5 {
+		t.Fatalf("expected the 5 ASGs of the 3 pages, got %d", len(asgs))
+	}
+	for i := 1; i <= 5; i++ {
+		if _, found := asgs[AwsRef{Name: fmt.Sprintf("asg-%d", i)}]; !found {
+			t.Errorf("expected asg-%d to be cached", i)
+		}
+	}
+}
+
+func TestNoPlaceholdersForWeightedCapacity(t *testing.T) {
+	stubInstanceTypes(t, map[string]string{"weighted": "m5.xlarge"})
+	group := withMixedInstancesPolicy(testGroup("weighted", 0, 6, 20, "i-1", "i-2", "i-3"), nil,
+		&autoscaling.LaunchTemplateOverrides{InstanceType: aws.String("m5.xlarge"), WeightedCapacity: aws.String("2")},
+		&autoscaling.LaunchTemplateOverrides{InstanceType: aws.String("m5.large"), WeightedCapacity: aws.String("1")})
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{group}}, nil)
+
+	instances, err := manager.GetAsgNodes(AwsRef{Name: "weighted"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, instance := range instances {
+		if manager.asgCache.isPlaceholderInstance(&instance) {
+			t.Errorf("expected no placeholder for 6 units provided by 3 instances, got %s", instance.Name)
+		}
+	}
+	if size, _ := testNodeGroup(t, manager, "weighted").TargetSize(); size != 3 {
+		t.Errorf("expected target size 3, got %d", size)
+	}
+}
+
+func TestCapacityWeightConversion(t *testing.T) {
+	for _, tc := range []struct {
+		units, weight, instances int
+	}{
+		{0, 2, 0},
+		{6, 2, 3},
+		{7, 2, 4},
+		{5, 1, 5},
+		{1, 4, 1},
+	} {
+		if instances := unitsToInstances(tc.units, tc.weight); instances != tc.instances {
+			t.Errorf("expected %d units of weight %d to be %d instances, got %d", tc.units, tc.weight, tc.instances, instances)
+		}
+	}
+
+	for _, tc := range []struct {
+		weightedCapacity *string
+		weight           int
+	}{
+		{aws.String("2"), 2},
+		{nil, 1},
+		{aws.String("invalid"), 1},
+		{aws.String("0"), 1},
+	} {
+		group := withMixedInstancesPolicy(testGroup("weighted", 0, 0, 5), nil,
+			&autoscaling.LaunchTemplateOverrides{InstanceType: aws.String("m5.xlarge"), WeightedCapacity: tc.weightedCapacity})
+		if weight := groupCapacityWeight(group); weight != tc.weight {
+			t.Errorf("expected weight %d for weighted capacity %v, got %d", tc.weight, aws.StringValue(tc.weightedCapacity), weight)
+		}
+	}
+	if weight := groupCapacityWeight(testGroup("plain", 0, 0, 5)); weight != 1 {
+		t.Errorf("expected weight 1 without mixed instances policy, got %d", weight)
+	}
+}
+
+func TestRegenerateDropsDisabledAsgs(t *testing.T) {
+	disabled := testGroup("disabled", 0, 0, 5)
+	// It still matches the auto discovery spec, which only requires the tag key
+	disabled.Tags[0].Value = aws.String("false")
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("workers", 0, 0, 5), disabled}}
+	manager := newTestManager(t, autoScaling, nil)
+
+	if asgs := manager.asgCache.Get(); len(asgs) != 1 || asgs[AwsRef{Name: "workers"}] == nil {
+		t.Errorf("expected only workers to be discovered, got %v", asgs)
+	}
+
+	// Disabling autoscaling of a registered ASG unregisters it on the next refresh
+	autoScaling.mutex.Lock()
+	autoScaling.groups[0].Tags[0].Value = aws.String("false")
+	autoScaling.mutex.Unlock()
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if asgs := manager.asgCache.Get(); len(asgs) != 0 {
+		t.Errorf("expected no ASG to be discovered, got %v", asgs)
+	}
+}
+
+func TestRegenerateDropsExcludedAsgs(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{
+		testGroup("workers", 0, 0, 5),
+		testGroup("gpu-workers", 0, 0, 5),
+		testGroup("ingress", 0, 0, 5),
+	}}
+	manager := newTestManager(t, autoScaling, nil)
+	if err := manager.SetExcludedAsgs([]string{"ingress"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	provider := &awsCloudProvider{awsManager: manager}
+	if nodeGroups := provider.NodeGroups(); len(nodeGroups) != 2 {
+		t.Errorf("expected 2 node groups, got %d", len(nodeGroups))
+	}
+	if names := sortedNames(manager); !reflect.DeepEqual(names, []string{"gpu-workers", "workers"}) {
+		t.Errorf("expected ingress to be excluded, got %v", names)
+	}
+
+	// Exclusions are whole name regular expressions
+	if err := manager.SetExcludedAsgs([]string{".*workers"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := sortedNames(manager); !reflect.DeepEqual(names, []string{"ingress"}) {
+		t.Errorf("expected only ingress to be kept, got %v", names)
+	}
+}
+
+func TestSetAsgSizeOfDeletedAsg(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{
+		testGroup("discovered", 0, 1, 5, "i-1"),
+		testGroup("explicit", 0, 1, 5, "i-2"),
+	}}
+	discoveryConfigs, err := parseASGAutoDiscoverySpecs([]string{testAutoDiscoverySpec})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cache, err := newASGCache(&awsWrapper{autoScalingI: autoScaling, ec2I: &fakeEC2{}}, []string{"0:5:explicit"}, discoveryConfigs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := cache.regenerate(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	asgs := cache.Get()
+	discovered, explicit := asgs[AwsRef{Name: "discovered"}], asgs[AwsRef{Name: "explicit"}]
+	if discovered == nil || explicit == nil {
+		t.Fatalf("expected both ASGs to be cached, got %v", asgs)
+	}
+
+	// Both ASGs are deleted in AWS
+	autoScaling.groups = nil
+	for _, asg := range []*asg{discovered, explicit} {
+		if err := cache.SetAsgSize(context.Background(), asg, 2); !errors.Is(err, ErrASGNotFound) {
+			t.Errorf("expected ErrASGNotFound for %s, got %v", asg.Name, err)
+		}
+	}
+
+	asgs = cache.Get()
+	if _, found := asgs[AwsRef{Name: "discovered"}]; found {
+		t.Error("expected the auto-discovered ASG to be unregistered")
+	}
+	if _, found := asgs[AwsRef{Name: "explicit"}]; !found {
+		t.Error("expected the explicitly configured ASG to stay registered")
+	}
+	if asg := cache.FindForInstance(AwsInstanceRef{ProviderID: "aws:///us-east-1a/i-2", Name: "i-2"}); asg != nil {
+		t.Errorf("expected the instances of the deleted ASG to be forgotten, got %s", asg.Name)
+	}
+}
+
+func TestRefreshInstanceStatesInBatches(t *testing.T) {
+	var ids []string
+	for i := 0; i < 120; i++ {
+		ids = append(ids, fmt.Sprintf("i-%d", i))
+	}
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 120, 200, ids...)}}
+	manager := newTestManager(t, autoScaling, nil)
+
+	// The states change in AWS after the refresh
+	for i, instance := range autoScaling.groups[0].Instances {
+		switch i % 3 {
+		case 1:
+			instance.HealthStatus = aws.String("Unhealthy")
+		case 2:
+			instance.LifecycleState = aws.String(autoscaling.LifecycleStateTerminating)
+			instance.ProtectedFromScaleIn = aws.Bool(true)
+		}
+	}
+
+	var refs []AwsInstanceRef
+	for _, id := range ids {
+		ref, _ := AwsRefFromProviderId(testNode(id).Spec.ProviderID)
+		refs = append(refs, *ref)
+	}
+	calls := autoScaling.callCount("DescribeAutoScalingInstances")
+	if err := manager.RefreshInstanceStates(context.Background(), refs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := autoScaling.callCount("DescribeAutoScalingInstances") - calls; calls != 3 {
+		t.Errorf("expected 3 DescribeAutoScalingInstances calls, got %d", calls)
+	}
+
+	states, err := manager.GetAsgInstanceStates(AwsRef{Name: "asg-1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, ref := range refs {
+		expected := InstanceState{HealthStatus: "Healthy", LifecycleState: autoscaling.LifecycleStateInService}
+		switch i % 3 {
+		case 1:
+			expected.HealthStatus = "Unhealthy"
+		case 2:
+			expected.LifecycleState = autoscaling.LifecycleStateTerminating
+		}
+		if states[ref] != expected {
+			t.Errorf("expected state %+v of %s, got %+v", expected, ref.Name, states[ref])
+		}
+		if protected := manager.asgCache.IsInstanceProtected(ref); protected != (i%3 == 2) {
+			t.Errorf("expected %s protected=%v, got %v", ref.Name, i%3 == 2, protected)
+		}
+	}
+}
+
+func TestEksNodegroupScalingConfig(t *testing.T) {
+	group := testGroup("eks-workers", 1, 3, 10, "i-1", "i-2", "i-3")
+	withTag(group, eksNodegroupNameTag, "workers")
+	withTag(group, eksClusterNameTag, "cluster")
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{group, testGroup("plain", 1, 1, 10, "i-4")}}
+	eksService := &fakeEKS{nodegroups: map[string]*eks.Nodegroup{"workers": {
+		NodegroupName: aws.String("workers"),
+		ScalingConfig: &eks.NodegroupScalingConfig{MinSize: aws.Int64(2), MaxSize: aws.Int64(5), DesiredSize: aws.Int64(4)},
+		Resources:     &eks.NodegroupResources{AutoScalingGroups: []*eks.AutoScalingGroup{{Name: aws.String("eks-workers")}}},
+	}}}
+	manager, err := createAWSManagerInternal(&awsWrapper{autoScalingI: autoScaling, ec2I: &fakeEC2{}, eksI: eksService},
+		InstanceTypes, InstanceTypeSourceStatic, []string{testAutoDiscoverySpec})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	manager.SetEksNodegroupDiscovery(true)
+
+	for i := 0; i < 3; i++ {
+		if err := manager.forceRefresh(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := manager.asgCache.RefreshAsg(context.Background(), AwsRef{Name: "eks-workers"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The min and max come from the node group, the desired size from the ASG
+	nodeGroup := testNodeGroup(t, manager, "eks-workers")
+	if nodeGroup.MinSize() != 2 || nodeGroup.MaxSize() != 5 {
+		t.Errorf("expected the sizes of the node group, got min %d, max %d", nodeGroup.MinSize(), nodeGroup.MaxSize())
+	}
+	if size, _ := nodeGroup.TargetSize(); size != 3 {
+		t.Errorf("expected the desired size of the ASG, got %d", size)
+	}
+	if plain := testNodeGroup(t, manager, "plain"); plain.MinSize() != 1 || plain.MaxSize() != 10 {
+		t.Errorf("expected the sizes of the plain ASG, got min %d, max %d", plain.MinSize(), plain.MaxSize())
+	}
+	// The node group is only described once over the refreshes
+	if eksService.calls != 1 {
+		t.Errorf("expected 1 DescribeNodegroup call, got %d", eksService.calls)
+	}
+}
+
+func TestLaunchTemplatePropertiesKeptOnDescribeError(t *testing.T) {
+	group := testGroup("ipv6", 0, 0, 5)
+	group.LaunchTemplate = &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String("lt-ipv6"), Version: aws.String("1")}
+	ec2Service := &fakeEC2{launchTemplateVersions: func(*ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+		return &ec2.DescribeLaunchTemplateVersionsOutput{LaunchTemplateVersions: []*ec2.LaunchTemplateVersion{{
+			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{
+				NetworkInterfaces: []*ec2.LaunchTemplateInstanceNetworkInterfaceSpecification{{Ipv6AddressCount: aws.Int64(1)}},
+				CapacityReservationSpecification: &ec2.LaunchTemplateCapacityReservationSpecificationResponse{
+					CapacityReservationTarget: &ec2.CapacityReservationTargetResponse{CapacityReservationId: aws.String("cr-1")},
+				},
+			},
+		}}}, nil
+	}}
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{group}}, ec2Service)
+
+	nodeGroup := testNodeGroup(t, manager, "ipv6")
+	if nodeGroup.IPFamily() != apiv1.IPv6Protocol || !nodeGroup.asg.CapacityReservationTargeted {
+		t.Fatalf("expected an IPv6 node group targeting a capacity reservation, got %s, %v", nodeGroup.IPFamily(), nodeGroup.asg.CapacityReservationTargeted)
+	}
+
+	ec2Service.launchTemplateVersions = func(*ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+		return nil, errors.New("RequestLimitExceeded")
+	}
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nodeGroup = testNodeGroup(t, manager, "ipv6")
+	if nodeGroup.IPFamily() != apiv1.IPv6Protocol || !nodeGroup.asg.CapacityReservationTargeted {
+		t.Errorf("expected the properties to be kept, got %s, %v", nodeGroup.IPFamily(), nodeGroup.asg.CapacityReservationTargeted)
+	}
+}
+
+func TestRootVolumeFromLaunchTemplate(t *testing.T) {
+	withLaunchTemplate := func(name string) *autoscaling.Group {
+		group := testGroup(name, 0, 0, 5)
+		group.LaunchTemplate = &autoscaling.LaunchTemplateSpecification{LaunchTemplateName: aws.String(name), Version: aws.String("1")}
+		return group
+	}
+	mappings := map[string][]*ec2.LaunchTemplateBlockDeviceMapping{
+		"io2": {{DeviceName: aws.String("/dev/xvda"), Ebs: &ec2.LaunchTemplateEbsBlockDevice{VolumeType: aws.String("io2"), Iops: aws.Int64(16000)}}},
+		"gp3": {
+			{DeviceName: aws.String("/dev/xvdb"), Ebs: &ec2.LaunchTemplateEbsBlockDevice{VolumeType: aws.String("io2")}},
+			{DeviceName: aws.String("/dev/sda1"), Ebs: &ec2.LaunchTemplateEbsBlockDevice{VolumeType: aws.String("gp3"), Iops: aws.Int64(3000), Throughput: aws.Int64(250)}},
+		},
+		"data-only": {{DeviceName: aws.String("/dev/xvdb"), Ebs: &ec2.LaunchTemplateEbsBlockDevice{VolumeType: aws.String("io2")}}},
+	}
+	ec2Service := &fakeEC2{launchTemplateVersions: func(input *ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+		return &ec2.DescribeLaunchTemplateVersionsOutput{LaunchTemplateVersions: []*ec2.LaunchTemplateVersion{{
+			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{BlockDeviceMappings: mappings[aws.StringValue(input.LaunchTemplateName)]},
+		}}}, nil
+	}}
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{
+		withLaunchTemplate("io2"), withLaunchTemplate("gp3"), withLaunchTemplate("data-only"), testGroup("launch-config", 0, 0, 5),
+	}}, ec2Service)
+
+	for name, expected := range map[string]*EbsVolume{
+		"io2":           {VolumeType: "io2", Iops: 16000},
+		"gp3":           {VolumeType: "gp3", Iops: 3000, Throughput: 250},
+		"data-only":     nil,
+		"launch-config": nil,
+	} {
+		if volume := testNodeGroup(t, manager, name).RootVolume(); !reflect.DeepEqual(volume, expected) {
+			t.Errorf("%s: expected root volume %+v, got %+v", name, expected, volume)
+		}
+	}
+}
+
+func TestDetectDrift(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{
+		testGroup("drifted", 0, 2, 5, "i-1", "i-2"),
+		testGroup("steady", 0, 1, 5, "i-3"),
+	}}
+	manager := newTestManager(t, autoScaling, nil)
+
+	// Resized outside of the autoscaler
+	autoScaling.groups[0].DesiredCapacity = aws.Int64(4)
+
+	drifts, err := manager.DetectDrift(context.Background(), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []AsgDrift{{AsgName: "drifted", CachedSize: 2, ActualSize: 4}}; !reflect.DeepEqual(drifts, expected) {
+		t.Errorf("expected drifts %v, got %v", expected, drifts)
+	}
+	if size, _ := testNodeGroup(t, manager, "drifted").TargetSize(); size != 2 {
+		t.Errorf("expected the cached size to be left alone, got %d", size)
+	}
+
+	if _, err := manager.DetectDrift(context.Background(), true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size, _ := testNodeGroup(t, manager, "drifted").TargetSize(); size != 4 {
+		t.Errorf("expected the cached size to be corrected, got %d", size)
+	}
+	if drifts, _ := manager.DetectDrift(context.Background(), false); len(drifts) != 0 {
+		t.Errorf("expected no drift once corrected, got %v", drifts)
+	}
+}
+
+// TestConcurrentReadsDuringRegenerate is meant to be run with -race: regenerate swaps
+// the maps of the cache and updates the registered ASGs while they are read.
+func TestConcurrentReadsDuringRegenerate(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 2, 10, "i-1", "i-2")}}
+	manager := newTestManager(t, autoScaling, nil)
+	stubInstanceTypes(t, map[string]string{"asg-1": "m5.large"})
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+	instance := AwsInstanceRef{ProviderID: "aws:///us-east-1a/i-1", Name: "i-1"}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for ref := range manager.asgCache.Get() {
+					_, _ = manager.asgCache.InstancesByAsg(ref)
+				}
+				manager.asgCache.FindForInstance(instance)
+				manager.asgCache.Snapshot()
+				_, _ = nodeGroup.TargetSize()
+				nodeGroup.MinSize()
+				nodeGroup.MaxSize()
+				nodeGroup.AvailabilityZones()
+				nodeGroup.SuspendedProcesses()
+				nodeGroup.ScalingSuspended()
+				if _, err := nodeGroup.TemplateNode(); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 500; i++ {
+		// Alternately add and remove an ASG and change the size of the other one
+		autoScaling.mutex.Lock()
+		if i%2 == 0 {
+			autoScaling.groups = append(autoScaling.groups, testGroup("asg-2", 0, 1, 10, "i-3"))
+		} else {
+			autoScaling.groups = autoScaling.groups[:1]
+		}
+		autoScaling.groups[0].DesiredCapacity = aws.Int64(int64(2 + i%2))
+		// and the fields updated in place on the registered ASG
+		autoScaling.groups[0].AvailabilityZones = aws.StringSlice([]string{"us-east-1a", fmt.Sprintf("us-east-1%c", 'b'+i%2)})
+		autoScaling.groups[0].SuspendedProcesses = []*autoscaling.SuspendedProcess{{ProcessName: aws.String(fmt.Sprintf("Process%d", i%2))}}
+		autoScaling.groups[0].Tags = append(testGroup("asg-1", 0, 0, 0).Tags,
+			&autoscaling.TagDescription{Key: aws.String(nodeTemplateLabelTagPrefix + "revision"), Value: aws.String(fmt.Sprint(i))})
+		autoScaling.mutex.Unlock()
+		if err := manager.asgCache.regenerate(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if size, _ := nodeGroup.TargetSize(); size != 3 {
+		t.Errorf("expected the size of the last refresh, got %d", size)
+	}
+}
@@ -1,23 +1,286 @@
 package aws
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"k8s.io/klog/v2"
 )
 
+// ec2MetadataEndpointEnvVar overrides the endpoint of the EC2 instance metadata service,
+// for proxied metadata or tests.
+const ec2MetadataEndpointEnvVar = "AWS_EC2_METADATA_SERVICE_ENDPOINT"
+
+// Environment variables of the web identity credentials, set by the EKS pod
+// identity webhook for IRSA.
+const (
+	webIdentityTokenFileEnvVar = "AWS_WEB_IDENTITY_TOKEN_FILE"
+	roleARNEnvVar              = "AWS_ROLE_ARN"
+	roleSessionNameEnvVar      = "AWS_ROLE_SESSION_NAME"
+	defaultRoleSessionName     = "cluster-autoscaler"
+)
+
+// endpointOverridesEnvVar holds a JSON list of serviceOverride, e.g.
+// [{"Service":"autoscaling","Region":"us-gov-west-1","URL":"https://autoscaling.us-gov-west-1.amazonaws.com","SigningRegion":"us-gov-west-1"}]
+const endpointOverridesEnvVar = "AWS_ENDPOINT_OVERRIDES"
+
+// instanceTypesFileEnvVar holds the path of a JSON file of instance types merged over
+// the static list, see LoadEC2InstanceTypes.
+const instanceTypesFileEnvVar = "AWS_INSTANCE_TYPES_FILE"
+
+// instanceTypeNameRegex splits instance type names such as m7i.2xlarge into their class,
+// generation, attributes and size.
+var instanceTypeNameRegex = regexp.MustCompile(`^([a-z]+)(\d+)([a-z-]*)\.([a-z0-9-]+)$`)
+
 var (
 	ec2MetaDataServiceUrl = "http://169.254.169.254"
+
+	regionalInstanceTypes = &regionalInstanceTypeCache{
+		byRegion: make(map[regionalInstanceTypesKey]map[string]*InstanceType),
+	}
 )
 
+// regionalInstanceTypesKey identifies the instance types of a source offered in a region.
+type regionalInstanceTypesKey struct {
+	source InstanceTypeSource
+	region string
+}
+
+// regionalInstanceTypeCache caches the instance types offered in each region, as
+// offerings only change when AWS launches new instance types.
+type regionalInstanceTypeCache struct {
+	mutex    sync.Mutex
+	byRegion map[regionalInstanceTypesKey]map[string]*InstanceType
+}
+
+// get returns the instance types of all, loaded from source, that are offered in the
+// region. The offerings of a region are only described the first time the instance
+// types of a source are requested for it.
+func (c *regionalInstanceTypeCache) get(ec2Client ec2I, region string, source InstanceTypeSource, all map[string]*InstanceType) (map[string]*InstanceType, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := regionalInstanceTypesKey{source: source, region: region}
+	if instanceTypes, found := c.byRegion[key]; found {
+		return instanceTypes, nil
+	}
+
+	input := &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: aws.String(ec2.LocationTypeRegion),
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("location"),
+			Values: []*string{aws.String(region)},
+		}},
+	}
+	instanceTypes := make(map[string]*InstanceType)
+	if err := ec2Client.DescribeInstanceTypeOfferingsPages(input, func(page *ec2.DescribeInstanceTypeOfferingsOutput, isLastPage bool) bool {
+		for _, offering := range page.InstanceTypeOfferings {
+			name := aws.StringValue(offering.InstanceType)
+			if instanceType, found := all[name]; found {
+				instanceTypes[name] = instanceType
+			}
+		}
+		return !isLastPage
+	}); err != nil {
+		return nil, fmt.Errorf("failed to describe instance type offerings in region %s: %v", region, err)
+	}
+
+	c.byRegion[key] = instanceTypes
+	return instanceTypes, nil
+}
+
+// serviceOverride overrides the endpoint resolved for an AWS service in a region.
+// This is required for partitions such as aws-us-gov and aws-cn, or for private
+// VPC endpoints, where the default commercial endpoints don't apply.
+type serviceOverride struct {
+	Service       string
+	Region        string
+	URL           string
+	SigningRegion string
+	SigningMethod string
+	SigningName   string
+}
+
+// getResolver returns an endpoint resolver honoring the given overrides and
+// falling back to the SDK default resolver for everything else.
+func getResolver(overrides []serviceOverride) endpoints.ResolverFunc {
+	defaultResolver := endpoints.DefaultResolver()
+	defaultResolverFn := func(service, region string,
+		optFns ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		return defaultResolver.EndpointFor(service, region, optFns...)
+	}
+	if len(overrides) == 0 {
+		return defaultResolverFn
+	}
+
+	return func(service, region string,
+		optFns ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		for _, override := range overrides {
+			if override.Service == service && override.Region == region {
+				return endpoints.ResolvedEndpoint{
+					URL:           override.URL,
+					SigningRegion: override.SigningRegion,
+					SigningMethod: override.SigningMethod,
+					SigningName:   override.SigningName,
+				}, nil
+			}
+		}
+		return defaultResolverFn(service, region, optFns...)
+	}
+}
+
+// serviceOverridesFromEnv returns the endpoint overrides configured in endpointOverridesEnvVar.
+func serviceOverridesFromEnv() ([]serviceOverride, error) {
+	value := os.Getenv(endpointOverridesEnvVar)
+	if value == "" {
+		return nil, nil
+	}
+	var overrides []serviceOverride
+	if err := json.Unmarshal([]byte(value), &overrides); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", endpointOverridesEnvVar, err)
+	}
+	for _, override := range overrides {
+		if override.Service == "" || override.Region == "" || override.URL == "" {
+			return nil, fmt.Errorf("invalid %s: service, region and URL are required in %+v", endpointOverridesEnvVar, override)
+		}
+	}
+	return overrides, nil
+}
+
+// NewAWSSDKSession builds the AWS session for the given region to pass to NewAwsManager,
+// honoring the endpoint overrides configured in AWS_ENDPOINT_OVERRIDES.
+func NewAWSSDKSession(region string) (*session.Session, error) {
+	overrides, err := serviceOverridesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return createAWSSDKSession(region, overrides)
+}
+
+// createAWSSDKSession builds an AWS session for the given region. Regional STS
+// endpoints are always used so the session works outside the commercial
+// partition, and the given overrides take precedence over the default resolver.
+func createAWSSDKSession(region string, overrides []serviceOverride) (*session.Session, error) {
+	if region != "" {
+		if _, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); !ok {
+			klog.Warningf("Region %s is not part of a known AWS partition, relying on endpoint overrides", region)
+		}
+	}
+
+	cfg := aws.NewConfig().
+		WithRegion(region).
+		WithEndpointResolver(getResolver(overrides)).
+		WithSTSRegionalEndpoint(endpoints.RegionalSTSEndpoint)
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session for region %s: %v", region, err)
+	}
+	creds, err := webIdentityCredentials(sess)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session for region %s: %v", region, err)
+	}
+	if creds != nil {
+		sess.Config.Credentials = creds
+	}
+	return sess, nil
+}
+
+// webIdentityCredentials returns credentials assuming the role of
+// AWS_ROLE_ARN with the token of AWS_WEB_IDENTITY_TOKEN_FILE, as projected by
+// EKS IRSA, or nil when web identity is not configured. Static credentials
+// from the environment keep precedence, like in the SDK default chain.
+func webIdentityCredentials(sess *session.Session) (*credentials.Credentials, error) {
+	tokenFile := os.Getenv(webIdentityTokenFileEnvVar)
+	roleARN := os.Getenv(roleARNEnvVar)
+	if tokenFile == "" && roleARN == "" {
+		return nil, nil
+	}
+	if tokenFile == "" || roleARN == "" {
+		return nil, fmt.Errorf("%s and %s must be set together", webIdentityTokenFileEnvVar, roleARNEnvVar)
+	}
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		klog.Warningf("Ignoring %s since static credentials are set in the environment", webIdentityTokenFileEnvVar)
+		return nil, nil
+	}
+
+	sessionName := os.Getenv(roleSessionNameEnvVar)
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+	klog.V(1).Infof("Using web identity credentials for role %s", roleARN)
+	provider := stscreds.NewWebIdentityRoleProviderWithOptions(sts.New(sess), roleARN, sessionName, stscreds.FetchTokenPath(tokenFile))
+	return credentials.NewCredentials(provider), nil
+}
+
+// partitionForRegion returns the ID of the AWS partition the region belongs to,
+// e.g. aws-us-gov for us-gov-west-1. Unknown regions are assumed to be part of
+// the commercial partition.
+func partitionForRegion(region string) string {
+	if partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return partition.ID()
+	}
+	return endpoints.AwsPartitionID
+}
+
+// newAwsWrapper returns an awsWrapper backed by the AWS services of the given session.
+// Retries of all the services share a budget which is reset on every refresh.
+func newAwsWrapper(sess *session.Session) *awsWrapper {
+	budget := newRetryBudget(defaultRefreshRetryBudget)
+	cfg := request.WithRetryer(aws.NewConfig(), newBudgetedRetryer(budget))
+	limiter := newApiRateLimiter()
+	autoScalingClient := autoscaling.New(sess, cfg)
+	addRateLimit(&autoScalingClient.Handlers, limiter)
+	ec2Client := ec2.New(sess, cfg)
+	addRateLimit(&ec2Client.Handlers, limiter)
+	eksClient := eks.New(sess, cfg)
+	addRateLimit(&eksClient.Handlers, limiter)
+	return &awsWrapper{
+		autoScalingI: autoScalingClient,
+		ec2I:         ec2Client,
+		eksI:         eksClient,
+		retryBudget:  budget,
+		rateLimiter:  limiter,
+		region:       aws.StringValue(sess.Config.Region),
+	}
+}
+
 // GenerateEC2InstanceTypes returns a map of ec2 resources
 func GenerateEC2InstanceTypes(sess *session.Session) (map[string]*InstanceType, error) {
+	return generateEC2InstanceTypes(ec2.New(sess))
+}
+
+func generateEC2InstanceTypes(ec2Client ec2I) (map[string]*InstanceType, error) {
 	instanceTypes := make(map[string]*InstanceType)
 
+	input := &ec2.DescribeInstanceTypesInput{}
+	if err := ec2Client.DescribeInstanceTypesPages(input, func(page *ec2.DescribeInstanceTypesOutput, isLastPage bool) bool {
+		for _, rawInstanceType := range page.InstanceTypes {
+			instanceTypes[aws.StringValue(rawInstanceType.InstanceType)] = transformInstanceType(rawInstanceType)
+		}
+		return !isLastPage
+	}); err != nil {
+		return nil, err
+	}
+
 	if len(instanceTypes) == 0 {
 		return nil, errors.New("unable to load EC2 Instance Type list")
 	}
@@ -25,11 +288,186 @@ func GenerateEC2InstanceTypes(sess *session.Session) (map[string]*InstanceType,
 	return instanceTypes, nil
 }
 
+func transformInstanceType(rawInstanceType *ec2.InstanceTypeInfo) *InstanceType {
+	instanceType := &InstanceType{
+		InstanceType: aws.StringValue(rawInstanceType.InstanceType),
+	}
+	if rawInstanceType.MemoryInfo != nil {
+		instanceType.MemoryMb = aws.Int64Value(rawInstanceType.MemoryInfo.SizeInMiB)
+	}
+	if rawInstanceType.VCpuInfo != nil {
+		instanceType.VCPU = aws.Int64Value(rawInstanceType.VCpuInfo.DefaultVCpus)
+	}
+	if rawInstanceType.GpuInfo != nil {
+		for _, gpu := range rawInstanceType.GpuInfo.Gpus {
+			instanceType.GPU += aws.Int64Value(gpu.Count)
+		}
+	}
+	if processor := rawInstanceType.ProcessorInfo; processor != nil {
+		if len(processor.SupportedArchitectures) > 0 {
+			instanceType.Architecture = interpretEc2SupportedArchitecure(aws.StringValue(processor.SupportedArchitectures[len(processor.SupportedArchitectures)-1]))
+		}
+		instanceType.ProcessorFeatures = aws.StringValueSlice(processor.SupportedFeatures)
+		instanceType.SustainedClockSpeedGhz = aws.Float64Value(processor.SustainedClockSpeedInGhz)
+	}
+	return instanceType
+}
+
+// SupportsProcessorFeature returns whether the processor of the instance type
+// supports the given feature, as reported by DescribeInstanceTypes.
+func (t *InstanceType) SupportsProcessorFeature(feature string) bool {
+	for _, f := range t.ProcessorFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// approximateInstanceType returns the known instance type closest to the given unknown
+// one: same class, attributes and size, from the nearest generation, preferring older
+// generations on ties, e.g. m6i.2xlarge for m7i.2xlarge.
+func approximateInstanceType(name string, known map[string]*InstanceType) (*InstanceType, bool) {
+	match := instanceTypeNameRegex.FindStringSubmatch(name)
+	if match == nil {
+		return nil, false
+	}
+	generation, err := strconv.Atoi(match[2])
+	if err != nil {
+		return nil, false
+	}
+
+	var nearest *InstanceType
+	nearestDistance := 0
+	for candidateName, candidate := range known {
+		candidateMatch := instanceTypeNameRegex.FindStringSubmatch(candidateName)
+		if candidateMatch == nil || candidateMatch[1] != match[1] || candidateMatch[3] != match[3] || candidateMatch[4] != match[4] {
+			continue
+		}
+		candidateGeneration, err := strconv.Atoi(candidateMatch[2])
+		if err != nil {
+			continue
+		}
+		distance := 2 * (generation - candidateGeneration)
+		if distance < 0 {
+			// Newer generations come after older ones at the same distance
+			distance = -distance + 1
+		}
+		if nearest == nil || distance < nearestDistance || (distance == nearestDistance && candidateName < nearest.InstanceType) {
+			nearest = candidate
+			nearestDistance = distance
+		}
+	}
+	return nearest, nearest != nil
+}
+
 // GetStaticEC2InstanceTypes return pregenerated ec2 instance type list
 func GetStaticEC2InstanceTypes() (map[string]*InstanceType, string) {
 	return InstanceTypes, StaticListLastUpdateTime
 }
 
+// GetRegionalEC2InstanceTypes returns the pregenerated ec2 instance types offered in the
+// region of the session, along with the last time the static list was updated.
+// The result is cached per region.
+func GetRegionalEC2InstanceTypes(sess *session.Session) (map[string]*InstanceType, string, error) {
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		return nil, "", errors.New("session has no region to filter instance types by")
+	}
+	instanceTypes, err := regionalInstanceTypes.get(ec2.New(sess), region, InstanceTypeSourceStatic, InstanceTypes)
+	if err != nil {
+		return nil, "", err
+	}
+	return instanceTypes, StaticListLastUpdateTime, nil
+}
+
+// LoadEC2InstanceTypes returns the static instance types, with the ones of the JSON file
+// named by AWS_INSTANCE_TYPES_FILE added or overriding them, e.g. for air-gapped clusters
+// or instance types newer than the static list. The file holds a list of instance types:
+// [{"InstanceType":"m8g.large","VCPU":2,"MemoryMb":8192,"GPU":0,"Architecture":"arm64"}]
+// The static list is returned as is when the variable is unset or the file is absent.
+func LoadEC2InstanceTypes() (map[string]*InstanceType, InstanceTypeSource, error) {
+	path := os.Getenv(instanceTypesFileEnvVar)
+	if path == "" {
+		return InstanceTypes, InstanceTypeSourceStatic, nil
+	}
+	instanceTypes, err := mergeInstanceTypesFile(path, InstanceTypes)
+	if errors.Is(err, os.ErrNotExist) {
+		klog.Warningf("Instance types file %s does not exist, using the static list", path)
+		return InstanceTypes, InstanceTypeSourceStatic, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return instanceTypes, InstanceTypeSourceFile, nil
+}
+
+// mergeInstanceTypesFile returns a copy of the given instance types with the ones of the
+// file added or overriding them. The given map is left unchanged.
+func mergeInstanceTypesFile(path string, base map[string]*InstanceType) (map[string]*InstanceType, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var fromFile []*InstanceType
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fromFile); err != nil {
+		return nil, fmt.Errorf("invalid instance types file %s: %v", path, err)
+	}
+
+	merged := make(map[string]*InstanceType, len(base)+len(fromFile))
+	for name, t := range base {
+		merged[name] = t
+	}
+	seen := make(map[string]bool, len(fromFile))
+	var added, overridden []string
+	for i, t := range fromFile {
+		if err := validateInstanceType(t); err != nil {
+			return nil, fmt.Errorf("invalid instance types file %s: entry %d: %v", path, i, err)
+		}
+		if seen[t.InstanceType] {
+			return nil, fmt.Errorf("invalid instance types file %s: duplicate instance type %s", path, t.InstanceType)
+		}
+		seen[t.InstanceType] = true
+		if _, found := base[t.InstanceType]; found {
+			overridden = append(overridden, t.InstanceType)
+		} else {
+			added = append(added, t.InstanceType)
+		}
+		merged[t.InstanceType] = t
+	}
+
+	sort.Strings(added)
+	sort.Strings(overridden)
+	klog.Infof("Loaded %d instance types from %s, added: %v, overridden: %v", len(fromFile), path, added, overridden)
+	return merged, nil
+}
+
+// validateInstanceType checks that an instance type read from a file is complete.
+// A missing architecture defaults to amd64.
+func validateInstanceType(t *InstanceType) error {
+	if t == nil {
+		return errors.New("instance type is null")
+	}
+	if t.InstanceType == "" || !strings.Contains(t.InstanceType, ".") {
+		return fmt.Errorf("invalid instance type name %q", t.InstanceType)
+	}
+	if t.VCPU <= 0 || t.MemoryMb <= 0 || t.GPU < 0 {
+		return fmt.Errorf("instance type %s needs a positive VCPU and MemoryMb and a non-negative GPU", t.InstanceType)
+	}
+	switch t.Architecture {
+	case "":
+		t.Architecture = "amd64"
+	case "amd64", "arm64":
+	default:
+		return fmt.Errorf("instance type %s has unknown architecture %q", t.InstanceType, t.Architecture)
+	}
+	return nil
+}
+
 func interpretEc2SupportedArchitecure(archName string) string {
 	switch archName {
 	case "arm64":
@@ -45,19 +483,56 @@ func interpretEc2SupportedArchitecure(archName string) string {
 	}
 }
 
-// GetCurrentAwsRegion return region of current cluster without building awsManager
+// ec2MetadataEndpoint returns the endpoint of the EC2 instance metadata service.
+func ec2MetadataEndpoint() string {
+	if endpoint := os.Getenv(ec2MetadataEndpointEnvVar); endpoint != "" {
+		return endpoint
+	}
+	return ec2MetaDataServiceUrl
+}
+
+// GetCurrentAwsRegion return region of current cluster without building awsManager.
+// The region is taken from AWS_REGION, then the instance metadata service, then the
+// shared config file, which honors AWS_PROFILE and AWS_CONFIG_FILE.
 func GetCurrentAwsRegion() (string, error) {
 	region, present := os.LookupEnv("AWS_REGION")
 
 	if !present {
 		c := aws.NewConfig().
-			WithEndpoint(ec2MetaDataServiceUrl)
-		sess, err := session.NewSession()
+			WithEndpoint(ec2MetadataEndpoint())
+		sess, err := NewAWSSDKSession("")
+		if err != nil {
+			return "", fmt.Errorf("failed to create session: %v", err)
+		}
+		region, metadataErr := ec2metadata.New(sess, c).Region()
+		if metadataErr == nil {
+			klog.V(1).Infof("Using region %s from the EC2 instance metadata service", region)
+			return region, nil
+		}
+
+		region, err = regionFromSharedConfig()
 		if err != nil {
-			return "", fmt.Errorf("failed to create session")
+			return "", fmt.Errorf("failed to get region from instance metadata: %v, and from shared config: %v", metadataErr, err)
 		}
-		return ec2metadata.New(sess, c).Region()
+		klog.V(1).Infof("Using region %s from the shared AWS config, instance metadata is unavailable: %v", region, metadataErr)
+		return region, nil
 	}
 
+	klog.V(1).Infof("Using region %s from AWS_REGION", region)
+	return region, nil
+}
+
+// regionFromSharedConfig returns the region of the current profile in the shared config file.
+func regionFromSharedConfig() (string, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to load shared config: %v", err)
+	}
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		return "", errors.New("no region set in shared config")
+	}
 	return region, nil
 }
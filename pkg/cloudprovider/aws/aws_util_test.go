@@ -0,0 +1,325 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const govCloudRegion = "us-gov-west-1"
+
+func setFakeCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("AWS_PROFILE", "")
+}
+
+// unsetEnv unsets the environment variable for the duration of the test.
+func unsetEnv(t *testing.T, key string) {
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func TestGetResolverGovCloudOverride(t *testing.T) {
+	resolver := getResolver([]serviceOverride{{
+		Service:       "autoscaling",
+		Region:        govCloudRegion,
+		URL:           "https://autoscaling.example.internal",
+		SigningRegion: govCloudRegion,
+	}})
+
+	endpoint, err := resolver("autoscaling", govCloudRegion)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if endpoint.URL != "https://autoscaling.example.internal" || endpoint.SigningRegion != govCloudRegion {
+		t.Errorf("expected the override for autoscaling, got %+v", endpoint)
+	}
+
+	endpoint, err = resolver("ec2", govCloudRegion)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if endpoint.URL != "https://ec2.us-gov-west-1.amazonaws.com" {
+		t.Errorf("expected the default GovCloud endpoint for ec2, got %s", endpoint.URL)
+	}
+}
+
+func TestServiceOverridesFromEnv(t *testing.T) {
+	t.Setenv(endpointOverridesEnvVar, "")
+	if overrides, err := serviceOverridesFromEnv(); err != nil || overrides != nil {
+		t.Errorf("expected no overrides, got %v, %v", overrides, err)
+	}
+
+	t.Setenv(endpointOverridesEnvVar, `[{"Service":"ec2","Region":"us-gov-east-1"}]`)
+	if _, err := serviceOverridesFromEnv(); err == nil {
+		t.Error("expected an error for an override without URL")
+	}
+
+	t.Setenv(endpointOverridesEnvVar, "not json")
+	if _, err := serviceOverridesFromEnv(); err == nil {
+		t.Error("expected an error for malformed overrides")
+	}
+}
+
+func TestDescribeAutoScalingGroupsGovCloudEndpoint(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, `<DescribeAutoScalingGroupsResponse xmlns="http://autoscaling.amazonaws.com/doc/2011-01-01/">
+  <DescribeAutoScalingGroupsResult>
+    <AutoScalingGroups>
+      <member>
+        <AutoScalingGroupName>gov-asg</AutoScalingGroupName>
+        <MinSize>1</MinSize>
+        <MaxSize>3</MaxSize>
+        <DesiredCapacity>2</DesiredCapacity>
+      </member>
+    </AutoScalingGroups>
+  </DescribeAutoScalingGroupsResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</DescribeAutoScalingGroupsResponse>`)
+	}))
+	defer server.Close()
+
+	setFakeCredentials(t)
+	overrides, _ := json.Marshal([]serviceOverride{{
+		Service:       "autoscaling",
+		Region:        govCloudRegion,
+		URL:           server.URL,
+		SigningRegion: govCloudRegion,
+	}})
+	t.Setenv(endpointOverridesEnvVar, string(overrides))
+
+	sess, err := NewAWSSDKSession(govCloudRegion)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	groups, err := newAwsWrapper(sess).getAutoscalingGroupsByNames(context.Background(), []string{"gov-asg"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 1 || aws.StringValue(groups[0].AutoScalingGroupName) != "gov-asg" {
+		t.Fatalf("expected gov-asg to be described, got %v", groups)
+	}
+	if !strings.Contains(authorization, "/"+govCloudRegion+"/autoscaling/") {
+		t.Errorf("expected the request to be signed for %s, got %q", govCloudRegion, authorization)
+	}
+}
+
+func TestGetCurrentAwsRegionFromMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			fmt.Fprint(w, "token")
+		case "/latest/dynamic/instance-identity/document":
+			fmt.Fprintf(w, `{"region": %q, "availabilityZone": "us-gov-west-1a"}`, govCloudRegion)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	setFakeCredentials(t)
+	unsetEnv(t, "AWS_REGION")
+	t.Setenv(ec2MetadataEndpointEnvVar, server.URL)
+
+	region, err := GetCurrentAwsRegion()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if region != govCloudRegion {
+		t.Errorf("expected region %s from instance metadata, got %s", govCloudRegion, region)
+	}
+}
+
+func TestGenerateEC2InstanceTypesProcessorInfo(t *testing.T) {
+	ec2Service := &fakeEC2{instanceTypes: []*ec2.InstanceTypeInfo{{
+		InstanceType: aws.String("m7g.large"),
+		VCpuInfo:     &ec2.VCpuInfo{DefaultVCpus: aws.Int64(2)},
+		MemoryInfo:   &ec2.MemoryInfo{SizeInMiB: aws.Int64(8192)},
+		ProcessorInfo: &ec2.ProcessorInfo{
+			SupportedArchitectures:   aws.StringSlice([]string{"arm64"}),
+			SupportedFeatures:        aws.StringSlice([]string{"amd-sev-snp"}),
+			SustainedClockSpeedInGhz: aws.Float64(2.6),
+		},
+	}}}
+
+	instanceTypes, err := generateEC2InstanceTypes(ec2Service)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	instanceType := instanceTypes["m7g.large"]
+	if instanceType == nil {
+		t.Fatalf("expected m7g.large, got %v", instanceTypes)
+	}
+	if instanceType.Architecture != "arm64" || instanceType.SustainedClockSpeedGhz != 2.6 {
+		t.Errorf("unexpected processor info: %+v", instanceType)
+	}
+	if !instanceType.SupportsProcessorFeature("amd-sev-snp") || instanceType.SupportsProcessorFeature("intel-tdx") {
+		t.Errorf("unexpected processor features: %v", instanceType.ProcessorFeatures)
+	}
+}
+
+func TestEc2MetadataEndpoint(t *testing.T) {
+	unsetEnv(t, ec2MetadataEndpointEnvVar)
+	if endpoint := ec2MetadataEndpoint(); endpoint != ec2MetaDataServiceUrl {
+		t.Errorf("expected the link-local endpoint by default, got %s", endpoint)
+	}
+
+	t.Setenv(ec2MetadataEndpointEnvVar, "http://127.0.0.1:1338")
+	if endpoint := ec2MetadataEndpoint(); endpoint != "http://127.0.0.1:1338" {
+		t.Errorf("expected the overridden endpoint, got %s", endpoint)
+	}
+}
+
+func TestGetCurrentAwsRegionPrefersEnv(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv(ec2MetadataEndpointEnvVar, server.URL)
+
+	region, err := GetCurrentAwsRegion()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if region != "eu-west-1" || requests != 0 {
+		t.Errorf("expected region eu-west-1 without metadata requests, got %s after %d requests", region, requests)
+	}
+}
+
+func TestLoadEC2InstanceTypesFromFile(t *testing.T) {
+	path := t.TempDir() + "/instance-types.json"
+	t.Setenv(instanceTypesFileEnvVar, path)
+
+	// The static list is used as long as the file does not exist
+	instanceTypes, source, err := LoadEC2InstanceTypes()
+	if err != nil || source != InstanceTypeSourceStatic || len(instanceTypes) != len(InstanceTypes) {
+		t.Fatalf("expected the static list, got %d types from %s, %v", len(instanceTypes), source, err)
+	}
+
+	content := `[
+		{"InstanceType": "m5.large", "VCPU": 2, "MemoryMb": 9000, "Architecture": "amd64"},
+		{"InstanceType": "x9z.large", "VCPU": 4, "MemoryMb": 16384, "GPU": 1}
+	]`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	instanceTypes, source, err = LoadEC2InstanceTypes()
+	if err != nil || source != InstanceTypeSourceFile {
+		t.Fatalf("expected instance types from the file, got %s, %v", source, err)
+	}
+	if len(instanceTypes) != len(InstanceTypes)+1 {
+		t.Errorf("expected one instance type to be added, got %d instead of %d", len(instanceTypes), len(InstanceTypes))
+	}
+	if memory := instanceTypes["m5.large"].MemoryMb; memory != 9000 {
+		t.Errorf("expected m5.large to be overridden, got %d MiB", memory)
+	}
+	if memory := InstanceTypes["m5.large"].MemoryMb; memory == 9000 {
+		t.Error("expected the static list to be left unchanged")
+	}
+	if added := instanceTypes["x9z.large"]; added == nil || added.GPU != 1 || added.Architecture != "amd64" {
+		t.Errorf("expected x9z.large to be added with the default architecture, got %+v", added)
+	}
+}
+
+func TestLoadEC2InstanceTypesRejectsInvalidFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"not a list", `{"m5.large": {}}`, "cannot unmarshal"},
+		{"unknown field", `[{"InstanceType": "m5.large", "VCPU": 2, "MemoryMb": 8192, "Memory": 8}]`, "unknown field"},
+		{"missing name", `[{"VCPU": 2, "MemoryMb": 8192}]`, "invalid instance type name"},
+		{"missing memory", `[{"InstanceType": "m5.large", "VCPU": 2}]`, "positive VCPU and MemoryMb"},
+		{"unknown architecture", `[{"InstanceType": "m5.large", "VCPU": 2, "MemoryMb": 8192, "Architecture": "sparc"}]`, "unknown architecture"},
+		{"duplicate", `[{"InstanceType": "m5.large", "VCPU": 2, "MemoryMb": 8192}, {"InstanceType": "m5.large", "VCPU": 2, "MemoryMb": 8192}]`, "duplicate"},
+	} {
+		path := t.TempDir() + "/instance-types.json"
+		if err := os.WriteFile(path, []byte(tc.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv(instanceTypesFileEnvVar, path)
+		if _, _, err := LoadEC2InstanceTypes(); !errorContains(err, path, tc.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestCreateAWSSDKSessionWebIdentity(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</AssumeRoleWithWebIdentityResponse>`)
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("irsa-token"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	unsetEnv(t, "AWS_ACCESS_KEY_ID")
+	unsetEnv(t, "AWS_SECRET_ACCESS_KEY")
+	unsetEnv(t, roleSessionNameEnvVar)
+	t.Setenv(webIdentityTokenFileEnvVar, tokenFile)
+	t.Setenv(roleARNEnvVar, "arn:aws:iam::123456789012:role/autoscaler")
+
+	sess, err := createAWSSDKSession("us-east-1", []serviceOverride{{
+		Service: "sts",
+		Region:  "us-east-1",
+		URL:     server.URL,
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.ProviderName != stscreds.WebIdentityProviderName || creds.AccessKeyID != "ASIAEXAMPLE" {
+		t.Errorf("expected web identity credentials, got %s from %s", creds.AccessKeyID, creds.ProviderName)
+	}
+	if form.Get("Action") != "AssumeRoleWithWebIdentity" || form.Get("WebIdentityToken") != "irsa-token" ||
+		form.Get("RoleArn") != "arn:aws:iam::123456789012:role/autoscaler" || form.Get("RoleSessionName") != defaultRoleSessionName {
+		t.Errorf("unexpected AssumeRoleWithWebIdentity request %v", form)
+	}
+}
+
+func TestCreateAWSSDKSessionIncompleteWebIdentity(t *testing.T) {
+	setFakeCredentials(t)
+	unsetEnv(t, webIdentityTokenFileEnvVar)
+	t.Setenv(roleARNEnvVar, "arn:aws:iam::123456789012:role/autoscaler")
+
+	if _, err := createAWSSDKSession("us-east-1", nil); !errorContains(err, webIdentityTokenFileEnvVar, roleARNEnvVar) {
+		t.Errorf("expected an error about the incomplete web identity, got %v", err)
+	}
+}
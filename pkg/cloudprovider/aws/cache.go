@@ -4,6 +4,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go/service/eks"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/utils/clock"
@@ -11,6 +13,7 @@ import (
 
 const (
 	asgInstanceTypeCacheTTL = time.Minute * 20
+	eksNodegroupCacheTTL    = time.Minute * 5
 	cacheMinTTL             = 120
 	cacheMaxTTL             = 600
 )
@@ -68,8 +71,10 @@ func (c *jitterClock) Since(ts time.Time) time.Duration {
 	return since
 }
 
-func (es instanceTypeExpirationStore) populate(autoscalingGroups map[AwsRef]*asg) error {
-	asgsToQuery := []*asg{}
+// populate caches the instance types of the given ASGs missing from the store, keyed by
+// the ID of their ref and looked up with the AWS services of their region.
+func (es instanceTypeExpirationStore) populate(autoscalingGroups map[AwsRef]*asg, serviceFor func(AwsRef) *awsWrapper) error {
+	asgsToQuery := make(map[*awsWrapper][]*asg)
 
 	if c, ok := es.jitterClock.(*jitterClock); ok {
 		c.Lock()
@@ -81,11 +86,12 @@ func (es instanceTypeExpirationStore) populate(autoscalingGroups map[AwsRef]*asg
 		if asg == nil {
 			continue
 		}
-		_, found, _ := es.GetByKey(asg.AwsRef.Name)
+		_, found, _ := es.GetByKey(asg.AwsRef.Id())
 		if found {
 			continue
 		}
-		asgsToQuery = append(asgsToQuery, asg)
+		service := serviceFor(asg.AwsRef)
+		asgsToQuery[service] = append(asgsToQuery[service], asg)
 	}
 
 	if c, ok := es.jitterClock.(*jitterClock); ok {
@@ -97,16 +103,40 @@ func (es instanceTypeExpirationStore) populate(autoscalingGroups map[AwsRef]*asg
 	// List expires old entries
 	_ = es.List()
 
-	instanceTypesByAsg, err := es.awsService.getInstanceTypesForAsgs(asgsToQuery)
-	if err != nil {
-		return err
-	}
+	var errs []error
+	for service, asgs := range asgsToQuery {
+		instanceTypesByAsg, err := service.getInstanceTypesForAsgs(asgs)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
 
-	for asgName, instanceType := range instanceTypesByAsg {
-		es.Add(instanceTypeCachedObject{
-			name:         asgName,
-			instanceType: instanceType,
-		})
+		// The names of the ASGs of a region are unique
+		for _, asg := range asgs {
+			if instanceType, found := instanceTypesByAsg[asg.AwsRef.Name]; found {
+				es.Add(instanceTypeCachedObject{
+					name:         asg.AwsRef.Id(),
+					instanceType: instanceType,
+				})
+			}
+		}
 	}
-	return nil
+	return utilerrors.NewAggregate(errs)
+}
+
+type eksNodegroupCachedObject struct {
+	key       string
+	nodegroup *eks.Nodegroup
+}
+
+// newEksNodegroupCache returns a store of the described EKS node groups, keyed by
+// eksNodegroupKey, so they aren't described again on every refresh.
+func newEksNodegroupCache() cache.Store {
+	return cache.NewTTLStore(func(obj interface{}) (string, error) {
+		return obj.(eksNodegroupCachedObject).key, nil
+	}, eksNodegroupCacheTTL)
+}
+
+func eksNodegroupKey(region, clusterName, nodegroupName string) string {
+	return region + "/" + clusterName + "/" + nodegroupName
 }
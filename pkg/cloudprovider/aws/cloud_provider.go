@@ -1,11 +1,19 @@
 package aws
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	apiv1 "k8s.io/api/core/v1"
 	klog "k8s.io/klog/v2"
 )
@@ -13,8 +21,22 @@ import (
 const (
 	// GPULabel is the label added to nodes with GPU resource.
 	GPULabel = "k8s.amazonaws.com/accelerator"
+	// ResourceNvidiaGPU is the name of the Nvidia GPU resource.
+	ResourceNvidiaGPU = "nvidia.com/gpu"
 	// nodeNotPresentErr indicates no node with the given identifier present in AWS
 	nodeNotPresentErr = "node is not present in aws"
+	// CapacityTypeOnDemand is the capacity type of on-demand node groups.
+	CapacityTypeOnDemand = "ON_DEMAND"
+	// CapacityTypeSpot is the capacity type of spot node groups.
+	CapacityTypeSpot = "SPOT"
+
+	expanderPriorityTag = "k8s.io/cluster-autoscaler/node-template/priority"
+	costHintTag         = "k8s.io/cluster-autoscaler/node-template/cost-hint"
+	capacityTypeTag     = "k8s.io/cluster-autoscaler/node-template/label/eks.amazonaws.com/capacityType"
+
+	// maxCapacityMemoryDifferenceRatio is the maximum difference of memory capacity
+	// between two similar node groups, as instances of the same type may differ slightly.
+	maxCapacityMemoryDifferenceRatio = 0.015
 )
 
 var (
@@ -26,8 +48,28 @@ var (
 		"nvidia-tesla-a100": {},
 		"nvidia-a10g":       {},
 	}
+
+	// gpuTypesByInstanceFamily maps the GPU instance families to their accelerator type,
+	// one of availableGPUTypes
+	gpuTypesByInstanceFamily = map[string]string{
+		"p2":   "nvidia-tesla-k80",
+		"p3":   "nvidia-tesla-v100",
+		"p3dn": "nvidia-tesla-v100",
+		"p4d":  "nvidia-tesla-a100",
+		"p4de": "nvidia-tesla-a100",
+		"g4dn": "nvidia-tesla-t4",
+		"g5":   "nvidia-a10g",
+	}
 )
 
+// GPULabelValueForInstanceType returns the value of the GPULabel of nodes of the given
+// instance type, e.g. nvidia-tesla-t4 for g4dn.xlarge, and false for instance types
+// without a known NVIDIA accelerator.
+func GPULabelValueForInstanceType(name string) (string, bool) {
+	gpuType, found := gpuTypesByInstanceFamily[instanceTypeFamily(name)]
+	return gpuType, found
+}
+
 // awsCloudProvider implements CloudProvider interface.
 type awsCloudProvider struct {
 	awsManager *AwsManager
@@ -63,26 +105,65 @@ func (aws *awsCloudProvider) NodeGroups() []*AwsNodeGroup {
 	return ngs
 }
 
-// NodeGroupForNode returns the node group for the given node.
+// NodeGroupForNode returns the node group for the given node, routed by the region of the
+// zone of its provider ID. Nodes in another region than their ASG have none, and with the
+// strict zone check of the manager neither do nodes in a zone their ASG doesn't span.
 func (aws *awsCloudProvider) NodeGroupForNode(node *apiv1.Node) (*AwsNodeGroup, error) {
-	if len(node.Spec.ProviderID) == 0 {
-		klog.Warningf("Node %v has no providerId", node.Name)
-		return nil, nil
-	}
-	ref, err := AwsRefFromProviderId(node.Spec.ProviderID)
+	nodeGroups, err := aws.NodeGroupForNodes([]*apiv1.Node{node})
 	if err != nil {
 		return nil, err
 	}
-	asg := aws.awsManager.GetAsgForInstance(*ref)
+	return nodeGroups[node.Name], nil
+}
 
-	if asg == nil {
-		return nil, nil
+// NodeGroupForNodes returns the node groups of the given nodes by node name, looking
+// them all up with a single lock of the cache. Nodes without a node group are omitted,
+// as are the nodes whose instance can't be resolved, which are logged.
+func (aws *awsCloudProvider) NodeGroupForNodes(nodes []*apiv1.Node) (map[string]*AwsNodeGroup, error) {
+	refs := make(map[string]AwsInstanceRef, len(nodes))
+	for _, node := range nodes {
+		// Some bootstrap setups name nodes after their private DNS name and leave the
+		// provider ID empty, their instance is then looked up by that name
+		ref, err := aws.awsManager.GetInstanceRefForNode(context.Background(), node)
+		if err != nil {
+			klog.Warningf("Failed to resolve the instance of node %s: %v", node.Name, err)
+			continue
+		}
+		if ref == nil {
+			klog.Warningf("Node %v has no providerId", node.Name)
+			continue
+		}
+		refs[node.Name] = *ref
 	}
 
-	return &AwsNodeGroup{
-		asg:        asg,
-		awsManager: aws.awsManager,
-	}, nil
+	instances := make([]AwsInstanceRef, 0, len(refs))
+	for _, ref := range refs {
+		instances = append(instances, ref)
+	}
+	asgs := aws.awsManager.GetAsgsForInstances(instances)
+
+	nodeGroups := make(map[string]*AwsNodeGroup, len(refs))
+	byAsg := make(map[AwsRef]*AwsNodeGroup)
+	for name, ref := range refs {
+		asg, found := asgs[ref]
+		if !found {
+			// Untracked instances are never part of a node group, whatever the policy
+			continue
+		}
+		if aws.awsManager.outsideAsgRegion(asg, ref) || aws.awsManager.outsideAsgZones(asg, ref) {
+			continue
+		}
+		nodeGroup, found := byAsg[asg.AwsRef]
+		if !found {
+			nodeGroup = &AwsNodeGroup{
+				asg:        asg,
+				awsManager: aws.awsManager,
+			}
+			byAsg[asg.AwsRef] = nodeGroup
+		}
+		nodeGroups[name] = nodeGroup
+	}
+	return nodeGroups, nil
 }
 
 // HasInstance returns whether a given node has a corresponding instance in this cloud provider
@@ -103,14 +184,33 @@ func (aws *awsCloudProvider) HasInstance(node *apiv1.Node) (bool, error) {
 		return false, nil
 	}
 
-	awsRef, err := AwsRefFromProviderId(node.Spec.ProviderID)
+	awsRef, err := aws.awsManager.GetInstanceRefForNode(context.Background(), node)
 	if err != nil {
 		return false, err
 	}
+	if awsRef == nil {
+		return false, fmt.Errorf("node %s has no providerId and no instance with its private DNS name", node.Name)
+	}
 
 	// we don't care about the status
 	status, err := aws.awsManager.asgCache.InstanceStatus(*awsRef)
 	if status != nil {
+		aws.awsManager.markPresent(*awsRef)
+		return true, nil
+	}
+
+	// newly launched instances may not be in the cache yet
+	if aws.awsManager.withinNotPresentGrace(*awsRef) {
+		klog.V(4).Infof("Instance %s not found but within not-present grace period, assuming present", awsRef.Name)
+		return true, nil
+	}
+
+	present, lookupErr := aws.awsManager.isUntrackedInstancePresent(*awsRef)
+	if lookupErr != nil {
+		return false, fmt.Errorf("failed to look up untracked instance %s: %v", awsRef.Name, lookupErr)
+	}
+	if present {
+		klog.V(4).Infof("Instance %s belongs to no tracked ASG but exists in EC2, reporting it as present", awsRef.Name)
 		return true, nil
 	}
 
@@ -118,8 +218,9 @@ func (aws *awsCloudProvider) HasInstance(node *apiv1.Node) (bool, error) {
 }
 
 // GetAvailableMachineTypes get all machine types that can be requested from the cloud provider.
+// They are the known instance types, sorted and restricted to the configured prefixes.
 func (aws *awsCloudProvider) GetAvailableMachineTypes() ([]string, error) {
-	return []string{}, nil
+	return aws.awsManager.AvailableMachineTypes(), nil
 }
 
 // Refresh is called before every main loop and can be used to dynamically update cloud provider state.
@@ -128,9 +229,28 @@ func (aws *awsCloudProvider) Refresh() error {
 	return aws.awsManager.Refresh()
 }
 
+// RefreshWithContext is like Refresh, but bounds the AWS calls to the given context, so that
+// the main loop can enforce a deadline on them.
+func (aws *awsCloudProvider) RefreshWithContext(ctx context.Context) error {
+	return aws.awsManager.RefreshWithContext(ctx)
+}
+
 // AwsRef contains a reference to some entity in AWS world.
 type AwsRef struct {
 	Name string
+	// Region of the entity when it is managed through an additional regional service of
+	// the manager, empty for the region of the manager
+	Region string
+}
+
+// Id returns the name of the entity, prefixed with its region when it is in an
+// additional region so that entities with the same name in different regions don't
+// collide. AWS doesn't allow colons in ASG names.
+func (ref AwsRef) Id() string {
+	if ref.Region == "" {
+		return ref.Name
+	}
+	return ref.Region + ":" + ref.Name
 }
 
 // AwsInstanceRef contains a reference to an instance in the AWS world.
@@ -139,18 +259,34 @@ type AwsInstanceRef struct {
 	Name       string
 }
 
-var validAwsRefIdRegex = regexp.MustCompile(fmt.Sprintf(`^aws\:\/\/\/[-0-9a-z]*\/[-0-9a-z]*(\/[-0-9a-z\.]*)?$|aws\:\/\/\/[-0-9a-z]*\/%s.*$`, placeholderInstanceNamePrefix))
+// Region returns the region of the instance, derived from the zone of its provider ID.
+func (ref AwsInstanceRef) Region() (string, error) {
+	if !validAwsRefIdRegex.MatchString(ref.ProviderID) {
+		return "", fmt.Errorf("wrong id: expected format aws:///<zone>/<name>, got %v", ref.ProviderID)
+	}
+	zone := zoneFromProviderId(ref.ProviderID)
+	region := regionFromZone(zone)
+	if region == "" {
+		return "", fmt.Errorf("can't derive the region of instance %s from zone %q", ref.Name, zone)
+	}
+	return region, nil
+}
+
+// validAwsRefIdRegex matches provider IDs in format aws:///<zone>/<name>, where name is
+// either an instance ID or a placeholder instance name. Some providers, e.g. EKS with
+// custom networking, append extra path segments which are ignored.
+var validAwsRefIdRegex = regexp.MustCompile(fmt.Sprintf(`^aws:///[-0-9a-z]*/(%s[^/]*|[-0-9A-Za-z]+)(/.*)?$`, placeholderInstanceNamePrefix))
 
 // AwsRefFromProviderId creates AwsInstanceRef object from provider id which
 // must be in format: aws:///zone/name
 func AwsRefFromProviderId(id string) (*AwsInstanceRef, error) {
-	if validAwsRefIdRegex.FindStringSubmatch(id) == nil {
+	match := validAwsRefIdRegex.FindStringSubmatch(id)
+	if match == nil {
 		return nil, fmt.Errorf("wrong id: expected format aws:///<zone>/<name>, got %v", id)
 	}
-	splitted := strings.Split(id[7:], "/")
 	return &AwsInstanceRef{
 		ProviderID: id,
-		Name:       splitted[1],
+		Name:       match[1],
 	}, nil
 }
 
@@ -162,18 +298,21 @@ type AwsNodeGroup struct {
 
 // MaxSize returns maximum size of the node group.
 func (ng *AwsNodeGroup) MaxSize() int {
-	return ng.asg.maxSize
+	_, maxSize, _ := ng.awsManager.asgCache.sizes(ng.asg)
+	return maxSize
 }
 
 // MinSize returns minimum size of the node group.
 func (ng *AwsNodeGroup) MinSize() int {
-	return ng.asg.minSize
+	minSize, _, _ := ng.awsManager.asgCache.sizes(ng.asg)
+	return minSize
 }
 
 // TargetSize returns the current TARGET size of the node group. It is possible that the
 // number is different from the number of nodes registered in Kubernetes.
 func (ng *AwsNodeGroup) TargetSize() (int, error) {
-	return ng.asg.curSize, nil
+	_, _, curSize := ng.awsManager.asgCache.sizes(ng.asg)
+	return curSize, nil
 }
 
 // Exist checks if the node group really exists on the cloud provider side. Allows to tell the
@@ -193,18 +332,54 @@ func (ng *AwsNodeGroup) Delete() error {
 	return nil
 }
 
-// IncreaseSize increases Asg size
+// IncreaseSize increases Asg size. A delta of 0 is a no-op. A delta larger than the
+// maximum scale-up step of the ASG is clamped to it, the autoscaler adds the remaining
+// instances in its next loops.
 func (ng *AwsNodeGroup) IncreaseSize(delta int) error {
-	if delta <= 0 {
+	if delta == 0 {
+		klog.V(4).Infof("Size increase of 0 requested for ASG %s, nothing to do", ng.Id())
+		return nil
+	}
+	if ng.awsManager.scaleUpDisabled.Load() {
+		return fmt.Errorf("scale-up globally disabled, not increasing size of ASG %s", ng.Id())
+	}
+	if delta < 0 {
 		return fmt.Errorf("size increase must be positive")
 	}
-	size := ng.asg.curSize
-	if size+delta > ng.asg.maxSize {
-		return fmt.Errorf("size increase too large - desired:%d max:%d", size+delta, ng.asg.maxSize)
+	if step := ng.awsManager.maxScaleUpStepFor(ng.asg); step > 0 && delta > step {
+		klog.InfoS("Clamping size increase to the maximum scale-up step", "asg", ng.Id(), "requested", delta, "maxStep", step)
+		delta = step
+	}
+	_, maxSize, size := ng.awsManager.asgCache.sizes(ng.asg)
+	if size+delta > maxSize {
+		return fmt.Errorf("size increase too large - desired:%d max:%d", size+delta, maxSize)
 	}
+	ng.checkZoneBalance(size + delta)
 	return ng.awsManager.SetAsgSize(ng.asg, size+delta)
 }
 
+// checkZoneBalance warns when a single availability zone would hold more than the
+// configured fraction of the nodes of the ASG once it reaches the given size, assuming
+// AWS spreads the new instances evenly over the zones of the ASG.
+func (ng *AwsNodeGroup) checkZoneBalance(size int) {
+	fraction := ng.awsManager.maxZoneFraction
+	zones := ng.AvailabilityZones()
+	if fraction <= 0 || size <= 0 || len(zones) == 0 {
+		return
+	}
+
+	evenShare := int(math.Ceil(float64(size) / float64(len(zones))))
+	for zone, count := range ng.awsManager.asgCache.InstancesPerZone(ng.asg.AwsRef) {
+		if count < evenShare {
+			count = evenShare
+		}
+		if float64(count) > fraction*float64(size) {
+			klog.Warningf("ASG %s would have %d of its %d nodes in zone %s, more than the maximum fraction %v",
+				ng.Id(), count, size, zone, fraction)
+		}
+	}
+}
+
 // DecreaseTargetSize decreases the target size of the node group. This function
 // doesn't permit to delete any existing node and can be used only to reduce the
 // request for new nodes that have not been yet fulfilled. Delta should be negative.
@@ -215,61 +390,255 @@ func (ng *AwsNodeGroup) DecreaseTargetSize(delta int) error {
 		return fmt.Errorf("size decrease size must be negative")
 	}
 
-	size := ng.asg.curSize
-	nodes, err := ng.awsManager.GetAsgNodes(ng.asg.AwsRef)
+	// The cache may be stale, e.g. the ASG may have just launched an instance, so
+	// refresh it before checking that no existing node would be deleted.
+	if err := ng.awsManager.RefreshAsg(ng.asg.AwsRef); err != nil {
+		return fmt.Errorf("failed to refresh ASG %s: %v", ng.Id(), err)
+	}
+
+	size, _ := ng.TargetSize()
+	existing, err := ng.existingNodeCount()
 	if err != nil {
 		return err
 	}
-	if int(size)+delta < len(nodes) {
-		return fmt.Errorf("attempt to delete existing nodes targetSize:%d delta:%d existingNodes: %d",
-			size, delta, len(nodes))
+	if int(size)+delta < existing {
+		return fmt.Errorf("attempt to delete existing nodes of ASG %s targetSize:%d delta:%d existingNodes: %d",
+			ng.Id(), size, delta, existing)
 	}
 	return ng.awsManager.SetAsgSize(ng.asg, size+delta)
 }
 
-// Belongs returns true if the given node belongs to the NodeGroup.
+// existingNodeCount returns the number of cached instances of the ASG, leaving out the
+// placeholders which stand for the unfulfilled requests a decrease is meant to cancel.
+func (ng *AwsNodeGroup) existingNodeCount() (int, error) {
+	nodes, err := ng.awsManager.GetAsgNodes(ng.asg.AwsRef)
+	if err != nil {
+		return 0, err
+	}
+	existing := 0
+	for i := range nodes {
+		if !ng.awsManager.asgCache.isPlaceholderInstance(&nodes[i]) {
+			existing++
+		}
+	}
+	return existing, nil
+}
+
+// SetSize sets the target size of the node group to an absolute value within its min
+// and max sizes, for callers computing the desired size themselves. Like
+// DecreaseTargetSize, it refreshes the ASG before a decrease and refuses to go below
+// the number of existing nodes, and like IncreaseSize it is blocked while scale-up is
+// globally disabled. The maximum scale-up step doesn't apply.
+func (ng *AwsNodeGroup) SetSize(target int) error {
+	if minSize, maxSize := ng.MinSize(), ng.MaxSize(); target < minSize || target > maxSize {
+		return fmt.Errorf("size %d of ASG %s is outside of [%d, %d]", target, ng.Id(), minSize, maxSize)
+	}
+
+	size, _ := ng.TargetSize()
+	switch {
+	case target == size:
+		klog.V(4).Infof("ASG %s already has size %d, nothing to do", ng.Id(), target)
+		return nil
+	case target > size:
+		if ng.awsManager.scaleUpDisabled.Load() {
+			return fmt.Errorf("scale-up globally disabled, not increasing size of ASG %s", ng.Id())
+		}
+		return ng.awsManager.SetAsgSize(ng.asg, target)
+	}
+
+	if err := ng.awsManager.RefreshAsg(ng.asg.AwsRef); err != nil {
+		return fmt.Errorf("failed to refresh ASG %s: %v", ng.Id(), err)
+	}
+	existing, err := ng.existingNodeCount()
+	if err != nil {
+		return err
+	}
+	if target < existing {
+		return fmt.Errorf("attempt to delete existing nodes of ASG %s targetSize:%d existingNodes: %d",
+			ng.Id(), target, existing)
+	}
+	return ng.awsManager.SetAsgSize(ng.asg, target)
+}
+
+// Belongs returns true if the given node belongs to the NodeGroup. Nodes in another region
+// than the ASG don't, and with the strict zone check of the manager neither do nodes in a
+// zone the ASG doesn't span.
 func (ng *AwsNodeGroup) Belongs(node *apiv1.Node) (bool, error) {
-	ref, err := AwsRefFromProviderId(node.Spec.ProviderID)
+	ref, err := ng.instanceRefForNode(node)
 	if err != nil {
 		return false, err
 	}
-	targetAsg := ng.awsManager.GetAsgForInstance(*ref)
+	return ng.belongs(node, *ref)
+}
+
+// instanceRefForNode resolves the instance of the node, failing if there is none.
+func (ng *AwsNodeGroup) instanceRefForNode(node *apiv1.Node) (*AwsInstanceRef, error) {
+	ref, err := ng.awsManager.GetInstanceRefForNode(context.Background(), node)
+	if err != nil {
+		return nil, err
+	}
+	if ref == nil {
+		return nil, fmt.Errorf("node %s has no providerId and no instance with its private DNS name", node.Name)
+	}
+	return ref, nil
+}
+
+// belongs returns whether the instance of the node belongs to the node group.
+func (ng *AwsNodeGroup) belongs(node *apiv1.Node, ref AwsInstanceRef) (bool, error) {
+	targetAsg := ng.awsManager.GetAsgForInstance(ref)
 	if targetAsg == nil {
 		return false, fmt.Errorf("%s doesn't belong to a known asg", node.Name)
 	}
 	if targetAsg.AwsRef != ng.asg.AwsRef {
 		return false, nil
 	}
-	return true, nil
+	return !ng.awsManager.outsideAsgRegion(targetAsg, ref) && !ng.awsManager.outsideAsgZones(targetAsg, ref), nil
+}
+
+// AtomicIncreaseSize increases the size of the node group by delta only if all the new
+// instances can be launched, e.g. for gang-scheduled workloads, and returns an error
+// without scaling otherwise. It requires an ASG with a launch template: the instances
+// are launched on-demand with an instant EC2 fleet, in a single zone and of a single
+// instance type, then attached to the ASG. At most 20 instances can be added at once.
+func (ng *AwsNodeGroup) AtomicIncreaseSize(delta int) error {
+	if ng.awsManager.scaleUpDisabled.Load() {
+		return fmt.Errorf("scale-up globally disabled, not increasing size of ASG %s", ng.Id())
+	}
+	if delta <= 0 {
+		return fmt.Errorf("size increase must be positive")
+	}
+	_, maxSize, size := ng.awsManager.asgCache.sizes(ng.asg)
+	if size+delta > maxSize {
+		return fmt.Errorf("size increase too large - desired:%d max:%d", size+delta, maxSize)
+	}
+	return ng.awsManager.AtomicIncreaseAsgSize(context.Background(), ng.asg, delta)
 }
 
-// DeleteNodes deletes the nodes from the group.
+// DeleteNodes deletes the nodes from the group. Nodes whose instances are protected from
+// scale-in or still launching, unless forced on the manager, or carrying a protect taint,
+// are left in place. When partial deletes are enabled on the manager, so are nodes that
+// would take the group below its min size, taken from the end of the deletion order of
+// the manager: the given order by default, or oldest instances first. Otherwise no node
+// is deleted when the ones left to delete would take the group below its min size. The
+// other nodes are deleted, and a NodesNotDeletedError names the ones left in place.
 func (ng *AwsNodeGroup) DeleteNodes(nodes []*apiv1.Node) error {
-	size := ng.asg.curSize
+	size, _ := ng.TargetSize()
 	if int(size) <= ng.MinSize() {
 		return fmt.Errorf("min size reached, nodes will not be deleted")
 	}
+	notDeleted := &NodesNotDeletedError{AsgName: ng.Id(), Reasons: make(map[string]string)}
 	refs := make([]*AwsInstanceRef, 0, len(nodes))
+	names := make([]string, 0, len(nodes))
 	for _, node := range nodes {
-		belongs, err := ng.Belongs(node)
+		awsref, err := ng.instanceRefForNode(node)
+		if err != nil {
+			return err
+		}
+		belongs, err := ng.belongs(node, *awsref)
 		if err != nil {
 			return err
 		}
 		if !belongs {
 			return fmt.Errorf("%s belongs to a different asg than %s", node.Name, ng.Id())
 		}
-		awsref, err := AwsRefFromProviderId(node.Spec.ProviderID)
-		if err != nil {
-			return err
+		if ng.awsManager.asgCache.IsInstanceProtected(*awsref) {
+			klog.Warningf("Skipping deletion of node %s: instance %s is protected from scale-in by ASG %s", node.Name, awsref.Name, ng.Id())
+			notDeleted.Reasons[node.Name] = "is protected from scale-in by the ASG"
+			continue
+		}
+		if !ng.awsManager.forceDeleteLaunching && ng.awsManager.asgCache.IsInstanceLaunching(*awsref) {
+			klog.Warningf("Skipping deletion of node %s: instance %s of ASG %s is still launching", node.Name, awsref.Name, ng.Id())
+			notDeleted.Reasons[node.Name] = "is still launching"
+			continue
+		}
+		if taint, protected := ng.awsManager.protectTaint(node); protected {
+			klog.Warningf("Skipping deletion of node %s of ASG %s: it has the protect taint %s", node.Name, ng.Id(), taint.ToString())
+			notDeleted.Reasons[node.Name] = fmt.Sprintf("has the protect taint %s", taint.ToString())
+			continue
 		}
 		refs = append(refs, awsref)
+		names = append(names, node.Name)
+	}
+	if ng.awsManager.deletionOrder == DeletionOrderOldestFirst {
+		ng.sortOldestFirst(refs, names)
+	}
+	if allowed := size - ng.MinSize(); len(refs) > allowed {
+		if !ng.awsManager.partialDeleteOnMinSize {
+			return fmt.Errorf("min size reached, deleting %d nodes would take ASG %s below its min size %d, nodes will not be deleted",
+				len(refs), ng.Id(), ng.MinSize())
+		}
+		klog.Warningf("Deleting only %d of %d nodes from ASG %s to respect min size %d",
+			allowed, len(refs), ng.Id(), ng.MinSize())
+		for _, name := range names[allowed:] {
+			notDeleted.Reasons[name] = fmt.Sprintf("would take the ASG below its min size %d", ng.MinSize())
+		}
+		refs = refs[:allowed]
+	}
+	if err := ng.awsManager.DeleteInstances(refs); err != nil {
+		return err
+	}
+	if len(notDeleted.Reasons) > 0 {
+		return notDeleted
+	}
+	return nil
+}
+
+// sortOldestFirst sorts the instances and their node names by launch time, oldest first.
+// Instances whose launch time isn't known keep their order, after the others.
+func (ng *AwsNodeGroup) sortOldestFirst(refs []*AwsInstanceRef, names []string) {
+	type candidate struct {
+		ref        *AwsInstanceRef
+		name       string
+		launchTime time.Time
+		known      bool
+	}
+	candidates := make([]candidate, len(refs))
+	for i, ref := range refs {
+		launchTime, known := ng.awsManager.asgCache.InstanceLaunchTime(*ref)
+		candidates[i] = candidate{ref: ref, name: names[i], launchTime: launchTime, known: known}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].known != candidates[j].known {
+			return candidates[i].known
+		}
+		return candidates[i].launchTime.Before(candidates[j].launchTime)
+	})
+	for i, c := range candidates {
+		refs[i] = c.ref
+		names[i] = c.name
+	}
+}
+
+// NodesNotDeletedError is returned by DeleteNodes when some of the nodes were left in
+// place, so that they aren't counted as removed. The other nodes were deleted.
+type NodesNotDeletedError struct {
+	AsgName string
+	// Reasons maps the names of the nodes left in place to why they were
+	Reasons map[string]string
+}
+
+func (e *NodesNotDeletedError) Error() string {
+	names := make([]string, 0, len(e.Reasons))
+	for name := range e.Reasons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	reasons := make([]string, len(names))
+	for i, name := range names {
+		reasons[i] = fmt.Sprintf("%s %s", name, e.Reasons[name])
 	}
-	return ng.awsManager.DeleteInstances(refs)
+	return fmt.Sprintf("%d nodes of ASG %s were not deleted: %s", len(names), e.AsgName, strings.Join(reasons, "; "))
 }
 
-// Id returns asg id.
+// Id returns asg id, prefixed with its region for ASGs of additional regions.
 func (ng *AwsNodeGroup) Id() string {
-	return ng.asg.Name
+	return ng.asg.AwsRef.Id()
+}
+
+// snapshot returns a copy of the cached ASG of the node group, consistent with the
+// refreshes running concurrently.
+func (ng *AwsNodeGroup) snapshot() *asg {
+	return ng.awsManager.asgCache.snapshot(ng.asg)
 }
 
 // Debug returns a debug string for the Asg.
@@ -281,3 +650,301 @@ func (ng *AwsNodeGroup) Debug() string {
 func (ng *AwsNodeGroup) Nodes() ([]AwsInstanceRef, error) {
 	return ng.awsManager.GetAsgNodes(ng.asg.AwsRef)
 }
+
+// InstanceStates returns the health and lifecycle state of each instance of the node
+// group, so callers can tell InService instances from the ones going away.
+func (ng *AwsNodeGroup) InstanceStates() (map[AwsInstanceRef]InstanceState, error) {
+	return ng.awsManager.GetAsgInstanceStates(ng.asg.AwsRef)
+}
+
+// InServiceCount returns the number of cached instances of the node group in the
+// InService lifecycle state. Unlike TargetSize, it leaves out instances still launching,
+// going away and not launched at all, so a count below the target size for long points
+// at failing launches.
+func (ng *AwsNodeGroup) InServiceCount() (int, error) {
+	states, err := ng.InstanceStates()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, state := range states {
+		if state.LifecycleState == autoscaling.LifecycleStateInService {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// AvailabilityZones returns all the availability zones the ASG spans.
+func (ng *AwsNodeGroup) AvailabilityZones() []string {
+	return ng.snapshot().AvailabilityZones
+}
+
+// InstancesPerZone returns the number of instances of the node group in each of its
+// availability zones, so that callers can balance scale-ups across zones.
+func (ng *AwsNodeGroup) InstancesPerZone() (map[string]int, error) {
+	return ng.awsManager.asgCache.InstancesPerZone(ng.asg.AwsRef), nil
+}
+
+// LastUpdated returns when the cached state of the node group was last refreshed
+// from AWS, or the zero time if it never was.
+func (ng *AwsNodeGroup) LastUpdated() time.Time {
+	return ng.awsManager.GetAsgLastRefreshed(ng.asg.AwsRef)
+}
+
+// GetOptions returns the autoscaling options of the node group, falling back to
+// the given defaults for the options not set on the ASG.
+func (ng *AwsNodeGroup) GetOptions(defaults NodeGroupAutoscalingOptions) (*NodeGroupAutoscalingOptions, error) {
+	return ng.awsManager.GetAsgOptions(ng.snapshot(), defaults), nil
+}
+
+// TemplateCapacity returns the capacity of a node built from the ASG template.
+func (ng *AwsNodeGroup) TemplateCapacity() (apiv1.ResourceList, error) {
+	asg := ng.snapshot()
+	template, err := ng.awsManager.getAsgTemplate(asg)
+	if err != nil {
+		return nil, err
+	}
+	return ng.awsManager.buildCapacityFromTemplate(asg, template)
+}
+
+// TemplateNode returns a node built from the ASG template, used to simulate scale-ups
+// from zero.
+func (ng *AwsNodeGroup) TemplateNode() (*apiv1.Node, error) {
+	asg := ng.snapshot()
+	template, err := ng.awsManager.getAsgTemplate(asg)
+	if err != nil {
+		return nil, err
+	}
+	return ng.awsManager.buildNodeFromTemplate(asg, template)
+}
+
+// SuspendedProcesses returns the names of the scaling processes suspended on the ASG.
+func (ng *AwsNodeGroup) SuspendedProcesses() []string {
+	return ng.snapshot().SuspendedProcesses
+}
+
+// ScalingSuspended returns whether the Launch or Terminate process of the ASG is
+// suspended, in which case changes to its size don't launch or terminate instances.
+func (ng *AwsNodeGroup) ScalingSuspended() bool {
+	return ng.LaunchSuspended() || ng.TerminateSuspended()
+}
+
+// LaunchSuspended returns whether the Launch process of the ASG is suspended.
+func (ng *AwsNodeGroup) LaunchSuspended() bool {
+	return ng.snapshot().isProcessSuspended(scalingProcessLaunch)
+}
+
+// TerminateSuspended returns whether the Terminate process of the ASG is suspended.
+func (ng *AwsNodeGroup) TerminateSuspended() bool {
+	return ng.snapshot().isProcessSuspended(scalingProcessTerminate)
+}
+
+// IPFamily returns the primary IP family of the instances of the node group, IPv6 for
+// nodes of IPv6 EKS clusters. It isn't reflected on template nodes, as there is no
+// well-known node label for it and labels that the real nodes lack would mislead
+// scheduling; callers that need it for predicates read it here.
+func (ng *AwsNodeGroup) IPFamily() apiv1.IPFamily {
+	return ng.snapshot().ipFamily()
+}
+
+// RootVolume returns the type, IOPS and throughput of the EBS root volume set by the
+// launch template of the node group, or nil if it has no launch template or leaves the
+// root volume to the AMI.
+func (ng *AwsNodeGroup) RootVolume() *EbsVolume {
+	return ng.snapshot().RootVolume
+}
+
+// LaunchTemplateVersion identifies a version of an EC2 launch template.
+type LaunchTemplateVersion struct {
+	Name    string
+	Version string
+}
+
+// LaunchTemplate returns the launch template and version currently used by the node
+// group, or nil if it uses a launch configuration.
+func (ng *AwsNodeGroup) LaunchTemplate() (*LaunchTemplateVersion, error) {
+	return ng.awsManager.GetAsgLaunchTemplate(context.Background(), ng.snapshot())
+}
+
+// Reservations returns the kube-reserved, system-reserved and eviction thresholds
+// subtracted from the capacity of the template node to compute its allocatable.
+func (ng *AwsNodeGroup) Reservations() (*Reservations, error) {
+	return buildReservationsFromAsg(ng.snapshot())
+}
+
+// ExpanderInfo describes a node group to the price and priority expanders.
+type ExpanderInfo struct {
+	// Priority from the node-template/priority tag, 0 when not set.
+	Priority int
+	// CapacityType is either CapacityTypeOnDemand or CapacityTypeSpot.
+	CapacityType string
+	InstanceType string
+	// CostHint from the node-template/cost-hint tag, 0 when not set.
+	CostHint float64
+	// CapacityReserved is true when the node group launches into a capacity reservation.
+	CapacityReserved bool
+	// SpotAllocationStrategy of the mixed instances policy, empty without a policy.
+	SpotAllocationStrategy string
+}
+
+// ExpanderInfo returns the expander descriptor of the node group, assembled from cached state.
+func (ng *AwsNodeGroup) ExpanderInfo() (*ExpanderInfo, error) {
+	asg := ng.snapshot()
+	instanceType, err := getInstanceTypeForAsg(ng.awsManager.asgCache, asg)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ExpanderInfo{
+		CapacityType:           capacityType(asg),
+		InstanceType:           instanceType,
+		CapacityReserved:       asg.CapacityReservationTargeted,
+		SpotAllocationStrategy: asg.SpotAllocationStrategy,
+	}
+	if value, found := asg.tagValue(expanderPriorityTag); found {
+		if info.Priority, err = strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("invalid %s tag on ASG %s: %v", expanderPriorityTag, ng.Id(), err)
+		}
+	}
+	if value, found := asg.tagValue(costHintTag); found {
+		if info.CostHint, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("invalid %s tag on ASG %s: %v", costHintTag, ng.Id(), err)
+		}
+	}
+	return info, nil
+}
+
+// Price returns the approximate hourly on-demand price in USD of a node of the node group,
+// for cost-aware expanders. It returns an error wrapping ErrPriceUnavailable when pricing
+// is not enabled or the price of its instance type isn't known.
+func (ng *AwsNodeGroup) Price() (float64, error) {
+	return ng.awsManager.GetAsgPrice(context.Background(), ng.snapshot())
+}
+
+// capacityType returns the capacity type of the ASG, from the capacity type label tag if
+// present, otherwise from the instances distribution of its mixed instances policy.
+func capacityType(asg *asg) string {
+	if value, found := asg.tagValue(capacityTypeTag); found {
+		return strings.ToUpper(value)
+	}
+	if policy := asg.MixedInstancesPolicy; policy != nil && policy.instancesDistribution != nil {
+		distribution := policy.instancesDistribution
+		if aws.Int64Value(distribution.OnDemandBaseCapacity) == 0 &&
+			distribution.OnDemandPercentageAboveBaseCapacity != nil &&
+			aws.Int64Value(distribution.OnDemandPercentageAboveBaseCapacity) == 0 {
+			return CapacityTypeSpot
+		}
+	}
+	return CapacityTypeOnDemand
+}
+
+// IsSimilarTo returns whether the templates of the two node groups are similar enough
+// for their sizes to be balanced: same instance type family, capacity, labels and taints.
+func (ng *AwsNodeGroup) IsSimilarTo(other *AwsNodeGroup) (bool, error) {
+	asg, otherAsg := ng.snapshot(), other.snapshot()
+	template, err := ng.awsManager.getAsgTemplate(asg)
+	if err != nil {
+		return false, err
+	}
+	otherTemplate, err := other.awsManager.getAsgTemplate(otherAsg)
+	if err != nil {
+		return false, err
+	}
+
+	if instanceTypeFamily(template.InstanceType.InstanceType) != instanceTypeFamily(otherTemplate.InstanceType.InstanceType) {
+		return false, nil
+	}
+
+	capacity, err := ng.awsManager.buildCapacityFromTemplate(asg, template)
+	if err != nil {
+		return false, err
+	}
+	otherCapacity, err := other.awsManager.buildCapacityFromTemplate(otherAsg, otherTemplate)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range []apiv1.ResourceName{apiv1.ResourceCPU, ResourceNvidiaGPU} {
+		quantity, otherQuantity := capacity[name], otherCapacity[name]
+		if quantity.Cmp(otherQuantity) != 0 {
+			return false, nil
+		}
+	}
+	memory, otherMemory := capacity[apiv1.ResourceMemory], otherCapacity[apiv1.ResourceMemory]
+	larger := math.Max(float64(memory.Value()), float64(otherMemory.Value()))
+	if larger > 0 && math.Abs(float64(memory.Value()-otherMemory.Value()))/larger > maxCapacityMemoryDifferenceRatio {
+		return false, nil
+	}
+
+	if !reflect.DeepEqual(extractLabelsFromAsg(asg.Tags), extractLabelsFromAsg(otherAsg.Tags)) {
+		return false, nil
+	}
+	taints, err := extractTaintsFromAsg(asg.Tags)
+	if err != nil {
+		return false, err
+	}
+	otherTaints, err := extractTaintsFromAsg(otherAsg.Tags)
+	if err != nil {
+		return false, err
+	}
+	return taintsEqual(taints, otherTaints), nil
+}
+
+// instanceTypeFamily returns the family of an instance type, e.g. m5 for m5.large.
+func instanceTypeFamily(instanceType string) string {
+	return strings.SplitN(instanceType, ".", 2)[0]
+}
+
+func taintsEqual(taints, otherTaints []apiv1.Taint) bool {
+	if len(taints) != len(otherTaints) {
+		return false
+	}
+	keys := make(map[string]apiv1.Taint, len(taints))
+	for _, taint := range taints {
+		keys[taint.Key] = taint
+	}
+	for _, taint := range otherTaints {
+		if existing, found := keys[taint.Key]; !found || !existing.MatchTaint(&taint) || existing.Value != taint.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// WithinLaunchGracePeriod returns whether the size of the node group was increased less
+// than the launch grace period of the manager ago, so its missing instances may still be
+// launched.
+func (ng *AwsNodeGroup) WithinLaunchGracePeriod() bool {
+	grace := ng.awsManager.launchGracePeriod
+	lastScaleUp := ng.awsManager.asgCache.LastScaleUp(ng.asg)
+	return grace > 0 && !lastScaleUp.IsZero() && time.Since(lastScaleUp) < grace
+}
+
+// FailedPlaceholders returns the placeholder nodes of the node group that cannot be
+// fulfilled, e.g. when a spot ASG can't get capacity, along with the failure reasons.
+// Within the launch grace period, placeholders are pending and none is reported.
+func (ng *AwsNodeGroup) FailedPlaceholders() (map[AwsInstanceRef]string, error) {
+	nodes, err := ng.Nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make(map[AwsInstanceRef]string)
+	if ng.WithinLaunchGracePeriod() {
+		klog.V(4).Infof("ASG %s was scaled up less than %v ago, its placeholders are pending", ng.Id(), ng.awsManager.launchGracePeriod)
+		return failed, nil
+	}
+	for _, node := range nodes {
+		if !ng.awsManager.asgCache.isPlaceholderInstance(&node) {
+			continue
+		}
+		status, err := ng.awsManager.GetInstanceStatus(node)
+		if err != nil {
+			continue
+		}
+		if reason, unfulfillable := unfulfillablePlaceholderReason(status); unfulfillable {
+			failed[node] = reason
+		}
+	}
+	return failed, nil
+}
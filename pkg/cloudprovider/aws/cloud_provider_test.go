@@ -0,0 +1,820 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDeleteNodesPartialOnMinSize(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{
+		testGroup("asg-1", 2, 3, 5, "i-1", "i-2", "i-3"),
+	}}
+	manager := newTestManager(t, autoScaling, nil)
+	manager.SetPartialDeleteOnMinSize(true)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	err := nodeGroup.DeleteNodes([]*apiv1.Node{testNode("i-1"), testNode("i-2"), testNode("i-3")})
+	var notDeleted *NodesNotDeletedError
+	if !errors.As(err, &notDeleted) {
+		t.Fatalf("expected a NodesNotDeletedError, got %v", err)
+	}
+	if len(notDeleted.Reasons) != 2 || notDeleted.Reasons["node-i-2"] == "" || notDeleted.Reasons["node-i-3"] == "" {
+		t.Errorf("expected node-i-2 and node-i-3 to be left in place, got %v", notDeleted.Reasons)
+	}
+	if !errorContains(err, "node-i-2", "node-i-3", "min size 2") {
+		t.Errorf("expected the error to name the skipped nodes, got %v", err)
+	}
+	if len(autoScaling.terminated) != 1 || autoScaling.terminated[0] != "i-1" {
+		t.Errorf("expected only i-1 to be terminated, got %v", autoScaling.terminated)
+	}
+	if size, _ := nodeGroup.TargetSize(); size != 2 {
+		t.Errorf("expected target size 2, got %d", size)
+	}
+}
+
+func TestDeleteNodesDeletionOrder(t *testing.T) {
+	now := time.Now()
+	launched := func(id string, age time.Duration) *ec2.Instance {
+		return &ec2.Instance{InstanceId: aws.String(id), LaunchTime: aws.Time(now.Add(-age))}
+	}
+
+	for _, tc := range []struct {
+		order      DeletionOrder
+		terminated []string
+	}{
+		{DeletionOrderFIFO, []string{"i-1", "i-2"}},
+		// The launch time of i-4 is unknown, it comes last
+		{DeletionOrderOldestFirst, []string{"i-3", "i-2"}},
+	} {
+		autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 2, 4, 5, "i-1", "i-2", "i-3", "i-4")}}
+		ec2Service := &fakeEC2{instances: []*ec2.Instance{launched("i-1", time.Hour), launched("i-2", 2*time.Hour), launched("i-3", 3*time.Hour)}}
+		manager := newTestManager(t, autoScaling, ec2Service)
+		manager.SetPartialDeleteOnMinSize(true)
+		if err := manager.SetDeletionOrder(tc.order); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := manager.forceRefresh(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		err := testNodeGroup(t, manager, "asg-1").DeleteNodes([]*apiv1.Node{testNode("i-1"), testNode("i-2"), testNode("i-3"), testNode("i-4")})
+		var notDeleted *NodesNotDeletedError
+		if !errors.As(err, &notDeleted) || len(notDeleted.Reasons) != 2 {
+			t.Errorf("%s: expected two nodes to be left in place, got %v", tc.order, err)
+		}
+		if !reflect.DeepEqual(autoScaling.terminated, tc.terminated) {
+			t.Errorf("%s: expected %v to be terminated, got %v", tc.order, tc.terminated, autoScaling.terminated)
+		}
+		if tc.order == DeletionOrderFIFO && ec2Service.calls["DescribeInstances"] != 0 {
+			t.Errorf("%s: expected launch times not to be described", tc.order)
+		}
+	}
+
+	if err := newTestManager(t, &fakeAutoScaling{}, nil).SetDeletionOrder("newest-first"); err == nil {
+		t.Error("expected an unknown deletion order to be rejected")
+	}
+}
+
+func TestStrictZoneCheck(t *testing.T) {
+	// i-2 lingers in a zone removed from the ASG
+	group := testGroup("asg-1", 0, 2, 5, "i-1", "i-2")
+	group.Instances[1].AvailabilityZone = aws.String("us-east-1f")
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{group}}, nil)
+	provider := &awsCloudProvider{awsManager: manager}
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+	lingering := testNode("i-2")
+	lingering.Spec.ProviderID = "aws:///us-east-1f/i-2"
+
+	for _, strict := range []bool{false, true} {
+		manager.SetStrictZoneCheck(strict)
+		for _, tc := range []struct {
+			node    *apiv1.Node
+			belongs bool
+		}{
+			{testNode("i-1"), true},
+			{lingering, !strict},
+		} {
+			if belongs, err := nodeGroup.Belongs(tc.node); err != nil || belongs != tc.belongs {
+				t.Errorf("strict %v: expected %s to belong: %v, got %v, %v", strict, tc.node.Name, tc.belongs, belongs, err)
+			}
+			found, err := provider.NodeGroupForNode(tc.node)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (found != nil) != tc.belongs {
+				t.Errorf("strict %v: expected %s to have a node group: %v, got %v", strict, tc.node.Name, tc.belongs, found)
+			}
+		}
+	}
+}
+
+func TestFailedPlaceholdersWithinLaunchGracePeriod(t *testing.T) {
+	autoScaling := &fakeAutoScaling{
+		groups: []*autoscaling.Group{testGroup("asg-1", 0, 1, 5, "i-1")},
+		activities: map[string][]*autoscaling.Activity{"asg-1": {{
+			StartTime:     aws.Time(time.Now().Add(time.Minute)),
+			StatusCode:    aws.String(autoscaling.ScalingActivityStatusCodeFailed),
+			StatusMessage: aws.String("We currently do not have sufficient capacity"),
+		}}},
+	}
+	manager := newTestManager(t, autoScaling, nil)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+	if nodeGroup.WithinLaunchGracePeriod() {
+		t.Error("expected no launch grace period before a scale-up")
+	}
+
+	if err := nodeGroup.IncreaseSize(2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !nodeGroup.WithinLaunchGracePeriod() {
+		t.Error("expected the launch grace period to start with the scale-up")
+	}
+	if failed, err := nodeGroup.FailedPlaceholders(); err != nil || len(failed) != 0 {
+		t.Errorf("expected the placeholders to be pending, got %v, %v", failed, err)
+	}
+
+	if err := manager.SetLaunchGracePeriod(0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	failed, err := nodeGroup.FailedPlaceholders()
+	if err != nil || len(failed) != 2 {
+		t.Fatalf("expected 2 failed placeholders without a grace period, got %v, %v", failed, err)
+	}
+	for _, reason := range failed {
+		if reason != "We currently do not have sufficient capacity" {
+			t.Errorf("expected the reason of the failed activity, got %q", reason)
+		}
+	}
+
+	if err := manager.SetLaunchGracePeriod(-time.Minute); err == nil {
+		t.Error("expected a negative grace period to be rejected")
+	}
+}
+
+func TestGPULabelValueForInstanceType(t *testing.T) {
+	for name, expected := range map[string]string{
+		"g4dn.xlarge":     "nvidia-tesla-t4",
+		"g5.12xlarge":     "nvidia-a10g",
+		"p3.2xlarge":      "nvidia-tesla-v100",
+		"p3dn.24xlarge":   "nvidia-tesla-v100",
+		"p4d.24xlarge":    "nvidia-tesla-a100",
+		"m5.large":        "",
+		"inf1.xlarge":     "",
+		"not-an-instance": "",
+	} {
+		gpuType, found := GPULabelValueForInstanceType(name)
+		if gpuType != expected || found != (expected != "") {
+			t.Errorf("%s: expected %q, got %q, %v", name, expected, gpuType, found)
+		}
+	}
+	for family, gpuType := range gpuTypesByInstanceFamily {
+		if _, available := availableGPUTypes[gpuType]; !available {
+			t.Errorf("%s: %s is not one of the available GPU types", family, gpuType)
+		}
+	}
+}
+
+func TestTemplateCapacityMatchesInstanceType(t *testing.T) {
+	stubInstanceTypes(t, map[string]string{"asg-1": "m5.2xlarge"})
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 0, 5)}}, nil)
+
+	capacity, err := testNodeGroup(t, manager, "asg-1").TemplateCapacity()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	instanceType := InstanceTypes["m5.2xlarge"]
+	if cpu := capacity[apiv1.ResourceCPU]; cpu.Value() != instanceType.VCPU {
+		t.Errorf("expected %d CPUs, got %s", instanceType.VCPU, cpu.String())
+	}
+	if memory := capacity[apiv1.ResourceMemory]; memory.Value() != instanceType.MemoryMb*1024*1024 {
+		t.Errorf("expected %d MiB of memory, got %s", instanceType.MemoryMb, memory.String())
+	}
+	if gpu := capacity[ResourceNvidiaGPU]; gpu.Value() != 0 {
+		t.Errorf("expected no GPU, got %s", gpu.String())
+	}
+}
+
+func TestIncreaseSizeBlockedWhenScaleUpDisabled(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 1, 5, "i-1")}}
+	manager := newTestManager(t, autoScaling, nil)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	manager.SetScaleUpDisabled(true)
+	if err := nodeGroup.IncreaseSize(1); !errorContains(err, "scale-up globally disabled", "asg-1") {
+		t.Errorf("expected scale-up to be blocked, got %v", err)
+	}
+	if calls := autoScaling.callCount("SetDesiredCapacity"); calls != 0 {
+		t.Errorf("expected no SetDesiredCapacity call, got %d", calls)
+	}
+
+	manager.SetScaleUpDisabled(false)
+	if err := nodeGroup.IncreaseSize(1); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if calls := autoScaling.callCount("SetDesiredCapacity"); calls != 1 {
+		t.Errorf("expected a SetDesiredCapacity call once re-enabled, got %d", calls)
+	}
+}
+
+func TestDecreaseTargetSizeRefreshesLaunchedInstances(t *testing.T) {
+	group := testGroup("asg-1", 0, 3, 5, "i-1", "i-2")
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{group}}
+	manager := newTestManager(t, autoScaling, nil)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	// The third instance is launched after the cache was built, the cache still has a
+	// placeholder for it
+	autoScaling.mutex.Lock()
+	group.Instances = append(group.Instances, testInstance("i-3"))
+	autoScaling.mutex.Unlock()
+
+	err := nodeGroup.DecreaseTargetSize(-1)
+	if !errorContains(err, "attempt to delete existing nodes", "asg-1") {
+		t.Fatalf("expected the decrease to be rejected, got %v", err)
+	}
+	if calls := autoScaling.callCount("SetDesiredCapacity"); calls != 0 {
+		t.Errorf("expected no SetDesiredCapacity call, got %d", calls)
+	}
+	if nodes, _ := manager.GetAsgNodes(nodeGroup.asg.AwsRef); len(nodes) != 3 || nodes[2].Name != "i-3" {
+		t.Errorf("expected the refreshed instances, got %v", nodes)
+	}
+}
+
+func TestDecreaseTargetSizeCancelsPlaceholders(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 3, 5, "i-1", "i-2")}}
+	manager := newTestManager(t, autoScaling, nil)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	if err := nodeGroup.DecreaseTargetSize(-1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size, _ := nodeGroup.TargetSize(); size != 2 {
+		t.Errorf("expected target size 2, got %d", size)
+	}
+}
+
+func TestSetSize(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 1, 3, 5, "i-1", "i-2")}}
+	manager := newTestManager(t, autoScaling, nil)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	for _, target := range []int{0, 6} {
+		if err := nodeGroup.SetSize(target); !errorContains(err, "outside of [1, 5]", "asg-1") {
+			t.Errorf("expected size %d to be rejected, got %v", target, err)
+		}
+	}
+	// Only the placeholder of the third instance can be cancelled
+	if err := nodeGroup.SetSize(1); !errorContains(err, "attempt to delete existing nodes", "asg-1") {
+		t.Errorf("expected the decrease to be rejected, got %v", err)
+	}
+	if err := nodeGroup.SetSize(3); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if calls := autoScaling.callCount("SetDesiredCapacity"); calls != 0 {
+		t.Errorf("expected no SetDesiredCapacity call, got %d", calls)
+	}
+
+	for _, target := range []int{2, 5} {
+		if err := nodeGroup.SetSize(target); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if desired := aws.Int64Value(autoScaling.group("asg-1").DesiredCapacity); desired != int64(target) {
+			t.Errorf("expected a desired capacity of %d, got %d", target, desired)
+		}
+	}
+
+	manager.SetScaleUpDisabled(true)
+	if err := nodeGroup.SetSize(2); err != nil {
+		t.Errorf("expected decreases to be allowed while scale-up is disabled, got %v", err)
+	}
+	if err := nodeGroup.SetSize(4); !errorContains(err, "scale-up globally disabled") {
+		t.Errorf("expected the increase to be blocked, got %v", err)
+	}
+}
+
+func TestInServiceCount(t *testing.T) {
+	group := testGroup("asg-1", 0, 5, 5, "i-1", "i-2", "i-3", "i-4")
+	group.Instances[1].LifecycleState = aws.String(autoscaling.LifecycleStatePending)
+	group.Instances[2].LifecycleState = aws.String(autoscaling.LifecycleStateTerminatingWait)
+	nodeGroup := testNodeGroup(t, newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{group}}, nil), "asg-1")
+
+	// The placeholder of the fifth instance, the launching and the terminating instances
+	// are not in service
+	if count, err := nodeGroup.InServiceCount(); err != nil || count != 2 {
+		t.Errorf("expected 2 instances in service, got %d, %v", count, err)
+	}
+	if size, _ := nodeGroup.TargetSize(); size != 5 {
+		t.Errorf("expected target size 5, got %d", size)
+	}
+}
+
+func TestExpanderInfo(t *testing.T) {
+	stubInstanceTypes(t, map[string]string{"spot": "m5.large", "on-demand": "c5.xlarge", "invalid": "m5.large"})
+	spot := withMixedInstancesPolicy(testGroup("spot", 0, 0, 5), &autoscaling.InstancesDistribution{
+		OnDemandBaseCapacity:                aws.Int64(0),
+		OnDemandPercentageAboveBaseCapacity: aws.Int64(0),
+		SpotAllocationStrategy:              aws.String("price-capacity-optimized"),
+	}, &autoscaling.LaunchTemplateOverrides{InstanceType: aws.String("m5.large")})
+	withTag(spot, expanderPriorityTag, "10")
+	withTag(spot, costHintTag, "0.25")
+	onDemand := testGroup("on-demand", 0, 0, 5)
+	invalid := withTag(testGroup("invalid", 0, 0, 5), expanderPriorityTag, "high")
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{spot, onDemand, invalid}}, nil)
+
+	info, err := testNodeGroup(t, manager, "spot").ExpanderInfo()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := ExpanderInfo{
+		Priority:               10,
+		CapacityType:           CapacityTypeSpot,
+		InstanceType:           "m5.large",
+		CostHint:               0.25,
+		SpotAllocationStrategy: "price-capacity-optimized",
+	}
+	if *info != expected {
+		t.Errorf("expected %+v, got %+v", expected, *info)
+	}
+
+	info, err = testNodeGroup(t, manager, "on-demand").ExpanderInfo()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = ExpanderInfo{CapacityType: CapacityTypeOnDemand, InstanceType: "c5.xlarge"}
+	if *info != expected {
+		t.Errorf("expected %+v, got %+v", expected, *info)
+	}
+
+	if _, err := testNodeGroup(t, manager, "invalid").ExpanderInfo(); !errorContains(err, expanderPriorityTag, "invalid") {
+		t.Errorf("expected an invalid priority error, got %v", err)
+	}
+}
+
+func TestHasInstanceWithinNotPresentGrace(t *testing.T) {
+	now := time.Now()
+	ec2Service := &fakeEC2{instances: []*ec2.Instance{
+		{InstanceId: aws.String("i-new"), LaunchTime: aws.Time(now.Add(-time.Minute)), State: &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)}},
+		{InstanceId: aws.String("i-old"), LaunchTime: aws.Time(now.Add(-time.Hour)), State: &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)}},
+		{InstanceId: aws.String("i-gone"), LaunchTime: aws.Time(now.Add(-time.Minute)), State: &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameTerminated)}},
+	}}
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 1, 5, "i-1")}}
+	manager := newTestManager(t, autoScaling, ec2Service)
+	manager.SetInstanceNotPresentGrace(10 * time.Minute)
+	provider := &awsCloudProvider{awsManager: manager}
+
+	for instanceId, expected := range map[string]bool{"i-1": true, "i-new": true, "i-old": false, "i-gone": false, "i-unknown": false} {
+		present, _ := provider.HasInstance(testNode(instanceId))
+		if present != expected {
+			t.Errorf("expected HasInstance of %s to be %v, got %v", instanceId, expected, present)
+		}
+	}
+
+	// Launch times are memoized until the next refresh, which prunes them
+	describes := ec2Service.calls["DescribeInstances"]
+	provider.HasInstance(testNode("i-new"))
+	if ec2Service.calls["DescribeInstances"] != describes {
+		t.Errorf("expected the launch time of i-new to be memoized")
+	}
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(manager.launchTimes) != 1 {
+		t.Errorf("expected only the launch time of i-new to be kept, got %v", manager.launchTimes)
+	}
+}
+
+func TestDeleteNodesSkipsProtectedInstances(t *testing.T) {
+	group := testGroup("asg-1", 0, 3, 5, "i-1", "i-2", "i-3")
+	group.Instances[1].ProtectedFromScaleIn = aws.Bool(true)
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{group}}
+	manager := newTestManager(t, autoScaling, nil)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	err := nodeGroup.DeleteNodes([]*apiv1.Node{testNode("i-1"), testNode("i-2"), testNode("i-3")})
+	var notDeleted *NodesNotDeletedError
+	if !errors.As(err, &notDeleted) || len(notDeleted.Reasons) != 1 || notDeleted.Reasons["node-i-2"] != "is protected from scale-in by the ASG" {
+		t.Fatalf("expected node-i-2 to be left in place for its scale-in protection, got %v", err)
+	}
+	if len(autoScaling.terminated) != 2 || autoScaling.terminated[0] != "i-1" || autoScaling.terminated[1] != "i-3" {
+		t.Errorf("expected only the unprotected instances to be terminated, got %v", autoScaling.terminated)
+	}
+}
+
+func TestDeleteNodesSkipsLaunchingInstances(t *testing.T) {
+	group := testGroup("asg-1", 0, 3, 5, "i-1", "i-2", "i-3")
+	group.Instances[0].LifecycleState = aws.String(autoscaling.LifecycleStatePending)
+	group.Instances[1].LifecycleState = aws.String(autoscaling.LifecycleStatePendingWait)
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{group}}
+	manager := newTestManager(t, autoScaling, nil)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+	nodes := []*apiv1.Node{testNode("i-1"), testNode("i-2"), testNode("i-3")}
+
+	err := nodeGroup.DeleteNodes(nodes)
+	var notDeleted *NodesNotDeletedError
+	if !errors.As(err, &notDeleted) || len(notDeleted.Reasons) != 2 ||
+		notDeleted.Reasons["node-i-1"] != "is still launching" || notDeleted.Reasons["node-i-2"] != "is still launching" {
+		t.Fatalf("expected the launching nodes to be left in place, got %v", err)
+	}
+	if len(autoScaling.terminated) != 1 || autoScaling.terminated[0] != "i-3" {
+		t.Errorf("expected only i-3 to be terminated, got %v", autoScaling.terminated)
+	}
+
+	manager.SetForceDeleteLaunchingInstances(true)
+	if err := nodeGroup.DeleteNodes(nodes[:2]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(autoScaling.terminated) != 3 {
+		t.Errorf("expected the launching instances to be terminated when forced, got %v", autoScaling.terminated)
+	}
+}
+
+func TestDeleteNodesSkipsProtectTaints(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 2, 3, 5, "i-1", "i-2", "i-3")}}
+	manager := newTestManager(t, autoScaling, nil)
+	manager.SetProtectTaintKeys([]string{"example.com/stateful"})
+	manager.SetPartialDeleteOnMinSize(true)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	tainted := testNode("i-1")
+	tainted.Spec.Taints = []apiv1.Taint{{Key: "example.com/stateful", Effect: apiv1.TaintEffectNoSchedule}}
+	err := nodeGroup.DeleteNodes([]*apiv1.Node{tainted, testNode("i-2"), testNode("i-3")})
+
+	// The min size applies to the nodes left once the tainted one is skipped
+	var notDeleted *NodesNotDeletedError
+	if !errors.As(err, &notDeleted) || len(notDeleted.Reasons) != 2 {
+		t.Fatalf("expected two nodes to be left in place, got %v", err)
+	}
+	if !errorContains(err, "node-i-1 has the protect taint example.com/stateful", "node-i-3 would take the ASG below its min size 2") {
+		t.Errorf("expected a distinct reason for each node, got %v", err)
+	}
+	if len(autoScaling.terminated) != 1 || autoScaling.terminated[0] != "i-2" {
+		t.Errorf("expected only i-2 to be terminated, got %v", autoScaling.terminated)
+	}
+
+	// Without partial deletes, the nodes left once the tainted ones are skipped are all
+	// kept if deleting them would take the ASG below its min size
+	autoScaling.groups[0] = testGroup("asg-1", 2, 3, 5, "i-4", "i-5", "i-6")
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	manager.SetPartialDeleteOnMinSize(false)
+	nodeGroup = testNodeGroup(t, manager, "asg-1")
+	tainted = testNode("i-4")
+	tainted.Spec.Taints = []apiv1.Taint{{Key: "example.com/stateful", Effect: apiv1.TaintEffectNoSchedule}}
+	err = nodeGroup.DeleteNodes([]*apiv1.Node{tainted, testNode("i-5"), testNode("i-6")})
+	if !errorContains(err, "would take ASG asg-1 below its min size 2") {
+		t.Errorf("expected the deletion to be rejected, got %v", err)
+	}
+	if len(autoScaling.terminated) != 1 {
+		t.Errorf("expected no other instance to be terminated, got %v", autoScaling.terminated)
+	}
+}
+
+func TestIsSimilarTo(t *testing.T) {
+	stubInstanceTypes(t, map[string]string{
+		"a-1": "m5.xlarge", "a-2": "m5.xlarge", "larger": "m5.2xlarge", "other-family": "c5.xlarge",
+		"labeled": "m5.xlarge", "tainted": "m5.xlarge",
+	})
+	groups := []*autoscaling.Group{
+		testGroup("a-1", 0, 0, 5),
+		// Similar node groups usually span different zones
+		testGroup("a-2", 0, 0, 5),
+		testGroup("larger", 0, 0, 5),
+		testGroup("other-family", 0, 0, 5),
+		withTag(testGroup("labeled", 0, 0, 5), nodeTemplateLabelTagPrefix+"team", "data"),
+		withTag(testGroup("tainted", 0, 0, 5), nodeTemplateTaintTagPrefix+"dedicated", "data:NoSchedule"),
+	}
+	groups[1].AvailabilityZones = aws.StringSlice([]string{"us-east-1b"})
+	manager := newTestManager(t, &fakeAutoScaling{groups: groups}, nil)
+	reference := testNodeGroup(t, manager, "a-1")
+
+	for name, expected := range map[string]bool{
+		"a-2":          true,
+		"larger":       false,
+		"other-family": false,
+		"labeled":      false,
+		"tainted":      false,
+	} {
+		similar, err := reference.IsSimilarTo(testNodeGroup(t, manager, name))
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", name, err)
+		}
+		if similar != expected {
+			t.Errorf("expected a-1 similar to %s to be %v, got %v", name, expected, similar)
+		}
+	}
+}
+
+func TestIncreaseSizeDelta(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 1, 5, "i-1")}}
+	nodeGroup := testNodeGroup(t, newTestManager(t, autoScaling, nil), "asg-1")
+
+	if err := nodeGroup.IncreaseSize(0); err != nil {
+		t.Errorf("expected a delta of 0 to be a no-op, got %v", err)
+	}
+	if err := nodeGroup.IncreaseSize(-1); !errorContains(err, "size increase must be positive") {
+		t.Errorf("expected a negative delta to be rejected, got %v", err)
+	}
+	if calls := autoScaling.callCount("SetDesiredCapacity"); calls != 0 {
+		t.Errorf("expected no SetDesiredCapacity call, got %d", calls)
+	}
+}
+
+func TestIncreaseSizeClampedToMaxScaleUpStep(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{
+		testGroup("asg-1", 0, 1, 100, "i-1"),
+		withTag(testGroup("asg-2", 0, 1, 100, "i-2"), optionsTagsPrefix+maxScaleUpStepKey, "5"),
+		withTag(testGroup("asg-3", 0, 1, 100, "i-3"), optionsTagsPrefix+maxScaleUpStepKey, "invalid"),
+	}}
+	manager := newTestManager(t, autoScaling, nil)
+	if err := manager.SetMaxScaleUpStep(20); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		asg     string
+		delta   int
+		desired int64
+	}{
+		{"asg-1", 10, 11},
+		{"asg-1", 50, 21},
+		{"asg-2", 50, 6},
+		{"asg-3", 50, 21},
+	} {
+		if err := testNodeGroup(t, manager, tc.asg).IncreaseSize(tc.delta); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.asg, err)
+		}
+		if desired := aws.Int64Value(autoScaling.group(tc.asg).DesiredCapacity); desired != tc.desired {
+			t.Errorf("%s: expected a desired capacity of %d after increasing by %d, got %d", tc.asg, tc.desired, tc.delta, desired)
+		}
+		autoScaling.group(tc.asg).DesiredCapacity = aws.Int64(1)
+		if err := manager.forceRefresh(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := manager.SetMaxScaleUpStep(-1); err == nil {
+		t.Error("expected a negative step to be rejected")
+	}
+}
+
+func TestGetOptionsMaxNodeProvisionTime(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{
+		testGroup("asg-1", 0, 1, 10, "i-1"),
+		withTag(testGroup("asg-2", 0, 1, 10, "i-2"), optionsTagsPrefix+maxNodeProvisionTimeKey, "25m"),
+		withTag(testGroup("asg-3", 0, 1, 10, "i-3"), optionsTagsPrefix+maxNodeProvisionTimeKey, "invalid"),
+		withTag(testGroup("asg-4", 0, 1, 10, "i-4"), optionsTagsPrefix+maxNodeProvisionTimeKey, "0s"),
+	}}
+	manager := newTestManager(t, autoScaling, nil)
+	defaults := NodeGroupAutoscalingOptions{MaxNodeProvisionTime: 15 * time.Minute}
+
+	for _, tc := range []struct {
+		asg      string
+		expected time.Duration
+	}{
+		{"asg-1", 15 * time.Minute},
+		{"asg-2", 25 * time.Minute},
+		{"asg-3", 15 * time.Minute},
+		{"asg-4", 15 * time.Minute},
+	} {
+		options, err := testNodeGroup(t, manager, tc.asg).GetOptions(defaults)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.asg, err)
+		}
+		if options.MaxNodeProvisionTime != tc.expected {
+			t.Errorf("%s: expected a max node provision time of %v, got %v", tc.asg, tc.expected, options.MaxNodeProvisionTime)
+		}
+	}
+}
+
+func TestLastUpdatedAdvancesOnRefresh(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 1, 5, "i-1")}}
+	manager := newTestManager(t, autoScaling, nil)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	first := nodeGroup.LastUpdated()
+	if first.IsZero() {
+		t.Fatal("expected LastUpdated to be set by the initial refresh")
+	}
+	time.Sleep(time.Millisecond)
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second := nodeGroup.LastUpdated()
+	if !second.After(first) {
+		t.Errorf("expected LastUpdated to advance on refresh, got %v then %v", first, second)
+	}
+	time.Sleep(time.Millisecond)
+	if err := manager.RefreshAsg(nodeGroup.asg.AwsRef); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if third := nodeGroup.LastUpdated(); !third.After(second) {
+		t.Errorf("expected LastUpdated to advance on a single ASG refresh, got %v then %v", second, third)
+	}
+}
+
+func TestHasInstanceUntrackedPolicies(t *testing.T) {
+	ec2Service := &fakeEC2{instances: []*ec2.Instance{{
+		InstanceId: aws.String("i-untracked"),
+		LaunchTime: aws.Time(time.Now().Add(-time.Hour)),
+		State:      &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+	}}}
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 1, 5, "i-1")}}, ec2Service)
+	provider := &awsCloudProvider{awsManager: manager}
+	node := testNode("i-untracked")
+
+	for policy, expected := range map[UntrackedInstancePolicy]bool{
+		UntrackedInstanceUnmanaged: false,
+		UntrackedInstancePresent:   true,
+	} {
+		if err := manager.SetUntrackedInstancePolicy(policy); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if present, _ := provider.HasInstance(node); present != expected {
+			t.Errorf("expected HasInstance to be %v with policy %s, got %v", expected, policy, present)
+		}
+		// Untracked instances are never part of a node group
+		if nodeGroup, err := provider.NodeGroupForNode(node); err != nil || nodeGroup != nil {
+			t.Errorf("expected no node group with policy %s, got %v, %v", policy, nodeGroup, err)
+		}
+	}
+}
+
+func TestAwsRefFromProviderId(t *testing.T) {
+	testCases := []struct {
+		name       string
+		providerID string
+		expected   string
+		err        bool
+	}{
+		{name: "eks", providerID: "aws:///us-east-1a/i-0abc123def4567890", expected: "i-0abc123def4567890"},
+		{name: "eks with eni segment", providerID: "aws:///us-east-1a/i-0abc123/eni-0123", expected: "i-0abc123"},
+		{name: "kops", providerID: "aws:///eu-west-1b/i-0123456789abcdef0", expected: "i-0123456789abcdef0"},
+		{name: "placeholder", providerID: "aws:///us-east-1a/i-placeholder-asg-1-0", expected: "i-placeholder-asg-1-0"},
+		{name: "missing zone segment", providerID: "aws://i-0abc123", err: true},
+		{name: "other provider", providerID: "gce://project/us-central1-a/node-1", err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := AwsRefFromProviderId(tc.providerID)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ref.Name != tc.expected || ref.ProviderID != tc.providerID {
+				t.Errorf("expected instance %s of %s, got %+v", tc.expected, tc.providerID, ref)
+			}
+		})
+	}
+}
+
+// clusterOfNodes returns a provider of 10 ASGs and their nodes, 100 per ASG.
+func clusterOfNodes(tb testing.TB) (*awsCloudProvider, []*apiv1.Node) {
+	autoScaling := &fakeAutoScaling{}
+	nodes := []*apiv1.Node{}
+	for i := 0; i < 10; i++ {
+		var ids []string
+		for j := 0; j < 100; j++ {
+			id := fmt.Sprintf("i-%d-%d", i, j)
+			ids = append(ids, id)
+			nodes = append(nodes, testNode(id))
+		}
+		autoScaling.groups = append(autoScaling.groups, testGroup(fmt.Sprintf("asg-%d", i), 0, 100, 100, ids...))
+	}
+	return &awsCloudProvider{awsManager: newTestManager(tb, autoScaling, nil)}, nodes
+}
+
+func TestNodeGroupForNodes(t *testing.T) {
+	provider, nodes := clusterOfNodes(t)
+
+	// Nodes without provider ID are omitted
+	nodeGroups, err := provider.NodeGroupForNodes(append(nodes, &apiv1.Node{}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodeGroups) != 1000 {
+		t.Fatalf("expected the node groups of 1000 nodes, got %d", len(nodeGroups))
+	}
+	for _, node := range nodes {
+		single, err := provider.NodeGroupForNode(node)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if nodeGroups[node.Name].Id() != single.Id() {
+			t.Errorf("expected node group %s for %s, got %s", single.Id(), node.Name, nodeGroups[node.Name].Id())
+		}
+	}
+}
+
+func TestNodeGroupForNodesByPrivateDnsName(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 2, 10, "i-1", "i-2")}}
+	ec2Service := &fakeEC2{instances: []*ec2.Instance{{
+		InstanceId:     aws.String("i-1"),
+		PrivateDnsName: aws.String("ip-10-0-0-1.ec2.internal"),
+		Placement:      &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+	}}}
+	provider := &awsCloudProvider{awsManager: newTestManager(t, autoScaling, ec2Service)}
+	hit := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Status:     apiv1.NodeStatus{Addresses: []apiv1.NodeAddress{{Type: apiv1.NodeInternalDNS, Address: "ip-10-0-0-1.ec2.internal"}}},
+	}
+	miss := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "ip-10-0-0-9.ec2.internal"}}
+	nodes := []*apiv1.Node{hit, miss, testNode("i-2")}
+
+	for i := 0; i < 2; i++ {
+		nodeGroups, err := provider.NodeGroupForNodes(nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(nodeGroups) != 2 || nodeGroups["node-1"] == nil || nodeGroups["node-i-2"] == nil {
+			t.Errorf("expected node groups for node-1 and node-i-2 only, got %v", nodeGroups)
+		}
+	}
+	// The hit and the miss are both memoized
+	if calls := ec2Service.calls["DescribeInstances"]; calls != 2 {
+		t.Errorf("expected 2 private DNS name lookups, got %d", calls)
+	}
+	if belongs, err := testNodeGroup(t, provider.awsManager, "asg-1").Belongs(hit); err != nil || !belongs {
+		t.Errorf("expected node-1 to belong to asg-1, got %v, %v", belongs, err)
+	}
+	if _, err := provider.HasInstance(miss); err == nil {
+		t.Error("expected an error for a node without instance")
+	}
+
+	// Lookup errors leave the node out without failing the others
+	ec2Service.describeInstancesErr = errors.New("throttled")
+	other := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: "ip-10-0-0-2.ec2.internal"}}
+	nodeGroups, err := provider.NodeGroupForNodes([]*apiv1.Node{other, testNode("i-2")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodeGroups) != 1 || nodeGroups["node-i-2"] == nil {
+		t.Errorf("expected the node group of node-i-2 only, got %v", nodeGroups)
+	}
+	if _, err := testNodeGroup(t, provider.awsManager, "asg-1").Belongs(other); !errorContains(err, "throttled") {
+		t.Errorf("expected the lookup error, got %v", err)
+	}
+}
+
+func BenchmarkNodeGroupForNodes(b *testing.B) {
+	provider, nodes := clusterOfNodes(b)
+
+	b.Run("NodeGroupForNode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, node := range nodes {
+				if _, err := provider.NodeGroupForNode(node); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+			}
+		}
+	})
+	b.Run("NodeGroupForNodes", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := provider.NodeGroupForNodes(nodes); err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+		}
+	})
+}
+
+func TestGetAvailableMachineTypes(t *testing.T) {
+	manager, err := newAwsManager(&awsWrapper{}, map[string]*InstanceType{
+		"m5.large":   {InstanceType: "m5.large"},
+		"c5.large":   {InstanceType: "c5.large"},
+		"r6i.large":  {InstanceType: "r6i.large"},
+		"p3.2xlarge": {InstanceType: "p3.2xlarge"},
+	}, InstanceTypeSourceStatic, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	provider := &awsCloudProvider{awsManager: manager}
+
+	machineTypes, _ := provider.GetAvailableMachineTypes()
+	if expected := []string{"c5.large", "m5.large", "p3.2xlarge", "r6i.large"}; !reflect.DeepEqual(machineTypes, expected) {
+		t.Errorf("expected machine types %v, got %v", expected, machineTypes)
+	}
+
+	manager.SetMachineTypePrefixes([]string{"m", "c", "r"})
+	machineTypes, _ = provider.GetAvailableMachineTypes()
+	if expected := []string{"c5.large", "m5.large", "r6i.large"}; !reflect.DeepEqual(machineTypes, expected) {
+		t.Errorf("expected machine types %v, got %v", expected, machineTypes)
+	}
+}
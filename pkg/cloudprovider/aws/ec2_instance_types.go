@@ -9,6 +9,10 @@ type InstanceType struct {
 	MemoryMb     int64
 	GPU          int64
 	Architecture string
+	// ProcessorFeatures and SustainedClockSpeedGhz are only known for
+	// instance types fetched from DescribeInstanceTypes.
+	ProcessorFeatures      []string
+	SustainedClockSpeedGhz float64
 }
 
 // StaticListLastUpdateTime is a string declaring the last time the static list was updated.
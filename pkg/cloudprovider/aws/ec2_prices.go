@@ -0,0 +1,63 @@
+package aws
+
+// StaticPriceListLastUpdateTime is a string declaring the last time the static price list was updated.
+var StaticPriceListLastUpdateTime = "2024-04-08"
+
+// usOnDemandPrices are the hourly Linux on-demand prices in USD of common instance types
+// with shared tenancy, which are the same in us-east-1 and us-west-2.
+var usOnDemandPrices = map[string]float64{
+	"c5.large":     0.085,
+	"c5.xlarge":    0.17,
+	"c5.2xlarge":   0.34,
+	"c5.4xlarge":   0.68,
+	"c5.9xlarge":   1.53,
+	"c6g.large":    0.068,
+	"c6g.xlarge":   0.136,
+	"c6g.2xlarge":  0.272,
+	"c6g.4xlarge":  0.544,
+	"c6i.large":    0.085,
+	"c6i.xlarge":   0.17,
+	"c6i.2xlarge":  0.34,
+	"c6i.4xlarge":  0.68,
+	"g4dn.xlarge":  0.526,
+	"g4dn.2xlarge": 0.752,
+	"g4dn.4xlarge": 1.204,
+	"g5.xlarge":    1.006,
+	"m5.large":     0.096,
+	"m5.xlarge":    0.192,
+	"m5.2xlarge":   0.384,
+	"m5.4xlarge":   0.768,
+	"m5.8xlarge":   1.536,
+	"m5.12xlarge":  2.304,
+	"m5.16xlarge":  3.072,
+	"m5.24xlarge":  4.608,
+	"m6g.large":    0.077,
+	"m6g.xlarge":   0.154,
+	"m6g.2xlarge":  0.308,
+	"m6g.4xlarge":  0.616,
+	"m6i.large":    0.096,
+	"m6i.xlarge":   0.192,
+	"m6i.2xlarge":  0.384,
+	"m6i.4xlarge":  0.768,
+	"p3.2xlarge":   3.06,
+	"r5.large":     0.126,
+	"r5.xlarge":    0.252,
+	"r5.2xlarge":   0.504,
+	"r5.4xlarge":   1.008,
+	"r6i.large":    0.126,
+	"r6i.xlarge":   0.252,
+	"r6i.2xlarge":  0.504,
+	"r6i.4xlarge":  1.008,
+	"t3.micro":     0.0104,
+	"t3.small":     0.0208,
+	"t3.medium":    0.0416,
+	"t3.large":     0.0832,
+	"t3.xlarge":    0.1664,
+	"t3.2xlarge":   0.3328,
+}
+
+// staticOnDemandPrices are the prices of StaticPriceLoader by region.
+var staticOnDemandPrices = map[string]map[string]float64{
+	"us-east-1": usOnDemandPrices,
+	"us-west-2": usOnDemandPrices,
+}
@@ -0,0 +1,519 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/eks"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeAutoScaling is an in-memory auto-scaling service. Calls of methods it doesn't
+// implement panic on the nil embedded interface.
+type fakeAutoScaling struct {
+	autoScalingI
+
+	mutex  sync.Mutex
+	groups []*autoscaling.Group
+	// pageSize is the number of ASGs per page of DescribeAutoScalingGroups, 0 for a single page
+	pageSize int
+	// ignoreFilters returns all the ASGs whatever the filters, like endpoints that don't implement them
+	ignoreFilters bool
+	// describeErr fails the DescribeAutoScalingGroups calls including the named ASG
+	describeErr map[string]error
+	activities  map[string][]*autoscaling.Activity
+	// setDesiredCapacityErr fails all the SetDesiredCapacity calls
+	setDesiredCapacityErr error
+	hooks                 map[string][]*autoscaling.LifecycleHook
+	// completeLifecycleAction overrides CompleteLifecycleAction when set
+	completeLifecycleAction func(*autoscaling.CompleteLifecycleActionInput) error
+
+	// calls counts the calls by method name, describeInputs records DescribeAutoScalingGroups inputs
+	calls          map[string]int
+	describeInputs []*autoscaling.DescribeAutoScalingGroupsInput
+	terminated     []string
+	detached       []string
+	completed      []string
+}
+
+func (f *fakeAutoScaling) called(method string) {
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[method]++
+}
+
+func (f *fakeAutoScaling) callCount(method string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls[method]
+}
+
+func (f *fakeAutoScaling) group(name string) *autoscaling.Group {
+	for _, group := range f.groups {
+		if aws.StringValue(group.AutoScalingGroupName) == name {
+			return group
+		}
+	}
+	return nil
+}
+
+// matchesFilters implements the tag-key and tag:<key> filters of DescribeAutoScalingGroups.
+func matchesFilters(group *autoscaling.Group, filters []*autoscaling.Filter) bool {
+	for _, filter := range filters {
+		name := aws.StringValue(filter.Name)
+		found := false
+		for _, tag := range group.Tags {
+			for _, value := range aws.StringValueSlice(filter.Values) {
+				if name == "tag-key" && aws.StringValue(tag.Key) == value ||
+					name == "tag:"+aws.StringValue(tag.Key) && aws.StringValue(tag.Value) == value {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingGroupsPagesWithContext(_ aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool, _ ...request.Option) error {
+	f.mutex.Lock()
+	f.called("DescribeAutoScalingGroups")
+	f.describeInputs = append(f.describeInputs, input)
+	matched := []*autoscaling.Group{}
+	names := aws.StringValueSlice(input.AutoScalingGroupNames)
+	for _, name := range names {
+		if err := f.describeErr[name]; err != nil {
+			f.mutex.Unlock()
+			return err
+		}
+	}
+	for _, group := range f.groups {
+		if len(names) > 0 && !containsString(names, aws.StringValue(group.AutoScalingGroupName)) {
+			continue
+		}
+		if f.ignoreFilters || matchesFilters(group, input.Filters) {
+			// Like AWS, return copies the caller is free to modify
+			matched = append(matched, awsutil.CopyOf(group).(*autoscaling.Group))
+		}
+	}
+	f.mutex.Unlock()
+
+	pageSize := f.pageSize
+	if pageSize == 0 {
+		pageSize = len(matched) + 1
+	}
+	for i := 0; i == 0 || i < len(matched); i += pageSize {
+		end := i + pageSize
+		if end > len(matched) {
+			end = len(matched)
+		}
+		if !fn(&autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: matched[i:end]}, end == len(matched)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeAutoScaling) ResumeProcessesWithContext(_ aws.Context, input *autoscaling.ScalingProcessQuery, _ ...request.Option) (*autoscaling.ResumeProcessesOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("ResumeProcesses")
+	group := f.group(aws.StringValue(input.AutoScalingGroupName))
+	if group == nil {
+		return nil, awserr.New("ValidationError", "AutoScalingGroup name not found", nil)
+	}
+	resumed := aws.StringValueSlice(input.ScalingProcesses)
+	suspended := group.SuspendedProcesses[:0:0]
+	for _, process := range group.SuspendedProcesses {
+		if !containsString(resumed, aws.StringValue(process.ProcessName)) {
+			suspended = append(suspended, process)
+		}
+	}
+	group.SuspendedProcesses = suspended
+	return &autoscaling.ResumeProcessesOutput{}, nil
+}
+
+func (f *fakeAutoScaling) SuspendProcessesWithContext(_ aws.Context, input *autoscaling.ScalingProcessQuery, _ ...request.Option) (*autoscaling.SuspendProcessesOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("SuspendProcesses")
+	group := f.group(aws.StringValue(input.AutoScalingGroupName))
+	if group == nil {
+		return nil, awserr.New("ValidationError", "AutoScalingGroup name not found", nil)
+	}
+	for _, process := range input.ScalingProcesses {
+		group.SuspendedProcesses = append(group.SuspendedProcesses, &autoscaling.SuspendedProcess{ProcessName: process})
+	}
+	return &autoscaling.SuspendProcessesOutput{}, nil
+}
+
+func (f *fakeAutoScaling) DescribeScalingActivitiesWithContext(_ aws.Context, input *autoscaling.DescribeScalingActivitiesInput, _ ...request.Option) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("DescribeScalingActivities")
+	return &autoscaling.DescribeScalingActivitiesOutput{Activities: f.activities[aws.StringValue(input.AutoScalingGroupName)]}, nil
+}
+
+func (f *fakeAutoScaling) SetDesiredCapacityWithContext(_ aws.Context, input *autoscaling.SetDesiredCapacityInput, _ ...request.Option) (*autoscaling.SetDesiredCapacityOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("SetDesiredCapacity")
+	if f.setDesiredCapacityErr != nil {
+		return nil, f.setDesiredCapacityErr
+	}
+	group := f.group(aws.StringValue(input.AutoScalingGroupName))
+	if group == nil {
+		return nil, awserr.New("ValidationError", "AutoScalingGroup name not found", nil)
+	}
+	group.DesiredCapacity = input.DesiredCapacity
+	return &autoscaling.SetDesiredCapacityOutput{}, nil
+}
+
+// removeInstance removes the instance from its ASG, decrementing the desired capacity.
+func (f *fakeAutoScaling) removeInstance(instanceId string) error {
+	for _, group := range f.groups {
+		for i, instance := range group.Instances {
+			if aws.StringValue(instance.InstanceId) == instanceId {
+				group.Instances = append(group.Instances[:i:i], group.Instances[i+1:]...)
+				group.DesiredCapacity = aws.Int64(aws.Int64Value(group.DesiredCapacity) - 1)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("ValidationError: instance %s is not part of an ASG", instanceId)
+}
+
+func (f *fakeAutoScaling) TerminateInstanceInAutoScalingGroupWithContext(_ aws.Context, input *autoscaling.TerminateInstanceInAutoScalingGroupInput, _ ...request.Option) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("TerminateInstanceInAutoScalingGroup")
+	instanceId := aws.StringValue(input.InstanceId)
+	if err := f.removeInstance(instanceId); err != nil {
+		return nil, err
+	}
+	f.terminated = append(f.terminated, instanceId)
+	return &autoscaling.TerminateInstanceInAutoScalingGroupOutput{
+		Activity: &autoscaling.Activity{Description: aws.String("Terminating EC2 instance: " + instanceId)},
+	}, nil
+}
+
+func (f *fakeAutoScaling) DetachInstancesWithContext(_ aws.Context, input *autoscaling.DetachInstancesInput, _ ...request.Option) (*autoscaling.DetachInstancesOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("DetachInstances")
+	for _, instanceId := range aws.StringValueSlice(input.InstanceIds) {
+		if err := f.removeInstance(instanceId); err != nil {
+			return nil, err
+		}
+		f.detached = append(f.detached, instanceId)
+	}
+	return &autoscaling.DetachInstancesOutput{}, nil
+}
+
+func (f *fakeAutoScaling) DescribeLifecycleHooksWithContext(_ aws.Context, input *autoscaling.DescribeLifecycleHooksInput, _ ...request.Option) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("DescribeLifecycleHooks")
+	return &autoscaling.DescribeLifecycleHooksOutput{LifecycleHooks: f.hooks[aws.StringValue(input.AutoScalingGroupName)]}, nil
+}
+
+func (f *fakeAutoScaling) CompleteLifecycleActionWithContext(_ aws.Context, input *autoscaling.CompleteLifecycleActionInput, _ ...request.Option) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	f.mutex.Lock()
+	f.called("CompleteLifecycleAction")
+	complete := f.completeLifecycleAction
+	f.mutex.Unlock()
+	if complete != nil {
+		if err := complete(input); err != nil {
+			return nil, err
+		}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.completed = append(f.completed, aws.StringValue(input.InstanceId)+"/"+aws.StringValue(input.LifecycleHookName))
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingInstancesPagesWithContext(_ aws.Context, input *autoscaling.DescribeAutoScalingInstancesInput, fn func(*autoscaling.DescribeAutoScalingInstancesOutput, bool) bool, _ ...request.Option) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("DescribeAutoScalingInstances")
+	if len(input.InstanceIds) > 50 {
+		return awserr.New("ValidationError", "The number of instance ids that may be passed in is limited to 50", nil)
+	}
+	output := &autoscaling.DescribeAutoScalingInstancesOutput{}
+	for _, group := range f.groups {
+		for _, instance := range group.Instances {
+			if containsString(aws.StringValueSlice(input.InstanceIds), aws.StringValue(instance.InstanceId)) {
+				output.AutoScalingInstances = append(output.AutoScalingInstances, &autoscaling.InstanceDetails{
+					AutoScalingGroupName: group.AutoScalingGroupName,
+					InstanceId:           instance.InstanceId,
+					HealthStatus:         instance.HealthStatus,
+					LifecycleState:       instance.LifecycleState,
+					ProtectedFromScaleIn: instance.ProtectedFromScaleIn,
+				})
+			}
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+// fakeEC2 is an in-memory EC2 service. Calls of methods it doesn't implement panic on
+// the nil embedded interface.
+type fakeEC2 struct {
+	ec2I
+
+	mutex         sync.Mutex
+	instances     []*ec2.Instance
+	instanceTypes []*ec2.InstanceTypeInfo
+	// offerings are the names of the instance types offered in each region
+	offerings map[string][]string
+	// describeInstancesErr makes DescribeInstances fail when set
+	describeInstancesErr error
+	// launchTemplateVersions overrides DescribeLaunchTemplateVersions when set
+	launchTemplateVersions func(*ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error)
+
+	calls map[string]int
+}
+
+func (f *fakeEC2) called(method string) {
+	if f.calls == nil {
+		f.calls = make(map[string]int)
+	}
+	f.calls[method]++
+}
+
+func (f *fakeEC2) DescribeInstancesPagesWithContext(_ aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, _ ...request.Option) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("DescribeInstances")
+	if f.describeInstancesErr != nil {
+		return f.describeInstancesErr
+	}
+	ids := aws.StringValueSlice(input.InstanceIds)
+	var dnsNames []string
+	for _, filter := range input.Filters {
+		switch aws.StringValue(filter.Name) {
+		case "instance-id":
+			ids = append(ids, aws.StringValueSlice(filter.Values)...)
+		case "private-dns-name":
+			dnsNames = append(dnsNames, aws.StringValueSlice(filter.Values)...)
+		}
+	}
+	instances := []*ec2.Instance{}
+	for _, instance := range f.instances {
+		if len(ids) != 0 && !containsString(ids, aws.StringValue(instance.InstanceId)) {
+			continue
+		}
+		if len(dnsNames) != 0 && !containsString(dnsNames, aws.StringValue(instance.PrivateDnsName)) {
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: instances}}}, true)
+	return nil
+}
+
+func (f *fakeEC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	output := &ec2.DescribeInstancesOutput{}
+	err := f.DescribeInstancesPagesWithContext(nil, input, func(page *ec2.DescribeInstancesOutput, _ bool) bool {
+		output.Reservations = append(output.Reservations, page.Reservations...)
+		return true
+	})
+	return output, err
+}
+
+func (f *fakeEC2) DescribeInstanceTypesPages(_ *ec2.DescribeInstanceTypesInput, fn func(*ec2.DescribeInstanceTypesOutput, bool) bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("DescribeInstanceTypes")
+	fn(&ec2.DescribeInstanceTypesOutput{InstanceTypes: f.instanceTypes}, true)
+	return nil
+}
+
+func (f *fakeEC2) DescribeInstanceTypeOfferingsPages(input *ec2.DescribeInstanceTypeOfferingsInput, fn func(*ec2.DescribeInstanceTypeOfferingsOutput, bool) bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.called("DescribeInstanceTypeOfferings")
+	output := &ec2.DescribeInstanceTypeOfferingsOutput{}
+	for _, filter := range input.Filters {
+		if aws.StringValue(filter.Name) != "location" {
+			continue
+		}
+		for _, region := range aws.StringValueSlice(filter.Values) {
+			for _, name := range f.offerings[region] {
+				output.InstanceTypeOfferings = append(output.InstanceTypeOfferings, &ec2.InstanceTypeOffering{
+					InstanceType: aws.String(name),
+					Location:     aws.String(region),
+					LocationType: input.LocationType,
+				})
+			}
+		}
+	}
+	fn(output, true)
+	return nil
+}
+
+func (f *fakeEC2) DescribeLaunchTemplateVersionsWithContext(_ aws.Context, input *ec2.DescribeLaunchTemplateVersionsInput, _ ...request.Option) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	f.mutex.Lock()
+	f.called("DescribeLaunchTemplateVersions")
+	describe := f.launchTemplateVersions
+	f.mutex.Unlock()
+	if describe == nil {
+		return &ec2.DescribeLaunchTemplateVersionsOutput{}, nil
+	}
+	return describe(input)
+}
+
+// fakeEKS is an in-memory EKS service.
+type fakeEKS struct {
+	eksI
+
+	mutex      sync.Mutex
+	nodegroups map[string]*eks.Nodegroup
+	calls      int
+}
+
+func (f *fakeEKS) DescribeNodegroupWithContext(_ aws.Context, input *eks.DescribeNodegroupInput, _ ...request.Option) (*eks.DescribeNodegroupOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls++
+	nodegroup, found := f.nodegroups[aws.StringValue(input.NodegroupName)]
+	if !found {
+		return nil, fmt.Errorf("ResourceNotFoundException: no node group %s", aws.StringValue(input.NodegroupName))
+	}
+	return &eks.DescribeNodegroupOutput{Nodegroup: nodegroup}, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+const testAutoDiscoverySpec = "asg:tag=k8s.io/cluster-autoscaler/enabled"
+
+// testGroup returns an auto-discovered ASG in us-east-1a with the given instances, all
+// healthy and in service.
+func testGroup(name string, min, desired, max int, instanceIds ...string) *autoscaling.Group {
+	group := &autoscaling.Group{
+		AutoScalingGroupName: aws.String(name),
+		MinSize:              aws.Int64(int64(min)),
+		DesiredCapacity:      aws.Int64(int64(desired)),
+		MaxSize:              aws.Int64(int64(max)),
+		AvailabilityZones:    aws.StringSlice([]string{"us-east-1a"}),
+		Tags: []*autoscaling.TagDescription{{
+			Key:   aws.String("k8s.io/cluster-autoscaler/enabled"),
+			Value: aws.String("true"),
+		}},
+	}
+	for _, id := range instanceIds {
+		group.Instances = append(group.Instances, testInstance(id))
+	}
+	return group
+}
+
+func testInstance(id string) *autoscaling.Instance {
+	return &autoscaling.Instance{
+		InstanceId:       aws.String(id),
+		AvailabilityZone: aws.String("us-east-1a"),
+		HealthStatus:     aws.String("Healthy"),
+		LifecycleState:   aws.String(autoscaling.LifecycleStateInService),
+	}
+}
+
+func testNode(instanceId string) *apiv1.Node {
+	return &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-" + instanceId},
+		Spec:       apiv1.NodeSpec{ProviderID: "aws:///us-east-1a/" + instanceId},
+	}
+}
+
+// newTestManager returns a refreshed manager auto-discovering the ASGs of the fakes.
+func newTestManager(t testing.TB, autoScaling *fakeAutoScaling, ec2Service *fakeEC2) *AwsManager {
+	t.Helper()
+	if ec2Service == nil {
+		ec2Service = &fakeEC2{}
+	}
+	manager, err := createAWSManagerInternal(&awsWrapper{autoScalingI: autoScaling, ec2I: ec2Service},
+		InstanceTypes, InstanceTypeSourceStatic, []string{testAutoDiscoverySpec})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	return manager
+}
+
+// testNodeGroup returns the node group of the named ASG.
+func testNodeGroup(t *testing.T, manager *AwsManager, name string) *AwsNodeGroup {
+	t.Helper()
+	provider := &awsCloudProvider{awsManager: manager}
+	for _, nodeGroup := range provider.NodeGroups() {
+		if nodeGroup.Id() == name {
+			return nodeGroup
+		}
+	}
+	t.Fatalf("no node group %s in %v", name, manager.asgCache.names())
+	return nil
+}
+
+// errorContains returns whether err is non-nil and contains all the substrings.
+func errorContains(err error, substrings ...string) bool {
+	if err == nil {
+		return false
+	}
+	for _, s := range substrings {
+		if !strings.Contains(err.Error(), s) {
+			return false
+		}
+	}
+	return true
+}
+
+// stubInstanceTypes makes every ASG use the instance type of its entry in byAsg.
+func stubInstanceTypes(t *testing.T, byAsg map[string]string) {
+	original := getInstanceTypeForAsg
+	getInstanceTypeForAsg = func(_ *asgCache, group *asg) (string, error) {
+		if instanceType, found := byAsg[group.Name]; found {
+			return instanceType, nil
+		}
+		return "", fmt.Errorf("could not find instance type for %s", group.Name)
+	}
+	t.Cleanup(func() { getInstanceTypeForAsg = original })
+}
+
+// withTag adds the tag to the ASG.
+func withTag(group *autoscaling.Group, key, value string) *autoscaling.Group {
+	group.Tags = append(group.Tags, &autoscaling.TagDescription{Key: aws.String(key), Value: aws.String(value)})
+	return group
+}
+
+// withMixedInstancesPolicy gives the ASG a mixed instances policy with the given
+// instance type overrides and distribution.
+func withMixedInstancesPolicy(group *autoscaling.Group, distribution *autoscaling.InstancesDistribution, overrides ...*autoscaling.LaunchTemplateOverrides) *autoscaling.Group {
+	group.MixedInstancesPolicy = &autoscaling.MixedInstancesPolicy{
+		LaunchTemplate: &autoscaling.LaunchTemplate{
+			LaunchTemplateSpecification: &autoscaling.LaunchTemplateSpecification{
+				LaunchTemplateName: aws.String("lt-" + aws.StringValue(group.AutoScalingGroupName)),
+				Version:            aws.String("1"),
+			},
+			Overrides: overrides,
+		},
+		InstancesDistribution: distribution,
+	}
+	return group
+}
@@ -0,0 +1,77 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+// LabelSanitizationPolicy decides what happens to template labels derived from ASG tags
+// whose key is not a valid Kubernetes label key.
+type LabelSanitizationPolicy string
+
+const (
+	// LabelSanitizationReplace replaces the invalid characters of the key.
+	LabelSanitizationReplace LabelSanitizationPolicy = "replace"
+	// LabelSanitizationDrop drops the label.
+	LabelSanitizationDrop LabelSanitizationPolicy = "drop"
+	// LabelSanitizationError fails building the template.
+	LabelSanitizationError LabelSanitizationPolicy = "error"
+)
+
+var (
+	invalidLabelNameChars   = regexp.MustCompile("[^-A-Za-z0-9_.]")
+	invalidLabelPrefixChars = regexp.MustCompile("[^-a-z0-9.]")
+)
+
+// sanitizeLabels applies the policy to the labels whose key is invalid.
+func sanitizeLabels(asgName string, labels map[string]string, policy LabelSanitizationPolicy) (map[string]string, error) {
+	result := make(map[string]string, len(labels))
+	for key, value := range labels {
+		errs := validation.IsQualifiedName(key)
+		if len(errs) == 0 {
+			result[key] = value
+			continue
+		}
+
+		switch policy {
+		case LabelSanitizationError:
+			return nil, fmt.Errorf("invalid label key %q derived from tags of ASG %s: %s", key, asgName, strings.Join(errs, "; "))
+		case LabelSanitizationReplace:
+			sanitized := sanitizeLabelKey(key)
+			if len(validation.IsQualifiedName(sanitized)) == 0 {
+				klog.V(4).Infof("Replaced invalid label key %q derived from tags of ASG %s with %q", key, asgName, sanitized)
+				result[sanitized] = value
+				continue
+			}
+			klog.Warningf("Dropping label key %q derived from tags of ASG %s, it can't be sanitized", key, asgName)
+		default:
+			klog.Warningf("Dropping invalid label key %q derived from tags of ASG %s: %s", key, asgName, strings.Join(errs, "; "))
+		}
+	}
+	return result, nil
+}
+
+// sanitizeLabelKey replaces the characters not allowed in a label key, and trims the
+// name to the allowed length.
+func sanitizeLabelKey(key string) string {
+	prefix, name := "", key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		prefix, name = key[:i], key[i+1:]
+	}
+
+	name = invalidLabelNameChars.ReplaceAllString(name, "_")
+	if len(name) > validation.LabelValueMaxLength {
+		name = name[:validation.LabelValueMaxLength]
+	}
+	name = strings.Trim(name, "-_.")
+	if prefix == "" {
+		return name
+	}
+
+	prefix = strings.Trim(invalidLabelPrefixChars.ReplaceAllString(strings.ToLower(prefix), "-"), "-.")
+	return prefix + "/" + name
+}
@@ -0,0 +1,40 @@
+package aws
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSanitizeLabels(t *testing.T) {
+	labels := map[string]string{
+		"team":                    "data",
+		"Example.com/cost center": "42",
+	}
+
+	testCases := []struct {
+		policy   LabelSanitizationPolicy
+		expected map[string]string
+		err      bool
+	}{
+		{policy: LabelSanitizationReplace, expected: map[string]string{"team": "data", "example.com/cost_center": "42"}},
+		{policy: LabelSanitizationDrop, expected: map[string]string{"team": "data"}},
+		{policy: LabelSanitizationError, err: true},
+	}
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			result, err := sanitizeLabels("asg-1", labels, tc.policy)
+			if tc.err {
+				if !errorContains(err, "Example.com/cost center", "asg-1") {
+					t.Errorf("expected an invalid label key error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
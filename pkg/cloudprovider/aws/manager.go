@@ -3,61 +3,311 @@
 package aws
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"golang.org/x/time/rate"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 )
 
 const (
-	operationWaitTimeout    = 5 * time.Second
-	operationPollInterval   = 100 * time.Millisecond
-	maxRecordsReturnedByAPI = 100
-	maxAsgNamesPerDescribe  = 100
-	refreshInterval         = 1 * time.Minute
-	autoDiscovererTypeASG   = "asg"
-	asgAutoDiscovererKeyTag = "tag"
-	optionsTagsPrefix       = "k8s.io/cluster-autoscaler/node-template/autoscaling-options/"
-	labelAwsCSITopologyZone = "topology.ebs.csi.aws.com/zone"
+	operationWaitTimeout       = 5 * time.Second
+	operationPollInterval      = 100 * time.Millisecond
+	maxRecordsReturnedByAPI    = 100
+	maxAsgNamesPerDescribe     = 100
+	maxInstanceIdsPerFilter    = 200
+	maxInstanceIdsPerDescribe  = 50
+	maxInstancesPerAttach      = 20
+	defaultRefreshInterval     = 1 * time.Minute
+	defaultLaunchGracePeriod   = 10 * time.Minute
+	privateDnsNameMissTTL      = 10 * time.Minute
+	refreshIntervalEnvVar      = "AWS_ASG_REFRESH_INTERVAL"
+	autoDiscovererTypeASG      = "asg"
+	asgAutoDiscovererKeyTag    = "tag"
+	asgAutoDiscovererKeyName   = "name"
+	optionsTagsPrefix          = "k8s.io/cluster-autoscaler/node-template/autoscaling-options/"
+	labelAwsCSITopologyZone    = "topology.ebs.csi.aws.com/zone"
+	labelArchBeta              = "beta.kubernetes.io/arch"
+	labelOSBeta                = "beta.kubernetes.io/os"
+	defaultOS                  = "linux"
+	ephemeralStorageTag        = "k8s.io/cluster-autoscaler/node-template/resources/ephemeral-storage"
+	defaultMaxPodsPerNode      = 110
+	nodeTemplateLabelTagPrefix = "k8s.io/cluster-autoscaler/node-template/label/"
+	nodeTemplateTaintTagPrefix = "k8s.io/cluster-autoscaler/node-template/taint/"
+	// nodeTemplateResourcesTagPrefix tags set the capacity of extended resources, e.g.
+	// hugepages-2Mi or vpc.amazonaws.com/PrivateIPv4Address
+	nodeTemplateResourcesTagPrefix = "k8s.io/cluster-autoscaler/node-template/resources/"
 )
 
+// Autoscaling options that can be set per ASG with optionsTagsPrefix tags.
+const (
+	scaleDownUtilizationThresholdKey    = "scaledownutilizationthreshold"
+	scaleDownGpuUtilizationThresholdKey = "scaledowngpuutilizationthreshold"
+	scaleDownUnneededTimeKey            = "scaledownunneededtime"
+	scaleDownUnreadyTimeKey             = "scaledownunreadytime"
+	maxNodeProvisionTimeKey             = "maxnodeprovisiontime"
+	// maxScaleUpStepKey overrides the maximum scale-up step of the manager for the ASG
+	maxScaleUpStepKey = "maxscaleupstep"
+)
+
+// NodeGroupAutoscalingOptions contains the autoscaling settings that can be overridden per node group.
+type NodeGroupAutoscalingOptions struct {
+	// ScaleDownUtilizationThreshold is the utilization under which a node is considered for scale down.
+	ScaleDownUtilizationThreshold float64
+	// ScaleDownGpuUtilizationThreshold is the same threshold for GPU nodes.
+	ScaleDownGpuUtilizationThreshold float64
+	// ScaleDownUnneededTime is how long a node should be unneeded before it is scaled down.
+	ScaleDownUnneededTime time.Duration
+	// ScaleDownUnreadyTime is how long an unready node should be unneeded before it is scaled down.
+	ScaleDownUnreadyTime time.Duration
+	// MaxNodeProvisionTime is how long a node may take to register before the scale-up is considered failed.
+	MaxNodeProvisionTime time.Duration
+}
+
 // AwsManager is handles aws communication and data caching.
 type AwsManager struct {
 	awsService    awsWrapper
 	asgCache      *asgCache
 	lastRefresh   time.Time
 	instanceTypes map[string]*InstanceType
+	// instanceTypeSource is where instanceTypes were loaded from
+	instanceTypeSource InstanceTypeSource
+	// instanceTypesByRegion are the instanceTypes offered in each region when filtering
+	// them by region is enabled, regions without an entry use all of instanceTypes
+	instanceTypesByRegion map[string]map[string]*InstanceType
+	// approximateInstanceTypes derives the capacity of instance types missing from
+	// instanceTypes from a known type of the same family and size
+	approximateInstanceTypes bool
+
+	// lastRefreshMutex guards lastRefresh, which is read by readiness probes
+	lastRefreshMutex sync.Mutex
+
+	// refreshInterval is the minimum time between two refreshes of the ASG cache
+	refreshInterval time.Duration
+	// cacheInvalidated makes the next Refresh regenerate the cache regardless of refreshInterval.
+	// It is set by scaling calls concurrently with refreshes.
+	cacheInvalidated atomic.Bool
+
+	// partialDeleteOnMinSize makes DeleteNodes delete as many nodes as possible
+	// down to the ASG min size instead of rejecting the whole batch.
+	partialDeleteOnMinSize bool
+	// forceDeleteLaunching makes DeleteNodes delete instances that are still launching
+	forceDeleteLaunching bool
+	// machineTypePrefixes restricts the available machine types to the instance types
+	// starting with any of them, none means all the known instance types
+	machineTypePrefixes []string
+	// privateDnsNames memoizes the instances resolved from the private DNS names of
+	// nodes without a provider ID, and privateDnsNameMisses when the names matching no
+	// instance were looked up, so they are looked up again only after privateDnsNameMissTTL
+	privateDnsNames      map[string]AwsInstanceRef
+	privateDnsNameMisses map[string]time.Time
+	privateDnsNamesMutex sync.Mutex
+	// protectTaintKeys are the keys of the taints that exclude nodes from DeleteNodes
+	protectTaintKeys map[string]bool
+	// scaleUpDisabled blocks IncreaseSize for all node groups, e.g. during maintenance windows.
+	scaleUpDisabled atomic.Bool
+
+	// notPresentGrace is how long an instance missing from the cache is still reported
+	// as present, counted from its launch.
+	notPresentGrace time.Duration
+	// launchTimes memoizes the launch time of the instances missing from the cache, zero
+	// for instances that don't exist or are terminated. It is pruned on every refresh.
+	launchTimes     map[AwsInstanceRef]time.Time
+	notPresentMutex sync.Mutex
+	// untrackedInstancePolicy decides how instances in no tracked ASG are reported
+	untrackedInstancePolicy UntrackedInstancePolicy
+	// labelSanitizationPolicy decides what happens to invalid label keys derived from tags
+	labelSanitizationPolicy LabelSanitizationPolicy
+	// csiZoneFromFirstAZ sets the EBS CSI topology label of multi-AZ ASG templates to
+	// their first zone instead of omitting it
+	csiZoneFromFirstAZ bool
+	// onNodeGroupsChanged is called after a refresh that changed the set of ASGs, may be nil
+	onNodeGroupsChanged func(added, removed []string)
+	// maxZoneFraction is the fraction of the nodes of an ASG above which a single zone
+	// is considered unbalanced, 0 to disable the check
+	maxZoneFraction float64
+	// maxScaleUpStep is the maximum number of instances added by a single IncreaseSize
+	// call, 0 for no limit
+	maxScaleUpStep int
+	// deletionOrder is the order in which DeleteNodes picks the nodes to delete
+	deletionOrder DeletionOrder
+	// strictZoneCheck leaves instances in a zone their ASG doesn't span out of its node group
+	strictZoneCheck bool
+	// launchGracePeriod is how long after a scale-up the placeholders of an ASG are
+	// considered pending rather than failed
+	launchGracePeriod time.Duration
+	// prices caches the prices of instance types, nil when pricing is disabled
+	prices *priceCache
 }
 
+// DeletionOrder is the order in which DeleteNodes deletes nodes when it can't delete all
+// of them without going below the min size of their ASG.
+type DeletionOrder string
+
+const (
+	// DeletionOrderFIFO deletes the nodes in the order they were given.
+	DeletionOrderFIFO DeletionOrder = "fifo"
+	// DeletionOrderOldestFirst deletes the nodes of the oldest instances first. Nodes of
+	// instances whose launch time isn't known yet come last, in the order they were given.
+	DeletionOrderOldestFirst DeletionOrder = "oldest-first"
+)
+
+// UntrackedInstancePolicy decides what HasInstance reports for an EC2 instance that
+// exists but belongs to no tracked ASG.
+type UntrackedInstancePolicy string
+
+const (
+	// UntrackedInstanceUnmanaged reports such instances as not present in AWS.
+	UntrackedInstanceUnmanaged UntrackedInstancePolicy = "unmanaged"
+	// UntrackedInstancePresent looks the instance up in EC2 and reports it as present
+	// when it exists, without assigning it to a node group.
+	UntrackedInstancePresent UntrackedInstancePolicy = "present"
+)
+
+// InstanceTypeSource describes where the EC2 instance types known to the manager come from.
+type InstanceTypeSource string
+
+const (
+	// InstanceTypeSourceStatic is the list compiled into the binary, see GetStaticEC2InstanceTypes.
+	InstanceTypeSourceStatic InstanceTypeSource = "static"
+	// InstanceTypeSourceDynamic is a list fetched from the EC2 API, see GenerateEC2InstanceTypes.
+	InstanceTypeSourceDynamic InstanceTypeSource = "dynamic"
+	// InstanceTypeSourceFile is a list loaded from a JSON file.
+	InstanceTypeSourceFile InstanceTypeSource = "file"
+)
+
 type asgTemplate struct {
 	InstanceType *InstanceType
 	Region       string
-	Zone         string
-	Tags         []string
+	// Zone is empty for ASGs spanning multiple availability zones
+	Zone string
+	// CSIZone is the zone of the EBS CSI topology label, empty to omit it
+	CSIZone string
+	Tags    []string
+	// RootVolume is the EBS root volume set by the launch template, nil if unknown
+	RootVolume *EbsVolume
+}
+
+// AwsManagerOptions configures an AwsManager built with NewAwsManager.
+type AwsManagerOptions struct {
+	InstanceTypes      map[string]*InstanceType
+	InstanceTypeSource InstanceTypeSource
+	AutoDiscoverySpecs []string
+	// DeferRefresh skips the initial refresh of the ASG cache, it is then built by
+	// the first call to Refresh.
+	DeferRefresh bool
+	// RegionalSessions are the sessions of additional regions, whose auto-discovered ASGs
+	// are managed along with the ones of the region of the manager.
+	RegionalSessions []*session.Session
+	// FilterInstanceTypesByRegion restricts the instance types of the templates of the
+	// ASGs of each region to the ones offered there.
+	FilterInstanceTypesByRegion bool
+}
+
+// NewAwsManager returns an AwsManager with its own ASG cache, using the AWS services of
+// the given session. Managers built from the same session share its credentials and
+// configuration but nothing else, which allows managing several clusters in one process.
+func NewAwsManager(sess *session.Session, opts AwsManagerOptions) (*AwsManager, error) {
+	manager, err := newAwsManager(newAwsWrapper(sess), opts.InstanceTypes, opts.InstanceTypeSource, opts.AutoDiscoverySpecs)
+	if err != nil {
+		return nil, err
+	}
+	for _, regionalSess := range opts.RegionalSessions {
+		if err := manager.addRegionalService(newAwsWrapper(regionalSess)); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FilterInstanceTypesByRegion {
+		if err := manager.filterInstanceTypesByRegion(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.DeferRefresh {
+		return manager, nil
+	}
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return manager, nil
 }
 
 // createAwsManagerInternal allows for custom objects to be passed in by tests
 func createAWSManagerInternal(
 	awsService *awsWrapper,
 	instanceTypes map[string]*InstanceType,
+	instanceTypeSource InstanceTypeSource,
+	autoDiscoverySpecs []string,
 ) (*AwsManager, error) {
+	manager, err := newAwsManager(awsService, instanceTypes, instanceTypeSource, autoDiscoverySpecs)
+	if err != nil {
+		return nil, err
+	}
 
-	cache, err := newASGCache(awsService, []string{})
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return manager, nil
+}
+
+// newAwsManager builds an AwsManager without refreshing its ASG cache.
+func newAwsManager(
+	awsService *awsWrapper,
+	instanceTypes map[string]*InstanceType,
+	instanceTypeSource InstanceTypeSource,
+	autoDiscoverySpecs []string,
+) (*AwsManager, error) {
+
+	autoDiscoveryConfigs, err := parseASGAutoDiscoverySpecs(autoDiscoverySpecs)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := newASGCache(awsService, []string{}, autoDiscoveryConfigs)
 	if err != nil {
 		return nil, err
 	}
 
 	manager := &AwsManager{
-		awsService:    *awsService,
-		asgCache:      cache,
-		instanceTypes: instanceTypes,
+		awsService:              *awsService,
+		asgCache:                cache,
+		instanceTypes:           instanceTypes,
+		instanceTypeSource:      instanceTypeSource,
+		launchTimes:             make(map[AwsInstanceRef]time.Time),
+		launchGracePeriod:       defaultLaunchGracePeriod,
+		untrackedInstancePolicy: UntrackedInstanceUnmanaged,
+		labelSanitizationPolicy: LabelSanitizationDrop,
+		refreshInterval:         defaultRefreshInterval,
+		privateDnsNames:         make(map[string]AwsInstanceRef),
+		privateDnsNameMisses:    make(map[string]time.Time),
 	}
 
-	if err := manager.forceRefresh(); err != nil {
-		return nil, err
+	if value, found := os.LookupEnv(refreshIntervalEnvVar); found {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", refreshIntervalEnvVar, value, err)
+		}
+		if err := manager.SetRefreshInterval(interval); err != nil {
+			return nil, err
+		}
 	}
 
 	return manager, nil
@@ -66,27 +316,625 @@ func createAWSManagerInternal(
 // Refresh is called before every main loop and can be used to dynamically update cloud provider state.
 // In particular the list of node groups returned by NodeGroups can change as a result of CloudProvider.Refresh().
 func (m *AwsManager) Refresh() error {
-	if m.lastRefresh.Add(refreshInterval).After(time.Now()) {
+	return m.RefreshWithContext(context.Background())
+}
+
+// RefreshWithContext is like Refresh, but the AWS calls it makes are bound to the given context.
+func (m *AwsManager) RefreshWithContext(ctx context.Context) error {
+	if !m.cacheInvalidated.Load() && m.LastRefresh().Add(m.refreshInterval).After(time.Now()) {
 		return nil
 	}
-	return m.forceRefresh()
+	return m.forceRefresh(ctx)
 }
 
-func (m *AwsManager) forceRefresh() error {
-	if err := m.asgCache.regenerate(); err != nil {
-		klog.Errorf("Failed to regenerate ASG cache: %v", err)
+func (m *AwsManager) forceRefresh(ctx context.Context) error {
+	for _, service := range m.services() {
+		if service.retryBudget != nil {
+			service.retryBudget.reset()
+		}
+	}
+	// Invalidations from here on aren't reflected by the regenerated cache, keep them
+	invalidated := m.cacheInvalidated.Swap(false)
+	previous := m.asgCache.names()
+	klog.V(2).InfoS("Refreshing ASG cache", "asgCount", len(previous), "invalidated", invalidated)
+	if err := m.asgCache.regenerate(ctx); err != nil {
+		klog.ErrorS(err, "Failed to regenerate ASG cache")
+		if invalidated {
+			m.cacheInvalidated.Store(true)
+		}
 		return err
 	}
-	m.lastRefresh = time.Now()
-	klog.V(2).Infof("Refreshed ASG list, next refresh after %v", m.lastRefresh.Add(refreshInterval))
+	current := m.asgCache.names()
+	if m.onNodeGroupsChanged != nil {
+		if added, removed := diffNames(previous, current); len(added) > 0 || len(removed) > 0 {
+			klog.V(2).InfoS("Node groups changed", "added", added, "removed", removed)
+			m.onNodeGroupsChanged(added, removed)
+		}
+	}
+	lastRefresh := time.Now()
+	m.lastRefreshMutex.Lock()
+	m.lastRefresh = lastRefresh
+	m.lastRefreshMutex.Unlock()
+	klog.V(2).InfoS("Refreshed ASG cache", "asgCount", len(current), "nextRefresh", lastRefresh.Add(m.refreshInterval))
+	m.pruneLaunchTimes()
 	return nil
 }
 
+// SetOnNodeGroupsChanged registers a callback called after a refresh that added or removed
+// ASGs, with their sorted names. Refreshes that don't change the set of ASGs don't call it.
+func (m *AwsManager) SetOnNodeGroupsChanged(fn func(added, removed []string)) {
+	m.onNodeGroupsChanged = fn
+}
+
+// diffNames returns the sorted names that are only in current, then the ones only in previous.
+func diffNames(previous, current map[string]bool) ([]string, []string) {
+	added := []string{}
+	for name := range current {
+		if !previous[name] {
+			added = append(added, name)
+		}
+	}
+	removed := []string{}
+	for name := range previous {
+		if !current[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// LastRefresh returns when the ASG cache was last successfully refreshed.
+func (m *AwsManager) LastRefresh() time.Time {
+	m.lastRefreshMutex.Lock()
+	defer m.lastRefreshMutex.Unlock()
+	return m.lastRefresh
+}
+
+// Healthy returns false when the ASG cache wasn't successfully refreshed within
+// maxStaleness, which usually means that AWS API calls are failing.
+func (m *AwsManager) Healthy(maxStaleness time.Duration) bool {
+	return time.Since(m.LastRefresh()) <= maxStaleness
+}
+
+// ReadyzHandler returns an HTTP handler for readiness probes, failing with 503 while
+// the manager isn't Healthy.
+func (m *AwsManager) ReadyzHandler(maxStaleness time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if !m.Healthy(maxStaleness) {
+			http.Error(w, fmt.Sprintf("ASG cache last refreshed at %v", m.LastRefresh()), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// withinNotPresentGrace returns whether the given instance, missing from the cache, was
+// launched within the not-present grace period. Launch times are described from EC2 once
+// per instance and refresh; instances that don't exist or are terminated never are.
+func (m *AwsManager) withinNotPresentGrace(ref AwsInstanceRef) bool {
+	if m.notPresentGrace <= 0 || m.asgCache.isPlaceholderInstance(&ref) {
+		return false
+	}
+
+	m.notPresentMutex.Lock()
+	launchTime, found := m.launchTimes[ref]
+	m.notPresentMutex.Unlock()
+	if !found {
+		launchTimes, err := m.serviceForInstance(ref).getInstanceLaunchTimes(context.Background(), []string{ref.Name})
+		if err != nil {
+			klog.Warningf("Failed to describe the launch time of instance %s: %v", ref.Name, err)
+			return false
+		}
+		launchTime = launchTimes[ref.Name]
+		m.notPresentMutex.Lock()
+		m.launchTimes[ref] = launchTime
+		m.notPresentMutex.Unlock()
+	}
+	return !launchTime.IsZero() && time.Since(launchTime) < m.notPresentGrace
+}
+
+// markPresent forgets the launch time of the given instance, found in the cache.
+func (m *AwsManager) markPresent(ref AwsInstanceRef) {
+	m.notPresentMutex.Lock()
+	defer m.notPresentMutex.Unlock()
+	delete(m.launchTimes, ref)
+}
+
+// pruneLaunchTimes forgets the launch times of the instances now in the cache, of the ones
+// out of the grace period and of the missing ones, which are described again if needed.
+func (m *AwsManager) pruneLaunchTimes() {
+	m.notPresentMutex.Lock()
+	defer m.notPresentMutex.Unlock()
+	for ref, launchTime := range m.launchTimes {
+		if launchTime.IsZero() || time.Since(launchTime) >= m.notPresentGrace || m.asgCache.FindForInstance(ref) != nil {
+			delete(m.launchTimes, ref)
+		}
+	}
+}
+
+// SetPartialDeleteOnMinSize configures whether DeleteNodes deletes as many nodes as
+// possible down to the ASG min size instead of rejecting the whole batch. The nodes left
+// in place are named by the NodesNotDeletedError it then returns.
+func (m *AwsManager) SetPartialDeleteOnMinSize(enabled bool) {
+	m.partialDeleteOnMinSize = enabled
+}
+
+// SetForceDeleteLaunchingInstances configures whether DeleteNodes deletes the nodes of
+// instances that are still launching, in the Pending states. By default they are left in
+// place, so nodes aren't terminated in the middle of their bootstrap.
+func (m *AwsManager) SetForceDeleteLaunchingInstances(enabled bool) {
+	m.forceDeleteLaunching = enabled
+}
+
+// SetProtectTaintKeys configures taint keys that protect nodes from scale-down:
+// DeleteNodes skips the nodes carrying any of them.
+func (m *AwsManager) SetProtectTaintKeys(keys []string) {
+	m.protectTaintKeys = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		m.protectTaintKeys[key] = true
+	}
+}
+
+// protectTaint returns the first taint of the node protecting it from scale-down.
+func (m *AwsManager) protectTaint(node *apiv1.Node) (apiv1.Taint, bool) {
+	for _, taint := range node.Spec.Taints {
+		if m.protectTaintKeys[taint.Key] {
+			return taint, true
+		}
+	}
+	return apiv1.Taint{}, false
+}
+
+// SetScaleUpDisabled globally enables or disables scale-up of all node groups.
+func (m *AwsManager) SetScaleUpDisabled(disabled bool) {
+	m.scaleUpDisabled.Store(disabled)
+}
+
+// SetWarmPoolAware configures whether instances kept in ASG warm pools are excluded
+// from the ASG instances. It takes effect on the next refresh.
+func (m *AwsManager) SetWarmPoolAware(enabled bool) {
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.warmPoolAware = enabled
+}
+
+// SetDetachOnDelete configures whether DeleteInstances detaches the instances from their
+// ASG instead of terminating them, so that they can be terminated by custom hooks.
+func (m *AwsManager) SetDetachOnDelete(enabled bool) {
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.detachOnDelete = enabled
+}
+
+// SetRefreshInterval configures the minimum time between two refreshes of the ASG cache.
+func (m *AwsManager) SetRefreshInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("refresh interval must be positive, got %v", interval)
+	}
+	m.refreshInterval = interval
+	return nil
+}
+
+// SetCSIZoneFromFirstAZ configures whether templates of multi-AZ ASGs get the EBS CSI
+// topology zone label set to the first zone of the ASG. By default it is omitted, like
+// the other zone labels, as a new instance can land in any zone of the ASG.
+func (m *AwsManager) SetCSIZoneFromFirstAZ(enabled bool) {
+	m.csiZoneFromFirstAZ = enabled
+}
+
+// SetTerminationTagPrefix enables tagging instances with <prefix>/terminated-at and
+// <prefix>/termination-reason before DeleteInstances deletes them. Tagging is best
+// effort and doesn't block the deletion. An empty prefix disables it.
+func (m *AwsManager) SetTerminationTagPrefix(prefix string) {
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.terminationTagPrefix = strings.TrimSuffix(prefix, "/")
+}
+
+// SetEksNodegroupDiscovery configures whether the min and max sizes of ASGs backing EKS
+// managed node groups are taken from the scaling config of their node group rather than
+// from the ASG. Discovery of the ASGs themselves is unchanged.
+func (m *AwsManager) SetEksNodegroupDiscovery(enabled bool) {
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.eksNodegroupAware = enabled
+}
+
+// SetCompleteTerminationHooks configures whether DeleteInstances completes the termination
+// lifecycle hooks of the instances it terminates, instead of leaving them in
+// Terminating:Wait until the hooks time out. Completion is best effort, and happens in
+// the background once the lifecycle actions have started.
+func (m *AwsManager) SetCompleteTerminationHooks(enabled bool) {
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.completeTerminationHooks = enabled
+}
+
+// SetDryRun configures whether SetAsgSize and DeleteInstances only log the changes they
+// would make and apply them to the cache, without mutating the ASGs in AWS.
+func (m *AwsManager) SetDryRun(enabled bool) {
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.dryRun = enabled
+}
+
+// SetFailOnSuspendedProcesses configures whether SetAsgSize fails instead of warning when
+// the ASG has the Launch or Terminate process suspended, which would stall the change.
+func (m *AwsManager) SetFailOnSuspendedProcesses(enabled bool) {
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.failOnSuspendedProcesses = enabled
+}
+
+// SetResumeSuspendedProcesses configures whether SetAsgSize resumes the Launch or Terminate
+// process of the ASG when it is suspended and would stall the size change, and whether it
+// suspends the process again once the size is set. Resuming processes overrides whoever
+// suspended them, e.g. during maintenance, so it is off by default and logged when it
+// happens. Instances not launched or terminated before the process is suspended again
+// wait until it is resumed.
+func (m *AwsManager) SetResumeSuspendedProcesses(resume, resuspend bool) {
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.resumeSuspendedProcesses = resume
+	m.asgCache.resuspendProcesses = resume && resuspend
+}
+
+// SetInstanceTagLabelKeys configures instance tags that are mirrored as labels on the
+// template node of their ASG. When the instances of an ASG disagree on the value of a
+// tag, it is left out. Template label tags set on the ASG take precedence over them.
+// It takes effect on the next refresh.
+func (m *AwsManager) SetInstanceTagLabelKeys(keys []string) {
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.instanceTagLabelKeys = keys
+}
+
+// SetMaxZoneFraction configures the fraction of the nodes of an ASG that a single
+// availability zone may hold before IncreaseSize warns about it. 0 disables the check.
+func (m *AwsManager) SetMaxZoneFraction(fraction float64) error {
+	if fraction < 0 || fraction > 1 {
+		return fmt.Errorf("maximum zone fraction must be within [0, 1], got %v", fraction)
+	}
+	m.maxZoneFraction = fraction
+	return nil
+}
+
+// SetDeletionOrder configures the order in which DeleteNodes deletes nodes, FIFO by
+// default. Oldest-first requires describing the launch time of the instances of all
+// ASGs, which is done on refresh for the instances new since the previous refresh.
+func (m *AwsManager) SetDeletionOrder(order DeletionOrder) error {
+	switch order {
+	case DeletionOrderFIFO, DeletionOrderOldestFirst:
+	default:
+		return fmt.Errorf("unknown deletion order %q", order)
+	}
+	m.deletionOrder = order
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.trackLaunchTimes = order == DeletionOrderOldestFirst
+	return nil
+}
+
+// SetStrictZoneCheck configures whether Belongs and NodeGroupForNode leave out of the node
+// group of their ASG the instances whose provider ID names a zone the ASG doesn't span,
+// e.g. nodes lingering in a decommissioned zone. Such instances are logged. Off by default.
+func (m *AwsManager) SetStrictZoneCheck(enabled bool) {
+	m.strictZoneCheck = enabled
+}
+
+// outsideAsgZones returns whether the strict zone check is enabled and the zone of the
+// instance isn't one of the zones of its ASG, logging it.
+func (m *AwsManager) outsideAsgZones(asg *asg, ref AwsInstanceRef) bool {
+	if !m.strictZoneCheck {
+		return false
+	}
+	zone := zoneFromProviderId(ref.ProviderID)
+	if zone == "" {
+		return false
+	}
+	zones := m.asgCache.snapshot(asg).AvailabilityZones
+	for _, asgZone := range zones {
+		if asgZone == zone {
+			return false
+		}
+	}
+	klog.Warningf("Instance %s of ASG %s is in zone %s, which is not one of the zones %v of the ASG", ref.Name, asg.Name, zone, zones)
+	return true
+}
+
+// SetLaunchGracePeriod configures how long after increasing the size of an ASG the
+// placeholders of its instances not launched yet are considered pending, even if AWS
+// reports a failed scaling activity, so transient launch failures don't trigger early
+// scale-up retries elsewhere. It defaults to 10 minutes, 0 disables it.
+func (m *AwsManager) SetLaunchGracePeriod(period time.Duration) error {
+	if period < 0 {
+		return fmt.Errorf("launch grace period must not be negative, got %v", period)
+	}
+	m.launchGracePeriod = period
+	return nil
+}
+
+// SetPriceLoader enables the prices of node groups, loaded with the given loader on first
+// use and reloaded once they are older than the refresh interval. A nil loader disables
+// them.
+func (m *AwsManager) SetPriceLoader(loader PriceLoader, refreshInterval time.Duration) error {
+	if loader == nil {
+		m.prices = nil
+		return nil
+	}
+	if refreshInterval <= 0 {
+		return fmt.Errorf("price refresh interval must be positive, got %v", refreshInterval)
+	}
+	m.prices = newPriceCache(loader, refreshInterval, clock.RealClock{})
+	return nil
+}
+
+// GetAsgPrice returns the approximate hourly on-demand price in USD of the instance type
+// of the ASG, or an error wrapping ErrPriceUnavailable when it isn't known.
+func (m *AwsManager) GetAsgPrice(ctx context.Context, asg *asg) (float64, error) {
+	if m.prices == nil {
+		return 0, fmt.Errorf("%w: pricing is not enabled", ErrPriceUnavailable)
+	}
+	instanceType, err := getInstanceTypeForAsg(m.asgCache, asg)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrPriceUnavailable, err)
+	}
+	return m.prices.price(ctx, m.asgRegion(asg), instanceType)
+}
+
+// SetMaxScaleUpStep caps the number of instances a single IncreaseSize call adds, so a
+// spike in demand is absorbed over several autoscaler loops. 0 disables the limit.
+// ASGs can override it with a maxscaleupstep autoscaling option tag.
+func (m *AwsManager) SetMaxScaleUpStep(step int) error {
+	if step < 0 {
+		return fmt.Errorf("maximum scale-up step must not be negative, got %d", step)
+	}
+	m.maxScaleUpStep = step
+	return nil
+}
+
+// maxScaleUpStepFor returns the maximum scale-up step of the ASG: the value of its
+// maxscaleupstep option tag if valid, the one of the manager otherwise.
+func (m *AwsManager) maxScaleUpStepFor(asg *asg) int {
+	value, found := m.getAutoscalingOptions(asg.AwsRef)[maxScaleUpStepKey]
+	if !found {
+		return m.maxScaleUpStep
+	}
+	step, err := strconv.Atoi(value)
+	if err != nil || step < 0 {
+		klog.Warningf("asg %s %s tag value %q is not a non-negative integer", asg.Name, maxScaleUpStepKey, value)
+		return m.maxScaleUpStep
+	}
+	return step
+}
+
+// SetMaxNodeGroups caps the number of ASGs tracked by the manager, protecting against
+// auto discovery matching far more ASGs than intended. 0 disables the limit.
+// It takes effect on the next refresh.
+func (m *AwsManager) SetMaxNodeGroups(max int) error {
+	if max < 0 {
+		return fmt.Errorf("maximum node group count must not be negative, got %d", max)
+	}
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.maxNodeGroups = max
+	return nil
+}
+
+// SetExcludedAsgs sets the ASGs that are never auto-discovered, even if they match the
+// auto discovery tags or name patterns. Each entry is an ASG name or a regular expression
+// matching whole names. Explicitly configured ASGs are not affected.
+// It takes effect on the next refresh.
+func (m *AwsManager) SetExcludedAsgs(exclusions []string) error {
+	patterns := make([]*regexp.Regexp, 0, len(exclusions))
+	for _, exclusion := range exclusions {
+		pattern, err := regexp.Compile("^(?:" + exclusion + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid ASG exclusion %q: %v", exclusion, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	m.asgCache.mutex.Lock()
+	defer m.asgCache.mutex.Unlock()
+	m.asgCache.excludedAsgs = patterns
+	return nil
+}
+
+// SetRefreshRetryBudget caps the total number of AWS retries issued within a single refresh.
+func (m *AwsManager) SetRefreshRetryBudget(max int) error {
+	if max < 0 {
+		return fmt.Errorf("refresh retry budget must not be negative, got %d", max)
+	}
+	for _, service := range m.services() {
+		if service.retryBudget == nil {
+			return fmt.Errorf("AWS service does not support a retry budget")
+		}
+	}
+	for _, service := range m.services() {
+		service.retryBudget.setMax(max)
+	}
+	return nil
+}
+
+// SetApiRateLimit configures the rate of the AWS calls, in calls per second, and the
+// number of calls that can be issued in a burst above it.
+func (m *AwsManager) SetApiRateLimit(qps float64, burst int) error {
+	if qps <= 0 || burst < 1 {
+		return fmt.Errorf("AWS API rate limit must be positive, got %v calls per second with a burst of %d", qps, burst)
+	}
+	for _, service := range m.services() {
+		if service.rateLimiter == nil {
+			return fmt.Errorf("AWS service does not support rate limiting")
+		}
+	}
+	for _, service := range m.services() {
+		service.rateLimiter.SetLimit(rate.Limit(qps))
+		service.rateLimiter.SetBurst(burst)
+	}
+	return nil
+}
+
+// addRegionalService adds the AWS services of an additional region. The ASGs of that
+// region matching the auto discovery specs are managed along with the ones of the region
+// of the manager, and their refs carry the region.
+func (m *AwsManager) addRegionalService(awsService *awsWrapper) error {
+	if awsService.region == "" || awsService.region == m.awsService.region {
+		return fmt.Errorf("additional AWS region must be set and differ from the region %q of the manager, got %q", m.awsService.region, awsService.region)
+	}
+	return m.asgCache.addRegionalService(awsService)
+}
+
+// services returns the AWS services of the region of the manager and of the additional
+// regions.
+func (m *AwsManager) services() []*awsWrapper {
+	return append([]*awsWrapper{&m.awsService}, m.asgCache.regionalServiceList()...)
+}
+
+// serviceForRegion returns the AWS services of the given additional region, falling back
+// to the ones of the region of the manager.
+func (m *AwsManager) serviceForRegion(region string) *awsWrapper {
+	if service := m.asgCache.regionalService(region); service != nil {
+		return service
+	}
+	return &m.awsService
+}
+
+// serviceForInstance returns the AWS services of the region of the instance, derived from
+// the zone of its provider ID.
+func (m *AwsManager) serviceForInstance(ref AwsInstanceRef) *awsWrapper {
+	region, _ := ref.Region()
+	return m.serviceForRegion(region)
+}
+
+// outsideAsgRegion returns whether the region of the instance, derived from the zone of
+// its provider ID, is not the one of the ASG, so the node must not be routed to it.
+func (m *AwsManager) outsideAsgRegion(asg *asg, ref AwsInstanceRef) bool {
+	region, err := ref.Region()
+	if err != nil {
+		return false
+	}
+	asgRegion := asg.Region
+	if asgRegion == "" {
+		asgRegion = m.awsService.region
+	}
+	if asgRegion == "" || region == asgRegion {
+		return false
+	}
+	klog.Warningf("Instance %s is in region %s, not in the region %s of its ASG %s", ref.Name, region, asgRegion, asg.Name)
+	return true
+}
+
+// SetInstanceNotPresentGrace configures how long after its launch HasInstance keeps
+// reporting an instance missing from the cache as present, to tolerate newly launched
+// instances.
+func (m *AwsManager) SetInstanceNotPresentGrace(grace time.Duration) {
+	m.notPresentGrace = grace
+}
+
+// SetUntrackedInstancePolicy configures how HasInstance reports EC2 instances that
+// belong to no tracked ASG.
+func (m *AwsManager) SetUntrackedInstancePolicy(policy UntrackedInstancePolicy) error {
+	switch policy {
+	case UntrackedInstanceUnmanaged, UntrackedInstancePresent:
+		m.untrackedInstancePolicy = policy
+		return nil
+	default:
+		return fmt.Errorf("unknown untracked instance policy %q", policy)
+	}
+}
+
+// SetLabelSanitizationPolicy configures what happens to template labels derived from
+// ASG tags whose key is not a valid Kubernetes label key.
+func (m *AwsManager) SetLabelSanitizationPolicy(policy LabelSanitizationPolicy) error {
+	switch policy {
+	case LabelSanitizationReplace, LabelSanitizationDrop, LabelSanitizationError:
+		m.labelSanitizationPolicy = policy
+		return nil
+	default:
+		return fmt.Errorf("unknown label sanitization policy %q", policy)
+	}
+}
+
+// isUntrackedInstancePresent returns whether an instance missing from the cache should
+// be reported as present according to the untracked instance policy.
+func (m *AwsManager) isUntrackedInstancePresent(ref AwsInstanceRef) (bool, error) {
+	if m.untrackedInstancePolicy != UntrackedInstancePresent {
+		return false, nil
+	}
+	return m.serviceForInstance(ref).instanceExists(ref.Name)
+}
+
+// Partition returns the ID of the AWS partition the manager operates in: aws,
+// aws-us-gov or aws-cn.
+func (m *AwsManager) Partition() string {
+	return partitionForRegion(m.awsService.region)
+}
+
 // GetAsgForInstance returns AsgConfig of the given Instance
 func (m *AwsManager) GetAsgForInstance(instance AwsInstanceRef) *asg {
 	return m.asgCache.FindForInstance(instance)
 }
 
+// GetAsgsForInstances returns the ASGs of the given instances. Instances not part of
+// any ASG are omitted.
+func (m *AwsManager) GetAsgsForInstances(instances []AwsInstanceRef) map[AwsInstanceRef]*asg {
+	return m.asgCache.FindForInstances(instances)
+}
+
+// GetInstanceRefForNode resolves the instance of a node from its provider ID or, for
+// nodes without one, from its private DNS name, taken from its InternalDNS address or its
+// name and looked up in the region of the manager and the additional regions. It returns
+// nil if no instance has that name.
+func (m *AwsManager) GetInstanceRefForNode(ctx context.Context, node *apiv1.Node) (*AwsInstanceRef, error) {
+	if len(node.Spec.ProviderID) != 0 {
+		return AwsRefFromProviderId(node.Spec.ProviderID)
+	}
+
+	dnsName := node.Name
+	for _, address := range node.Status.Addresses {
+		if address.Type == apiv1.NodeInternalDNS && address.Address != "" {
+			dnsName = address.Address
+			break
+		}
+	}
+
+	m.privateDnsNamesMutex.Lock()
+	ref, found := m.privateDnsNames[dnsName]
+	missedAt, missed := m.privateDnsNameMisses[dnsName]
+	m.privateDnsNamesMutex.Unlock()
+	if found {
+		return &ref, nil
+	}
+	if missed && time.Since(missedAt) < privateDnsNameMissTTL {
+		return nil, nil
+	}
+
+	var resolved *AwsInstanceRef
+	for _, service := range m.services() {
+		var err error
+		resolved, err = service.getInstanceRefByPrivateDnsName(ctx, dnsName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up instance of node %s by private DNS name %s in region %s: %v", node.Name, dnsName, service.region, err)
+		}
+		if resolved != nil {
+			break
+		}
+	}
+
+	m.privateDnsNamesMutex.Lock()
+	defer m.privateDnsNamesMutex.Unlock()
+	if resolved == nil {
+		m.privateDnsNameMisses[dnsName] = time.Now()
+		return nil, nil
+	}
+	klog.V(4).Infof("Resolved node %s without provider ID to instance %s", node.Name, resolved.Name)
+	m.privateDnsNames[dnsName] = *resolved
+	delete(m.privateDnsNameMisses, dnsName)
+	return resolved, nil
+}
+
 // Cleanup the ASG cache.
 func (m *AwsManager) Cleanup() {
 	m.asgCache.Cleanup()
@@ -100,27 +948,158 @@ func (m *AwsManager) getAutoscalingOptions(ref AwsRef) map[string]string {
 	return m.asgCache.GetAutoscalingOptions(ref)
 }
 
+// GetAsgOptions returns the autoscaling options of the ASG, overriding the given defaults
+// with the values set via option tags. Invalid values are logged and ignored.
+func (m *AwsManager) GetAsgOptions(asg *asg, defaults NodeGroupAutoscalingOptions) *NodeGroupAutoscalingOptions {
+	options := m.getAutoscalingOptions(asg.AwsRef)
+	if len(options) == 0 {
+		return &defaults
+	}
+
+	parseFloat := func(key string, target *float64) {
+		if value, found := options[key]; found {
+			if opt, err := strconv.ParseFloat(value, 64); err != nil {
+				klog.Warningf("failed to convert asg %s %s tag to float: %v", asg.Name, key, err)
+			} else if opt < 0 || opt > 1 {
+				klog.Warningf("asg %s %s tag value %v is out of range [0, 1]", asg.Name, key, opt)
+			} else {
+				*target = opt
+			}
+		}
+	}
+	parseDuration := func(key string, target *time.Duration) {
+		if value, found := options[key]; found {
+			if opt, err := time.ParseDuration(value); err != nil {
+				klog.Warningf("failed to convert asg %s %s tag to duration: %v", asg.Name, key, err)
+			} else if opt < 0 {
+				klog.Warningf("asg %s %s tag value %v is negative", asg.Name, key, opt)
+			} else {
+				*target = opt
+			}
+		}
+	}
+
+	parseFloat(scaleDownUtilizationThresholdKey, &defaults.ScaleDownUtilizationThreshold)
+	parseFloat(scaleDownGpuUtilizationThresholdKey, &defaults.ScaleDownGpuUtilizationThreshold)
+	parseDuration(scaleDownUnneededTimeKey, &defaults.ScaleDownUnneededTime)
+	parseDuration(scaleDownUnreadyTimeKey, &defaults.ScaleDownUnreadyTime)
+	if value, found := options[maxNodeProvisionTimeKey]; found {
+		// A zero provision time would fail every scale-up of the ASG
+		if opt, err := time.ParseDuration(value); err != nil {
+			klog.Warningf("failed to convert asg %s %s tag to duration: %v", asg.Name, maxNodeProvisionTimeKey, err)
+		} else if opt <= 0 {
+			klog.Warningf("asg %s %s tag value %v is not positive", asg.Name, maxNodeProvisionTimeKey, opt)
+		} else {
+			defaults.MaxNodeProvisionTime = opt
+		}
+	}
+
+	return &defaults
+}
+
 // SetAsgSize sets ASG size.
 func (m *AwsManager) SetAsgSize(asg *asg, size int) error {
-	return m.asgCache.SetAsgSize(asg, size)
+	return m.SetAsgSizeWithContext(context.Background(), asg, size)
+}
+
+// SetAsgSizeWithContext is like SetAsgSize, but the AWS calls it makes are bound to the given context.
+func (m *AwsManager) SetAsgSizeWithContext(ctx context.Context, asg *asg, size int) error {
+	err := m.asgCache.SetAsgSize(ctx, asg, size)
+	if errors.Is(err, ErrASGNotFound) {
+		m.InvalidateCache()
+	}
+	return err
+}
+
+// AtomicIncreaseAsgSize adds delta instances to the ASG if all of them can be launched,
+// and fails without changing the ASG otherwise.
+func (m *AwsManager) AtomicIncreaseAsgSize(ctx context.Context, asg *asg, delta int) error {
+	if err := m.asgCache.AtomicIncreaseAsgSize(ctx, asg, delta); err != nil {
+		if errors.Is(err, ErrASGNotFound) {
+			m.InvalidateCache()
+		}
+		return err
+	}
+	m.InvalidateCache()
+	return nil
 }
 
 // DeleteInstances deletes the given instances. All instances must be controlled by the same ASG.
 func (m *AwsManager) DeleteInstances(instances []*AwsInstanceRef) error {
-	if err := m.asgCache.DeleteInstances(instances); err != nil {
+	return m.DeleteInstancesWithContext(context.Background(), instances)
+}
+
+// DeleteInstancesWithContext is like DeleteInstances, but the AWS calls it makes are bound
+// to the given context.
+func (m *AwsManager) DeleteInstancesWithContext(ctx context.Context, instances []*AwsInstanceRef) error {
+	if err := m.asgCache.DeleteInstances(ctx, instances); err != nil {
+		if errors.Is(err, ErrASGNotFound) {
+			m.InvalidateCache()
+		}
 		return err
 	}
 	klog.V(2).Infof("DeleteInstances was called: scheduling an ASG list refresh for next main loop evaluation")
-	m.lastRefresh = time.Now().Add(-refreshInterval)
+	m.InvalidateCache()
 	return nil
 }
 
+// InstanceTypeSource returns where the EC2 instance types used to build templates come
+// from, to help diagnosing templates built from a stale list.
+func (m *AwsManager) InstanceTypeSource() InstanceTypeSource {
+	return m.instanceTypeSource
+}
+
+// InvalidateCache makes the next Refresh regenerate the ASG cache, even if the refresh
+// interval hasn't elapsed yet.
+func (m *AwsManager) InvalidateCache() {
+	m.cacheInvalidated.Store(true)
+}
+
+// RefreshAsg refreshes the cached state of a single ASG.
+func (m *AwsManager) RefreshAsg(ref AwsRef) error {
+	return m.asgCache.RefreshAsg(context.Background(), ref)
+}
+
+// DetectDrift returns the ASGs whose cached size differs from their desired capacity in
+// AWS. When correct is true the cached sizes are updated, without waiting for the next
+// refresh.
+func (m *AwsManager) DetectDrift(ctx context.Context, correct bool) ([]AsgDrift, error) {
+	return m.asgCache.DetectDrift(ctx, correct)
+}
+
+// GetAsgLastRefreshed returns when the cached state of the ASG was last refreshed.
+func (m *AwsManager) GetAsgLastRefreshed(ref AwsRef) time.Time {
+	return m.asgCache.LastRefreshed(ref)
+}
+
 // GetAsgNodes returns Asg nodes.
 func (m *AwsManager) GetAsgNodes(ref AwsRef) ([]AwsInstanceRef, error) {
 	return m.asgCache.InstancesByAsg(ref)
 }
 
-// GetInstanceStatus returns the status of ASG nodes
+// GetAsgInstanceStates returns the health and lifecycle state of each instance of the ASG.
+func (m *AwsManager) GetAsgInstanceStates(ref AwsRef) (map[AwsInstanceRef]InstanceState, error) {
+	return m.asgCache.InstanceStates(ref)
+}
+
+// RefreshInstanceStates updates the cached state of the given instances from AWS, e.g.
+// before deleting many of them.
+func (m *AwsManager) RefreshInstanceStates(ctx context.Context, instances []AwsInstanceRef) error {
+	return m.asgCache.RefreshInstanceStates(ctx, instances)
+}
+
+// Snapshot returns the cached sizes of all the ASGs, without calling AWS.
+func (m *AwsManager) Snapshot() []AsgSnapshot {
+	return m.asgCache.Snapshot()
+}
+
+// SnapshotJSON returns the Snapshot marshalled as JSON, e.g. for a debug endpoint.
+func (m *AwsManager) SnapshotJSON() ([]byte, error) {
+	return json.Marshal(m.Snapshot())
+}
+
+// GetInstanceStatus returns the status of ASG nodes. The status of a placeholder that
+// cannot be fulfilled includes the reason of the failed scaling activity.
 func (m *AwsManager) GetInstanceStatus(ref AwsInstanceRef) (*string, error) {
 	return m.asgCache.InstanceStatus(ref)
 }
@@ -130,29 +1109,297 @@ func (m *AwsManager) getAsgTemplate(asg *asg) (*asgTemplate, error) {
 		return nil, fmt.Errorf("unable to get first AvailabilityZone for ASG %q", asg.Name)
 	}
 
+	// A new instance of a multi-AZ ASG can land in any of its zones, so the template
+	// only gets a zone when the ASG spans a single one.
 	az := asg.AvailabilityZones[0]
-	region := az[0 : len(az)-1]
+	region := m.asgRegion(asg)
 
+	csiZone := az
 	if len(asg.AvailabilityZones) > 1 {
-		klog.V(4).Infof("Found multiple availability zones for ASG %q; using %s for %s label\n", asg.Name, az, apiv1.LabelZoneFailureDomain)
+		klog.V(4).Infof("Found multiple availability zones for ASG %q; omitting zone labels from its template", asg.Name)
+		az = ""
+		if !m.csiZoneFromFirstAZ {
+			csiZone = ""
+		}
 	}
 
 	instanceTypeName, err := getInstanceTypeForAsg(m.asgCache, asg)
 	if err != nil {
 		return nil, err
 	}
+	if asg.diversifiedCapacity() {
+		// Any of the overrides can be launched, so only assume the capacity of the smallest
+		instanceTypeName = m.leastCapableInstanceType(region, asg.MixedInstancesPolicy.instanceTypesOverrides, instanceTypeName)
+	}
 
-	if t, ok := m.instanceTypes[instanceTypeName]; ok {
+	if t, ok := m.lookupInstanceType(region, instanceTypeName); ok {
 		return &asgTemplate{
 			InstanceType: t,
 			Region:       region,
 			Zone:         az,
+			CSIZone:      csiZone,
+			RootVolume:   asg.RootVolume,
 		}, nil
 	}
 
 	return nil, fmt.Errorf("ASG %q uses the unknown EC2 instance type %q", asg.Name, instanceTypeName)
 }
 
+// filterInstanceTypesByRegion restricts the instance types of each region of the manager
+// to the ones offered there.
+func (m *AwsManager) filterInstanceTypesByRegion() error {
+	byRegion := make(map[string]map[string]*InstanceType)
+	for _, service := range m.services() {
+		instanceTypes, err := regionalInstanceTypes.get(service.ec2I, service.region, m.instanceTypeSource, m.instanceTypes)
+		if err != nil {
+			return err
+		}
+		klog.V(2).Infof("%d of the %d known instance types are offered in region %s", len(instanceTypes), len(m.instanceTypes), service.region)
+		byRegion[service.region] = instanceTypes
+	}
+	m.instanceTypesByRegion = byRegion
+	return nil
+}
+
+// instanceTypesForRegion returns the known instance types offered in the region.
+func (m *AwsManager) instanceTypesForRegion(region string) map[string]*InstanceType {
+	if instanceTypes, found := m.instanceTypesByRegion[region]; found {
+		return instanceTypes
+	}
+	return m.instanceTypes
+}
+
+// lookupInstanceType returns the known instance type with the given name offered in the
+// region. When approximation is enabled, unknown types fall back to the nearest known type
+// of the same family and size, so new types can be scaled before the static list is
+// regenerated.
+func (m *AwsManager) lookupInstanceType(region, name string) (*InstanceType, bool) {
+	instanceTypes := m.instanceTypesForRegion(region)
+	if t, ok := instanceTypes[name]; ok {
+		return t, true
+	}
+	if !m.approximateInstanceTypes {
+		return nil, false
+	}
+	t, ok := approximateInstanceType(name, instanceTypes)
+	if !ok {
+		return nil, false
+	}
+	klog.Warningf("Unknown EC2 instance type %s, approximating its capacity from %s", name, t.InstanceType)
+	approximated := *t
+	approximated.InstanceType = name
+	return &approximated, true
+}
+
+// SetApproximateInstanceTypes configures whether the capacity of instance types missing
+// from the instance type list is derived from a known type of the same family and size
+// instead of failing the node template.
+func (m *AwsManager) SetApproximateInstanceTypes(enabled bool) {
+	m.approximateInstanceTypes = enabled
+}
+
+// SetMachineTypePrefixes restricts the machine types reported as available to the known
+// instance types whose name starts with any of the prefixes, e.g. "m", "c7g." or "r6i.".
+// No prefixes report all the known instance types.
+func (m *AwsManager) SetMachineTypePrefixes(prefixes []string) {
+	m.machineTypePrefixes = prefixes
+}
+
+// AvailableMachineTypes returns the sorted names of the known instance types, filtered by
+// the machine type prefixes.
+func (m *AwsManager) AvailableMachineTypes() []string {
+	machineTypes := make([]string, 0, len(m.instanceTypes))
+	for name := range m.instanceTypes {
+		if len(m.machineTypePrefixes) == 0 || hasAnyPrefix(name, m.machineTypePrefixes) {
+			machineTypes = append(machineTypes, name)
+		}
+	}
+	sort.Strings(machineTypes)
+	return machineTypes
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// leastCapableInstanceType returns the known instance type offered in the region with the
+// fewest vCPUs, then the least memory, falling back to the given instance type if none of
+// them is known.
+func (m *AwsManager) leastCapableInstanceType(region string, instanceTypes []string, fallback string) string {
+	known := m.instanceTypesForRegion(region)
+	var least *InstanceType
+	for _, name := range instanceTypes {
+		t, found := known[name]
+		if !found {
+			continue
+		}
+		if least == nil || t.VCPU < least.VCPU || (t.VCPU == least.VCPU && t.MemoryMb < least.MemoryMb) {
+			least = t
+		}
+	}
+	if least == nil {
+		return fallback
+	}
+	return least.InstanceType
+}
+
+// GetAsgLaunchTemplate returns the launch template used by the ASG, with $Latest and
+// $Default resolved to the version number they point to. It returns nil for ASGs
+// using a launch configuration.
+func (m *AwsManager) GetAsgLaunchTemplate(ctx context.Context, asg *asg) (*LaunchTemplateVersion, error) {
+	lt := asg.effectiveLaunchTemplate()
+	if lt == nil {
+		return nil, nil
+	}
+
+	version, err := m.serviceForRegion(asg.Region).resolveLaunchTemplateVersion(ctx, lt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve version %s of launch template %s of ASG %s: %v", lt.version, lt.name, asg.Name, err)
+	}
+	return &LaunchTemplateVersion{Name: lt.name, Version: version}, nil
+}
+
+// zoneRegionRegex matches the region prefix of availability zone names, including
+// Local Zones (us-west-2-lax-1a) and Wavelength Zones (us-east-1-wl1-bos-wlz-1).
+var zoneRegionRegex = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+`)
+
+// asgRegion returns the region of the ASG, derived from its first zone, falling back to
+// the region it is managed in.
+func (m *AwsManager) asgRegion(asg *asg) string {
+	if len(asg.AvailabilityZones) > 0 {
+		if region := regionFromZone(asg.AvailabilityZones[0]); region != "" {
+			return region
+		}
+	}
+	if asg.Region != "" {
+		return asg.Region
+	}
+	return m.awsService.region
+}
+
+// regionFromZone returns the region of an availability zone, or an empty string
+// if the zone name isn't recognised.
+func regionFromZone(zone string) string {
+	return zoneRegionRegex.FindString(zone)
+}
+
+// buildCapacityFromTemplate returns the node capacity described by an ASG template.
+func (m *AwsManager) buildCapacityFromTemplate(asg *asg, template *asgTemplate) (apiv1.ResourceList, error) {
+	capacity := apiv1.ResourceList{}
+	capacity[apiv1.ResourcePods] = *resource.NewQuantity(defaultMaxPodsPerNode, resource.DecimalSI)
+	capacity[apiv1.ResourceCPU] = *resource.NewQuantity(template.InstanceType.VCPU, resource.DecimalSI)
+	capacity[apiv1.ResourceMemory] = *resource.NewQuantity(template.InstanceType.MemoryMb*1024*1024, resource.DecimalSI)
+	capacity[ResourceNvidiaGPU] = *resource.NewQuantity(template.InstanceType.GPU, resource.DecimalSI)
+
+	for _, tag := range asg.Tags {
+		key := aws.StringValue(tag.Key)
+		if !strings.HasPrefix(key, nodeTemplateResourcesTagPrefix) {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(aws.StringValue(tag.Value))
+		if key == ephemeralStorageTag {
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s tag on ASG %q: %v", ephemeralStorageTag, asg.Name, err)
+			}
+			capacity[apiv1.ResourceEphemeralStorage] = quantity
+			continue
+		}
+		if err != nil {
+			klog.Warningf("Ignoring tag %s on ASG %q: invalid quantity %q: %v", key, asg.Name, aws.StringValue(tag.Value), err)
+			continue
+		}
+		capacity[apiv1.ResourceName(strings.TrimPrefix(key, nodeTemplateResourcesTagPrefix))] = quantity
+	}
+
+	if err := m.updateCapacityWithRequirementsOverrides(&capacity, asg.MixedInstancesPolicy); err != nil {
+		return nil, err
+	}
+	return capacity, nil
+}
+
+// buildNodeFromTemplate returns a node that looks like the ones the ASG would create,
+// for scaling up an ASG from zero.
+func (m *AwsManager) buildNodeFromTemplate(asg *asg, template *asgTemplate) (*apiv1.Node, error) {
+	nodeName := fmt.Sprintf("%s-template", asg.Name)
+	capacity, err := m.buildCapacityFromTemplate(asg, template)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := buildReservationsFromAsg(asg)
+	if err != nil {
+		return nil, err
+	}
+	taints, err := extractTaintsFromAsg(asg.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build template of ASG %s: %v", asg.Name, err)
+	}
+
+	node := &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   nodeName,
+			Labels: buildGenericLabels(template, nodeName),
+		},
+		Spec: apiv1.NodeSpec{
+			Taints: taints,
+		},
+		Status: apiv1.NodeStatus{
+			Capacity:    capacity,
+			Allocatable: reservations.allocatable(capacity),
+			Conditions: []apiv1.NodeCondition{{
+				Type:   apiv1.NodeReady,
+				Status: apiv1.ConditionTrue,
+			}},
+		},
+	}
+	// Template label tags of the ASG take precedence over instance tags
+	labels := m.asgCache.InstanceTagLabels(asg.AwsRef)
+	for k, v := range extractLabelsFromAsg(asg.Tags) {
+		labels[k] = v
+	}
+	labels, err = sanitizeLabels(asg.Name, labels, m.labelSanitizationPolicy)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range labels {
+		node.Labels[k] = v
+	}
+	return node, nil
+}
+
+// buildGenericLabels returns the well-known labels set by the kubelet and the cloud
+// controller manager on every node of the template's instance type.
+func buildGenericLabels(template *asgTemplate, nodeName string) map[string]string {
+	result := map[string]string{
+		apiv1.LabelArchStable:         template.InstanceType.Architecture,
+		labelArchBeta:                 template.InstanceType.Architecture,
+		apiv1.LabelOSStable:           defaultOS,
+		labelOSBeta:                   defaultOS,
+		apiv1.LabelInstanceTypeStable: template.InstanceType.InstanceType,
+		apiv1.LabelInstanceType:       template.InstanceType.InstanceType,
+		apiv1.LabelTopologyRegion:     template.Region,
+		apiv1.LabelZoneRegion:         template.Region,
+		apiv1.LabelHostname:           nodeName,
+	}
+	if template.Zone != "" {
+		result[apiv1.LabelTopologyZone] = template.Zone
+		result[apiv1.LabelZoneFailureDomain] = template.Zone
+	}
+	if template.CSIZone != "" {
+		result[labelAwsCSITopologyZone] = template.CSIZone
+	}
+	if template.InstanceType.GPU > 0 {
+		if gpuType, found := GPULabelValueForInstanceType(template.InstanceType.InstanceType); found {
+			result[GPULabel] = gpuType
+		}
+	}
+	return result
+}
+
 func (m *AwsManager) updateCapacityWithRequirementsOverrides(capacity *apiv1.ResourceList, policy *mixedInstancesPolicy) error {
 	if policy == nil || len(policy.instanceTypesOverrides) > 0 {
 		return nil
@@ -161,11 +1408,76 @@ func (m *AwsManager) updateCapacityWithRequirementsOverrides(capacity *apiv1.Res
 	return nil
 }
 
+func extractLabelsFromAsg(tags []*autoscaling.TagDescription) map[string]string {
+	result := make(map[string]string)
+
+	for _, tag := range tags {
+		k := aws.StringValue(tag.Key)
+		v := aws.StringValue(tag.Value)
+		splits := strings.Split(k, nodeTemplateLabelTagPrefix)
+		if len(splits) > 1 {
+			label := splits[1]
+			if label != "" {
+				result[label] = v
+			}
+		}
+	}
+
+	return result
+}
+
+func extractTaintsFromAsg(tags []*autoscaling.TagDescription) ([]apiv1.Taint, error) {
+	taints := make([]apiv1.Taint, 0)
+
+	for _, tag := range tags {
+		k := aws.StringValue(tag.Key)
+		if !strings.HasPrefix(k, nodeTemplateTaintTagPrefix) {
+			continue
+		}
+		taint, err := parseTaintTag(strings.TrimPrefix(k, nodeTemplateTaintTagPrefix), aws.StringValue(tag.Value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid taint tag %s: %v", k, err)
+		}
+		taints = append(taints, taint)
+	}
+
+	return taints, nil
+}
+
+// parseTaintTag builds a taint from the key of a taint tag, stripped of its prefix,
+// and the tag value in the format <value>:<effect>.
+func parseTaintTag(key, value string) (apiv1.Taint, error) {
+	if key == "" {
+		return apiv1.Taint{}, fmt.Errorf("empty taint key")
+	}
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return apiv1.Taint{}, fmt.Errorf("value %q is not in the format <value>:<effect>", value)
+	}
+
+	effect := apiv1.TaintEffect(value[i+1:])
+	switch effect {
+	case apiv1.TaintEffectNoSchedule, apiv1.TaintEffectPreferNoSchedule, apiv1.TaintEffectNoExecute:
+	default:
+		return apiv1.Taint{}, fmt.Errorf("unknown taint effect %q, expected one of %s, %s or %s", effect,
+			apiv1.TaintEffectNoSchedule, apiv1.TaintEffectPreferNoSchedule, apiv1.TaintEffectNoExecute)
+	}
+
+	return apiv1.Taint{
+		Key:    key,
+		Value:  value[:i],
+		Effect: effect,
+	}, nil
+}
+
 // An asgAutoDiscoveryConfig specifies how to autodiscover AWS ASGs.
 type asgAutoDiscoveryConfig struct {
 	// Tags to match on.
-	// Any ASG with all of the provided tag keys will be autoscaled.
+	// Any ASG with all of the provided tag keys will be autoscaled. Tags with a
+	// non-empty value additionally require the ASG tag to have that exact value.
 	Tags map[string]string
+	// NamePattern to match ASG names on. Any ASG whose name matches will be autoscaled.
+	NamePattern *regexp.Regexp
 }
 
 func parseASGAutoDiscoverySpec(spec string) (asgAutoDiscoveryConfig, error) {
@@ -185,24 +1497,79 @@ func parseASGAutoDiscoverySpec(spec string) (asgAutoDiscoveryConfig, error) {
 		return cfg, fmt.Errorf("invalid key=value pair %s", kv)
 	}
 	k, v := kv[0], kv[1]
-	if k != asgAutoDiscovererKeyTag {
-		return cfg, fmt.Errorf("unsupported parameter key \"%s\" is specified for discoverer \"%s\". The only supported key is \"%s\"", k, discoverer, asgAutoDiscovererKeyTag)
+	switch k {
+	case asgAutoDiscovererKeyTag:
+	case asgAutoDiscovererKeyName:
+		if v == "" {
+			return cfg, errors.New("name pattern not supplied")
+		}
+		pattern, err := compileAsgNamePattern(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid ASG name pattern %q for auto discovery: %v", v, err)
+		}
+		cfg.NamePattern = pattern
+		return cfg, nil
+	default:
+		return cfg, fmt.Errorf("unsupported parameter key \"%s\" is specified for discoverer \"%s\". Supported keys are \"%s\" and \"%s\"", k, discoverer, asgAutoDiscovererKeyTag, asgAutoDiscovererKeyName)
 	}
 	if v == "" {
 		return cfg, errors.New("tag value not supplied")
 	}
 	p := strings.Split(v, ",")
-	if len(p) == 0 {
-		return cfg, fmt.Errorf("invalid ASG tag for auto discovery specified: ASG tag must not be empty")
-	}
 	cfg.Tags = make(map[string]string, len(p))
 	for _, label := range p {
 		lp := strings.SplitN(label, "=", 2)
+		key := strings.TrimSpace(lp[0])
+		if key == "" {
+			if len(lp) > 1 {
+				return cfg, fmt.Errorf("invalid ASG tag for auto discovery specified: tag key must not be empty in %q", label)
+			}
+			continue
+		}
 		if len(lp) > 1 {
-			cfg.Tags[lp[0]] = lp[1]
+			cfg.Tags[key] = lp[1]
 			continue
 		}
-		cfg.Tags[lp[0]] = ""
+		cfg.Tags[key] = ""
+	}
+	if len(cfg.Tags) == 0 {
+		return cfg, fmt.Errorf("invalid ASG tag for auto discovery specified: ASG tag must not be empty")
 	}
 	return cfg, nil
 }
+
+// compileAsgNamePattern compiles a glob pattern such as "prod-workers-*" into a
+// regexp matching whole ASG names. "*" matches any sequence of characters and "?"
+// matches a single character.
+func compileAsgNamePattern(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// parseASGAutoDiscoverySpecs parses every --node-group-auto-discovery spec. The tags
+// of all specs are merged by the ASG cache, so an ASG is discovered only when it
+// matches every key=value constraint across all specs. ASGs matching any of the
+// name patterns are discovered in addition to the tagged ones.
+func parseASGAutoDiscoverySpecs(specs []string) ([]asgAutoDiscoveryConfig, error) {
+	cfgs := make([]asgAutoDiscoveryConfig, len(specs))
+	var err error
+	for i, spec := range specs {
+		cfgs[i], err = parseASGAutoDiscoverySpec(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfgs, nil
+}
@@ -0,0 +1,508 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDeleteInstancesDetachesWhenConfigured(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 2, 5, "i-1", "i-2")}}
+	manager := newTestManager(t, autoScaling, nil)
+	manager.SetDetachOnDelete(true)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	ref, _ := AwsRefFromProviderId(testNode("i-1").Spec.ProviderID)
+	if err := manager.DeleteInstances([]*AwsInstanceRef{ref}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(autoScaling.detached) != 1 || autoScaling.detached[0] != "i-1" || len(autoScaling.terminated) != 0 {
+		t.Errorf("expected i-1 to be detached rather than terminated, got detached %v and terminated %v",
+			autoScaling.detached, autoScaling.terminated)
+	}
+	if size, _ := nodeGroup.TargetSize(); size != 1 {
+		t.Errorf("expected target size 1, got %d", size)
+	}
+	if !manager.cacheInvalidated.Load() {
+		t.Error("expected the cache to be invalidated for the next loop")
+	}
+}
+
+func TestTemplateNodeArm64(t *testing.T) {
+	stubInstanceTypes(t, map[string]string{"graviton": "m6g.large"})
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("graviton", 0, 0, 5)}}, nil)
+
+	node, err := testNodeGroup(t, manager, "graviton").TemplateNode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, label := range []string{apiv1.LabelArchStable, labelArchBeta} {
+		if arch := node.Labels[label]; arch != "arm64" {
+			t.Errorf("expected label %s to be arm64, got %q", label, arch)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	for region, expected := range map[string]string{
+		"us-gov-west-1":  "aws-us-gov",
+		"cn-north-1":     "aws-cn",
+		"eu-west-1":      "aws",
+		"unknown-east-1": "aws",
+	} {
+		manager, err := newAwsManager(&awsWrapper{region: region}, InstanceTypes, InstanceTypeSourceStatic, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if partition := manager.Partition(); partition != expected {
+			t.Errorf("expected partition %s for region %s, got %s", expected, region, partition)
+		}
+	}
+}
+
+// templateNode returns the template node of the named ASG.
+func templateNode(t *testing.T, manager *AwsManager, name string) *apiv1.Node {
+	t.Helper()
+	node, err := testNodeGroup(t, manager, name).TemplateNode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return node
+}
+
+func TestTemplateNodeCSIZoneOfSingleZoneAsg(t *testing.T) {
+	stubInstanceTypes(t, map[string]string{"single": "m5.large"})
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("single", 0, 0, 5)}}, nil)
+
+	labels := templateNode(t, manager, "single").Labels
+	if zone := labels[labelAwsCSITopologyZone]; zone != "us-east-1a" {
+		t.Errorf("expected the CSI zone label us-east-1a, got %q", zone)
+	}
+	if zone := labels[apiv1.LabelTopologyZone]; zone != "us-east-1a" {
+		t.Errorf("expected the zone label us-east-1a alongside it, got %q", zone)
+	}
+}
+
+func TestDeleteInstancesSkipsTerminatingInstances(t *testing.T) {
+	group := testGroup("asg-1", 0, 2, 5, "i-1", "i-2")
+	group.Instances[0].LifecycleState = aws.String(autoscaling.LifecycleStateTerminatingWait)
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{group}}
+	manager := newTestManager(t, autoScaling, nil)
+
+	refs := []*AwsInstanceRef{}
+	for _, id := range []string{"i-1", "i-2"} {
+		ref, _ := AwsRefFromProviderId(testNode(id).Spec.ProviderID)
+		refs = append(refs, ref)
+	}
+	if err := manager.DeleteInstances(refs); err != nil {
+		t.Fatalf("expected the terminating instance to be skipped without error, got %v", err)
+	}
+	if len(autoScaling.terminated) != 1 || autoScaling.terminated[0] != "i-2" {
+		t.Errorf("expected only i-2 to be terminated, got %v", autoScaling.terminated)
+	}
+	if size, _ := testNodeGroup(t, manager, "asg-1").TargetSize(); size != 1 {
+		t.Errorf("expected target size 1, got %d", size)
+	}
+}
+
+func TestInvalidateCacheForcesRefresh(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 1, 5, "i-1")}}
+	manager := newTestManager(t, autoScaling, nil)
+	describes := autoScaling.callCount("DescribeAutoScalingGroups")
+
+	if err := manager.Refresh(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := autoScaling.callCount("DescribeAutoScalingGroups"); calls != describes {
+		t.Fatalf("expected no refresh within the refresh interval, got %d describe calls", calls-describes)
+	}
+
+	// Invalidations race with refreshes, e.g. when nodes are deleted concurrently
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.InvalidateCache()
+	}()
+	<-done
+	if err := manager.Refresh(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := autoScaling.callCount("DescribeAutoScalingGroups"); calls != describes+1 {
+		t.Errorf("expected the invalidated cache to be refreshed, got %d describe calls", calls-describes)
+	}
+	if manager.cacheInvalidated.Load() {
+		t.Error("expected the refresh to clear the invalidation")
+	}
+}
+
+func TestInstanceTypeSource(t *testing.T) {
+	sess, err := createAWSSDKSession("us-east-1", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, source := range []InstanceTypeSource{InstanceTypeSourceStatic, InstanceTypeSourceDynamic, InstanceTypeSourceFile} {
+		manager, err := NewAwsManager(sess, AwsManagerOptions{
+			InstanceTypes:      InstanceTypes,
+			InstanceTypeSource: source,
+			DeferRefresh:       true,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if reported := manager.InstanceTypeSource(); reported != source {
+			t.Errorf("expected instance type source %s, got %s", source, reported)
+		}
+	}
+}
+
+func TestTemplateNodeCSIZoneOfMultiZoneAsg(t *testing.T) {
+	stubInstanceTypes(t, map[string]string{"multi": "m5.large"})
+	group := testGroup("multi", 0, 0, 5)
+	group.AvailabilityZones = aws.StringSlice([]string{"us-east-1a", "us-east-1b"})
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{group}}, nil)
+
+	labels := templateNode(t, manager, "multi").Labels
+	if zone, found := labels[labelAwsCSITopologyZone]; found {
+		t.Errorf("expected no CSI zone label by default, got %q", zone)
+	}
+	if zone, found := labels[apiv1.LabelTopologyZone]; found {
+		t.Errorf("expected no zone label, got %q", zone)
+	}
+
+	manager.SetCSIZoneFromFirstAZ(true)
+	labels = templateNode(t, manager, "multi").Labels
+	if zone := labels[labelAwsCSITopologyZone]; zone != "us-east-1a" {
+		t.Errorf("expected the CSI zone label of the first zone, got %q", zone)
+	}
+}
+
+func TestReadyzHandlerReportsStaleCache(t *testing.T) {
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 0, 5)}}, nil)
+	handler := manager.ReadyzHandler(time.Minute)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if !manager.Healthy(time.Minute) || recorder.Code != http.StatusOK {
+		t.Errorf("expected a freshly refreshed manager to be ready, got %d", recorder.Code)
+	}
+
+	manager.lastRefreshMutex.Lock()
+	manager.lastRefresh = time.Now().Add(-2 * time.Minute)
+	manager.lastRefreshMutex.Unlock()
+
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if manager.Healthy(time.Minute) || recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a stale manager not to be ready, got %d", recorder.Code)
+	}
+}
+
+func TestRegionFromZone(t *testing.T) {
+	for _, tc := range []struct {
+		zone, region string
+	}{
+		{"us-east-1a", "us-east-1"},
+		{"us-west-2-lax-1a", "us-west-2"},
+		{"us-east-1-wl1-bos-wlz-1", "us-east-1"},
+		{"us-gov-west-1a", "us-gov-west-1"},
+		{"ap-southeast-2b", "ap-southeast-2"},
+		{"unknown", ""},
+		{"", ""},
+	} {
+		if region := regionFromZone(tc.zone); region != tc.region {
+			t.Errorf("expected region %q of zone %q, got %q", tc.region, tc.zone, region)
+		}
+	}
+}
+
+func TestParseTaintTag(t *testing.T) {
+	taint, err := parseTaintTag("dedicated", "gpu:NoSchedule")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := (apiv1.Taint{Key: "dedicated", Value: "gpu", Effect: apiv1.TaintEffectNoSchedule}); taint != expected {
+		t.Errorf("expected taint %v, got %v", expected, taint)
+	}
+
+	// The effect follows the last colon, so values may contain colons themselves
+	taint, err = parseTaintTag("url", "http://example.com:NoExecute")
+	if err != nil || taint.Value != "http://example.com" || taint.Effect != apiv1.TaintEffectNoExecute {
+		t.Errorf("expected a taint with a colon in its value, got %v, %v", taint, err)
+	}
+
+	for _, tc := range []struct {
+		key, value string
+	}{
+		{"", "gpu:NoSchedule"},
+		{"dedicated", "gpu"},
+		{"dedicated", "gpu:"},
+		{"dedicated", "gpu:Evict"},
+		{"dedicated", "gpu:noschedule"},
+	} {
+		if taint, err := parseTaintTag(tc.key, tc.value); err == nil {
+			t.Errorf("expected an error for taint tag %q=%q, got %v", tc.key, tc.value, taint)
+		}
+	}
+}
+
+func TestExtractTaintsFromAsgRejectsMalformedTags(t *testing.T) {
+	tags := []*autoscaling.TagDescription{
+		{Key: aws.String(nodeTemplateTaintTagPrefix + "dedicated"), Value: aws.String("gpu:NoSchedule")},
+		{Key: aws.String(nodeTemplateTaintTagPrefix + "broken"), Value: aws.String("NoSchedule")},
+	}
+	if _, err := extractTaintsFromAsg(tags); !errorContains(err, nodeTemplateTaintTagPrefix+"broken") {
+		t.Errorf("expected an error naming the malformed tag, got %v", err)
+	}
+}
+
+func TestTemplateNodeGPU(t *testing.T) {
+	stubInstanceTypes(t, map[string]string{"gpu": "p3.2xlarge", "cpu": "m5.large"})
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{
+		testGroup("gpu", 0, 0, 5),
+		testGroup("cpu", 0, 0, 5),
+	}}, nil)
+
+	node := templateNode(t, manager, "gpu")
+	if gpus := node.Status.Capacity[ResourceNvidiaGPU]; gpus.Value() != 1 {
+		t.Errorf("expected 1 GPU, got %s", gpus.String())
+	}
+	if gpuType := node.Labels[GPULabel]; gpuType != "nvidia-tesla-v100" {
+		t.Errorf("expected the nvidia-tesla-v100 GPU label, got %q", gpuType)
+	}
+
+	node = templateNode(t, manager, "cpu")
+	if gpus := node.Status.Capacity[ResourceNvidiaGPU]; !gpus.IsZero() {
+		t.Errorf("expected no GPU, got %s", gpus.String())
+	}
+	if gpuType, found := node.Labels[GPULabel]; found {
+		t.Errorf("expected no GPU label, got %q", gpuType)
+	}
+}
+
+// instanceRefs returns the refs of the instances with the given IDs.
+func instanceRefs(ids ...string) []*AwsInstanceRef {
+	refs := []*AwsInstanceRef{}
+	for _, id := range ids {
+		ref, _ := AwsRefFromProviderId(testNode(id).Spec.ProviderID)
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+func TestDeleteInstancesCompletesTerminationHooks(t *testing.T) {
+	attempts := 0
+	autoScaling := &fakeAutoScaling{
+		groups: []*autoscaling.Group{testGroup("asg-1", 0, 2, 5, "i-1", "i-2")},
+		hooks: map[string][]*autoscaling.LifecycleHook{"asg-1": {
+			{LifecycleHookName: aws.String("drain"), LifecycleTransition: aws.String("autoscaling:EC2_INSTANCE_TERMINATING")},
+			{LifecycleHookName: aws.String("bootstrap"), LifecycleTransition: aws.String("autoscaling:EC2_INSTANCE_LAUNCHING")},
+		}},
+		// The lifecycle action starts after two attempts
+		completeLifecycleAction: func(input *autoscaling.CompleteLifecycleActionInput) error {
+			if attempts++; attempts <= 2 {
+				return awserr.New("ValidationError", fmt.Sprintf("No active Lifecycle Action found with instance ID %s",
+					aws.StringValue(input.InstanceId)), nil)
+			}
+			return nil
+		},
+	}
+	manager := newTestManager(t, autoScaling, nil)
+	manager.SetCompleteTerminationHooks(true)
+	manager.asgCache.lifecycleActionBackoff = time.Millisecond
+
+	if err := manager.DeleteInstances(instanceRefs("i-1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for autoScaling.callCount("CompleteLifecycleAction") < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	autoScaling.mutex.Lock()
+	defer autoScaling.mutex.Unlock()
+	if len(autoScaling.completed) != 1 || autoScaling.completed[0] != "i-1/drain" {
+		t.Errorf("expected the drain hook of i-1 to be completed, got %v", autoScaling.completed)
+	}
+	if calls := autoScaling.calls["CompleteLifecycleAction"]; calls != 3 {
+		t.Errorf("expected 3 CompleteLifecycleAction calls, got %d", calls)
+	}
+}
+
+func TestDeleteInstancesWithoutTerminationHooks(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 2, 5, "i-1", "i-2")}}
+	manager := newTestManager(t, autoScaling, nil)
+	manager.SetCompleteTerminationHooks(true)
+
+	if err := manager.DeleteInstances(instanceRefs("i-1", "i-2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(autoScaling.terminated) != 2 {
+		t.Errorf("expected both instances to be terminated, got %v", autoScaling.terminated)
+	}
+	// The hooks are described once per call, even when there are none
+	if calls := autoScaling.callCount("DescribeLifecycleHooks"); calls != 1 {
+		t.Errorf("expected 1 DescribeLifecycleHooks call, got %d", calls)
+	}
+	if calls := autoScaling.callCount("CompleteLifecycleAction"); calls != 0 {
+		t.Errorf("expected no CompleteLifecycleAction call, got %d", calls)
+	}
+}
+
+func TestRegionalServices(t *testing.T) {
+	eastAutoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{testGroup("asg-1", 0, 1, 10, "i-1")}}
+	westGroup := testGroup("asg-1", 0, 2, 10, "i-2", "i-3")
+	westGroup.AutoScalingGroupARN = aws.String("arn:aws:autoscaling:us-west-2:123456789012:autoScalingGroup:uuid:autoScalingGroupName/asg-1")
+	westGroup.AvailabilityZones = aws.StringSlice([]string{"us-west-2a", "us-east-1a"})
+	westGroup.Instances[0].AvailabilityZone = aws.String("us-west-2a")
+	westAutoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{westGroup}}
+
+	manager, err := newAwsManager(&awsWrapper{autoScalingI: eastAutoScaling, ec2I: &fakeEC2{}, region: "us-east-1"},
+		InstanceTypes, InstanceTypeSourceStatic, []string{testAutoDiscoverySpec})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := manager.addRegionalService(&awsWrapper{autoScalingI: westAutoScaling, ec2I: &fakeEC2{}, region: "us-west-2"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, region := range []string{"", "us-east-1", "us-west-2"} {
+		if err := manager.addRegionalService(&awsWrapper{region: region}); err == nil {
+			t.Errorf("expected additional region %q to be rejected", region)
+		}
+	}
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	provider := &awsCloudProvider{awsManager: manager}
+	for _, tc := range []struct {
+		providerID string
+		nodeGroup  string
+	}{
+		{"aws:///us-east-1a/i-1", "asg-1"},
+		{"aws:///us-west-2a/i-2", "us-west-2:asg-1"},
+		// Cached in the us-west-2 ASG but in a us-east-1 zone, not routed to it
+		{"aws:///us-east-1a/i-3", ""},
+	} {
+		node := &apiv1.Node{ObjectMeta: metav1.ObjectMeta{Name: tc.providerID}, Spec: apiv1.NodeSpec{ProviderID: tc.providerID}}
+		nodeGroup, err := provider.NodeGroupForNode(node)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.providerID, err)
+		}
+		id := ""
+		if nodeGroup != nil {
+			id = nodeGroup.Id()
+		}
+		if id != tc.nodeGroup {
+			t.Errorf("%s: expected node group %q, got %q", tc.providerID, tc.nodeGroup, id)
+		}
+	}
+
+	if err := testNodeGroup(t, manager, "us-west-2:asg-1").IncreaseSize(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if desired := aws.Int64Value(westAutoScaling.group("asg-1").DesiredCapacity); desired != 3 {
+		t.Errorf("expected the us-west-2 ASG to be resized to 3, got %d", desired)
+	}
+	if desired := aws.Int64Value(eastAutoScaling.group("asg-1").DesiredCapacity); desired != 1 {
+		t.Errorf("expected the us-east-1 ASG to keep its size of 1, got %d", desired)
+	}
+
+	// The instance types of ASGs with the same name in different regions are cached apart
+	var queried []string
+	if err := manager.asgCache.asgInstanceTypeCache.populate(manager.asgCache.Get(), func(ref AwsRef) *awsWrapper {
+		queried = append(queried, ref.Id())
+		return manager.asgCache.serviceFor(ref)
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Strings(queried)
+	if expected := []string{"asg-1", "us-west-2:asg-1"}; !reflect.DeepEqual(queried, expected) {
+		t.Errorf("expected the instance types of %v to be looked up in their region, got %v", expected, queried)
+	}
+	for id, instanceType := range map[string]string{"asg-1": "m5.large", "us-west-2:asg-1": "c5.large"} {
+		manager.asgCache.asgInstanceTypeCache.Add(instanceTypeCachedObject{name: id, instanceType: instanceType})
+	}
+	for _, tc := range []struct {
+		nodeGroup    string
+		instanceType string
+	}{
+		{"asg-1", "m5.large"},
+		{"us-west-2:asg-1", "c5.large"},
+	} {
+		instanceType, err := getInstanceTypeForAsg(manager.asgCache, testNodeGroup(t, manager, tc.nodeGroup).asg)
+		if err != nil || instanceType != tc.instanceType {
+			t.Errorf("%s: expected instance type %s, got %q, %v", tc.nodeGroup, tc.instanceType, instanceType, err)
+		}
+	}
+}
+
+func TestFilterInstanceTypesByRegion(t *testing.T) {
+	original := regionalInstanceTypes
+	regionalInstanceTypes = &regionalInstanceTypeCache{byRegion: make(map[regionalInstanceTypesKey]map[string]*InstanceType)}
+	t.Cleanup(func() { regionalInstanceTypes = original })
+
+	known := map[string]*InstanceType{
+		"m5.large":        {InstanceType: "m5.large", VCPU: 2},
+		"m7i.large":       {InstanceType: "m7i.large", VCPU: 2},
+		"u-6tb1.56xlarge": {InstanceType: "u-6tb1.56xlarge", VCPU: 224},
+	}
+	eastEC2 := &fakeEC2{offerings: map[string][]string{"us-east-1": {"m5.large", "m7i.large", "u-6tb1.56xlarge", "m8g.large"}}}
+	westEC2 := &fakeEC2{offerings: map[string][]string{"us-west-2": {"m5.large"}}}
+	newManager := func(source InstanceTypeSource) *AwsManager {
+		manager, err := newAwsManager(&awsWrapper{autoScalingI: &fakeAutoScaling{}, ec2I: eastEC2, region: "us-east-1"},
+			known, source, []string{testAutoDiscoverySpec})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := manager.addRegionalService(&awsWrapper{autoScalingI: &fakeAutoScaling{}, ec2I: westEC2, region: "us-west-2"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := manager.filterInstanceTypesByRegion(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return manager
+	}
+
+	manager := newManager(InstanceTypeSourceStatic)
+	for _, tc := range []struct {
+		region       string
+		instanceType string
+		found        bool
+	}{
+		{"us-east-1", "m7i.large", true},
+		// Offered but not known
+		{"us-east-1", "m8g.large", false},
+		{"us-west-2", "m5.large", true},
+		{"us-west-2", "m7i.large", false},
+		// Regions without offerings use all the known instance types
+		{"eu-west-1", "m7i.large", true},
+	} {
+		if _, found := manager.lookupInstanceType(tc.region, tc.instanceType); found != tc.found {
+			t.Errorf("%s in %s: expected found to be %v, got %v", tc.instanceType, tc.region, tc.found, found)
+		}
+	}
+	if least := manager.leastCapableInstanceType("us-west-2", []string{"u-6tb1.56xlarge", "m7i.large"}, "u-6tb1.56xlarge"); least != "u-6tb1.56xlarge" {
+		t.Errorf("expected the fallback when no override is offered in the region, got %s", least)
+	}
+
+	// The offerings are described once per region and source
+	newManager(InstanceTypeSourceStatic)
+	if eastEC2.calls["DescribeInstanceTypeOfferings"] != 1 || westEC2.calls["DescribeInstanceTypeOfferings"] != 1 {
+		t.Errorf("expected the offerings of each region to be described once, got %v and %v", eastEC2.calls, westEC2.calls)
+	}
+	newManager(InstanceTypeSourceFile)
+	if eastEC2.calls["DescribeInstanceTypeOfferings"] != 2 || westEC2.calls["DescribeInstanceTypeOfferings"] != 2 {
+		t.Errorf("expected the offerings to be described again for another source, got %v and %v", eastEC2.calls, westEC2.calls)
+	}
+}
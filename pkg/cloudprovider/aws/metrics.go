@@ -0,0 +1,46 @@
+package aws
+
+import "expvar"
+
+// Gauges of the number of instances of each ASG keyed by ASG name, updated on every
+// refresh. They are published by expvar, under /debug/vars of the default HTTP mux.
+var (
+	// placeholderInstancesGauge counts the placeholders of the instances requested from
+	// an ASG that haven't been launched yet; placeholders persisting for long point at
+	// capacity problems
+	placeholderInstancesGauge = expvar.NewMap("aws_asg_placeholder_instances")
+	// instancesGauge counts the instances that have been launched
+	instancesGauge = expvar.NewMap("aws_asg_instances")
+)
+
+// publishInstanceCounts sets the instance count gauges of the registered ASGs and
+// removes the ones of the ASGs no longer registered.
+func (m *asgCache) publishInstanceCounts() {
+	published := make(map[string]bool, len(m.registeredAsgs))
+	for ref := range m.registeredAsgs {
+		placeholders, instances := 0, 0
+		for _, instance := range m.asgToInstances[ref] {
+			if m.isPlaceholderInstance(&instance) {
+				placeholders++
+			} else {
+				instances++
+			}
+		}
+		setGauge(placeholderInstancesGauge, ref.Id(), placeholders)
+		setGauge(instancesGauge, ref.Id(), instances)
+		published[ref.Id()] = true
+	}
+	for name := range m.publishedGauges {
+		if !published[name] {
+			placeholderInstancesGauge.Delete(name)
+			instancesGauge.Delete(name)
+		}
+	}
+	m.publishedGauges = published
+}
+
+func setGauge(gauge *expvar.Map, key string, value int) {
+	v := new(expvar.Int)
+	v.Set(int64(value))
+	gauge.Set(key, v)
+}
@@ -0,0 +1,48 @@
+package aws
+
+import (
+	"context"
+	"expvar"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// gaugeValue returns the value of the gauge of the ASG, or -1 if it has none.
+func gaugeValue(gauge *expvar.Map, asgName string) int64 {
+	v, ok := gauge.Get(asgName).(*expvar.Int)
+	if !ok {
+		return -1
+	}
+	return v.Value()
+}
+
+func TestPublishInstanceCounts(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{
+		testGroup("gauges-1", 0, 3, 5, "i-1"),
+		testGroup("gauges-2", 0, 1, 5, "i-2"),
+	}}
+	manager := newTestManager(t, autoScaling, nil)
+
+	for name, expected := range map[string][2]int64{"gauges-1": {2, 1}, "gauges-2": {0, 1}} {
+		if placeholders, instances := gaugeValue(placeholderInstancesGauge, name), gaugeValue(instancesGauge, name); placeholders != expected[0] || instances != expected[1] {
+			t.Errorf("%s: expected %d placeholders and %d instances, got %d and %d", name, expected[0], expected[1], placeholders, instances)
+		}
+	}
+
+	// The instances are launched and the other ASG is deleted
+	autoScaling.mutex.Lock()
+	autoScaling.groups = autoScaling.groups[:1]
+	autoScaling.groups[0].Instances = append(autoScaling.groups[0].Instances, testInstance("i-3"), testInstance("i-4"))
+	autoScaling.mutex.Unlock()
+	if err := manager.forceRefresh(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if placeholders, instances := gaugeValue(placeholderInstancesGauge, "gauges-1"), gaugeValue(instancesGauge, "gauges-1"); placeholders != 0 || instances != 3 {
+		t.Errorf("expected 0 placeholders and 3 instances, got %d and %d", placeholders, instances)
+	}
+	if placeholders, instances := gaugeValue(placeholderInstancesGauge, "gauges-2"), gaugeValue(instancesGauge, "gauges-2"); placeholders != -1 || instances != -1 {
+		t.Errorf("expected the gauges of the deleted ASG to be removed, got %d and %d", placeholders, instances)
+	}
+}
@@ -0,0 +1,137 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// priceRetryInterval is how long the prices of a region that failed to load aren't
+// loaded again, so a failing loader isn't called for every node group.
+const priceRetryInterval = 5 * time.Minute
+
+// ErrPriceUnavailable is returned when the price of the instance type of a node group
+// isn't known, so the expander can fall back to another strategy.
+var ErrPriceUnavailable = errors.New("price unavailable")
+
+// PriceLoader loads the approximate hourly on-demand price in USD of the EC2 instance
+// types of a region.
+type PriceLoader interface {
+	LoadPrices(ctx context.Context, region string) (map[string]float64, error)
+}
+
+// StaticPriceLoader loads prices from the list compiled into the binary, see
+// StaticPriceListLastUpdateTime. It only knows the prices of common instance types of a
+// few regions.
+type StaticPriceLoader struct{}
+
+// LoadPrices returns a copy of the static prices of the region.
+func (StaticPriceLoader) LoadPrices(_ context.Context, region string) (map[string]float64, error) {
+	static, found := staticOnDemandPrices[region]
+	if !found {
+		return nil, fmt.Errorf("no static prices for region %s", region)
+	}
+	prices := make(map[string]float64, len(static))
+	for instanceType, price := range static {
+		prices[instanceType] = price
+	}
+	return prices, nil
+}
+
+// priceCache caches the prices of each region, loaded on first use and reloaded once
+// they are older than the refresh interval. Prices that fail to reload are kept. Prices
+// are loaded without holding the lock, and callers asking for the prices of a region
+// while they are loading get the previous ones, if any.
+type priceCache struct {
+	mutex           sync.Mutex
+	loader          PriceLoader
+	refreshInterval time.Duration
+	clock           clock.Clock
+	prices          map[string]map[string]float64
+	loadedAt        map[string]time.Time
+	failedAt        map[string]time.Time
+	// loading are the regions whose prices are being loaded
+	loading map[string]bool
+}
+
+func newPriceCache(loader PriceLoader, refreshInterval time.Duration, clock clock.Clock) *priceCache {
+	return &priceCache{
+		loader:          loader,
+		refreshInterval: refreshInterval,
+		clock:           clock,
+		prices:          make(map[string]map[string]float64),
+		loadedAt:        make(map[string]time.Time),
+		failedAt:        make(map[string]time.Time),
+		loading:         make(map[string]bool),
+	}
+}
+
+// price returns the hourly price of the instance type in the region.
+func (c *priceCache) price(ctx context.Context, region, instanceType string) (float64, error) {
+	if c.startLoading(region) {
+		prices, err := c.loader.LoadPrices(ctx, region)
+		c.finishLoading(region, prices, err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	prices, found := c.prices[region]
+	if !found {
+		return 0, fmt.Errorf("%w: no prices loaded for region %s", ErrPriceUnavailable, region)
+	}
+	price, found := prices[instanceType]
+	if !found {
+		return 0, fmt.Errorf("%w: no price for instance type %s in region %s", ErrPriceUnavailable, instanceType, region)
+	}
+	return price, nil
+}
+
+// startLoading returns whether the prices of the region must be loaded, because they are
+// missing or stale, unless loading them failed within priceRetryInterval or they are
+// already being loaded. The caller then loads them and passes them to finishLoading.
+func (c *priceCache) startLoading(region string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.clock.Now()
+	if loadedAt, found := c.loadedAt[region]; found && now.Sub(loadedAt) < c.refreshInterval {
+		return false
+	}
+	if failedAt, found := c.failedAt[region]; found && now.Sub(failedAt) < priceRetryInterval {
+		return false
+	}
+	if c.loading[region] {
+		return false
+	}
+	c.loading[region] = true
+	return true
+}
+
+// finishLoading stores the prices of the region loaded after startLoading, or records
+// that loading them failed.
+func (c *priceCache) finishLoading(region string, prices map[string]float64, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.loading, region)
+	now := c.clock.Now()
+	if err != nil {
+		if _, found := c.prices[region]; found {
+			klog.Warningf("Failed to reload the prices of region %s, keeping the previous ones: %v", region, err)
+		} else {
+			klog.Warningf("Failed to load the prices of region %s: %v", region, err)
+		}
+		c.failedAt[region] = now
+		return
+	}
+	klog.V(2).Infof("Loaded the prices of %d instance types in region %s", len(prices), region)
+	c.prices[region] = prices
+	c.loadedAt[region] = now
+	delete(c.failedAt, region)
+}
@@ -0,0 +1,133 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// fakePriceLoader returns its prices, or its error when set.
+type fakePriceLoader struct {
+	prices map[string]float64
+	err    error
+	loads  int
+}
+
+func (f *fakePriceLoader) LoadPrices(_ context.Context, _ string) (map[string]float64, error) {
+	f.loads++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.prices, nil
+}
+
+func TestPriceCacheRefresh(t *testing.T) {
+	loader := &fakePriceLoader{prices: map[string]float64{"m5.large": 0.096}}
+	clock := clocktesting.NewFakeClock(time.Now())
+	cache := newPriceCache(loader, time.Hour, clock)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name  string
+		step  time.Duration
+		err   error
+		loads int
+	}{
+		{"first use", 0, nil, 1},
+		{"cached", 30 * time.Minute, nil, 1},
+		{"stale prices kept when reloading fails", 31 * time.Minute, errors.New("throttled"), 2},
+		{"reload not retried right away", time.Minute, nil, 2},
+		{"reload retried", priceRetryInterval, nil, 3},
+	} {
+		clock.Step(tc.step)
+		loader.err = tc.err
+		price, err := cache.price(ctx, "us-east-1", "m5.large")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if price != 0.096 || loader.loads != tc.loads {
+			t.Errorf("%s: expected a price of 0.096 after %d loads, got %v after %d loads", tc.name, tc.loads, price, loader.loads)
+		}
+	}
+
+	if _, err := cache.price(ctx, "us-east-1", "m5.xlarge"); !errors.Is(err, ErrPriceUnavailable) {
+		t.Errorf("expected the price of an unknown instance type to be unavailable, got %v", err)
+	}
+	loader.err = errors.New("throttled")
+	if _, err := cache.price(ctx, "eu-west-1", "m5.large"); !errors.Is(err, ErrPriceUnavailable) {
+		t.Errorf("expected the price of a region that failed to load to be unavailable, got %v", err)
+	}
+}
+
+// blockingPriceLoader loads the prices of a region once release is closed, after
+// signaling on started.
+type blockingPriceLoader struct {
+	started chan string
+	release chan struct{}
+}
+
+func (l *blockingPriceLoader) LoadPrices(_ context.Context, region string) (map[string]float64, error) {
+	l.started <- region
+	<-l.release
+	return map[string]float64{"m5.large": 0.096}, nil
+}
+
+func TestPriceCacheLoadsWithoutLock(t *testing.T) {
+	loader := &blockingPriceLoader{started: make(chan string), release: make(chan struct{})}
+	cache := newPriceCache(loader, time.Hour, clocktesting.NewFakeClock(time.Now()))
+	ctx := context.Background()
+
+	loaded := make(chan error)
+	go func() {
+		_, err := cache.price(ctx, "us-east-1", "m5.large")
+		loaded <- err
+	}()
+	<-loader.started
+
+	// The prices of a region being loaded aren't loaded twice, and other callers don't
+	// wait for them
+	if _, err := cache.price(ctx, "us-east-1", "m5.large"); !errors.Is(err, ErrPriceUnavailable) {
+		t.Errorf("expected the prices being loaded to be unavailable, got %v", err)
+	}
+	close(loader.release)
+	if err := <-loaded; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if price, err := cache.price(ctx, "us-east-1", "m5.large"); err != nil || price != 0.096 {
+		t.Errorf("expected a price of 0.096 once loaded, got %v, %v", price, err)
+	}
+}
+
+func TestNodeGroupPrice(t *testing.T) {
+	autoScaling := &fakeAutoScaling{groups: []*autoscaling.Group{
+		testGroup("asg-1", 0, 1, 10, "i-1"),
+		testGroup("asg-2", 0, 1, 10, "i-2"),
+	}}
+	manager := newTestManager(t, autoScaling, nil)
+	stubInstanceTypes(t, map[string]string{"asg-1": "m5.xlarge", "asg-2": "x2iedn.metal"})
+
+	if _, err := testNodeGroup(t, manager, "asg-1").Price(); !errors.Is(err, ErrPriceUnavailable) {
+		t.Errorf("expected prices to be unavailable without a loader, got %v", err)
+	}
+
+	if err := manager.SetPriceLoader(StaticPriceLoader{}, 0); err == nil {
+		t.Error("expected a zero refresh interval to be rejected")
+	}
+	if err := manager.SetPriceLoader(StaticPriceLoader{}, 24*time.Hour); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	price, err := testNodeGroup(t, manager, "asg-1").Price()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if price != 0.192 {
+		t.Errorf("expected the static price 0.192 of m5.xlarge in us-east-1, got %v", price)
+	}
+	if _, err := testNodeGroup(t, manager, "asg-2").Price(); !errors.Is(err, ErrPriceUnavailable) {
+		t.Errorf("expected the price of an instance type missing from the static list to be unavailable, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws/request"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultApiQPS   = 20
+	defaultApiBurst = 40
+)
+
+// rateLimitHandlerName names the handler waiting on the shared rate limiter.
+const rateLimitHandlerName = "intelops-scaler.RateLimit"
+
+// newApiRateLimiter returns the token bucket shared by all the AWS calls of a wrapper,
+// so bursts of calls during a refresh don't trip account-wide throttling.
+func newApiRateLimiter() *rate.Limiter {
+	return rate.NewLimiter(defaultApiQPS, defaultApiBurst)
+}
+
+// addRateLimit makes every request sent with the handlers, including retries, wait for
+// a token of the limiter first. Requests whose context ends while waiting fail.
+func addRateLimit(handlers *request.Handlers, limiter *rate.Limiter) {
+	handlers.Send.PushFrontNamed(request.NamedHandler{
+		Name: rateLimitHandlerName,
+		Fn:   waitForRateLimit(limiter),
+	})
+}
+
+func waitForRateLimit(limiter *rate.Limiter) func(*request.Request) {
+	return func(r *request.Request) {
+		if err := limiter.Wait(r.Context()); err != nil {
+			r.Error = err
+		}
+	}
+}
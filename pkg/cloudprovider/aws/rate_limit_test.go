@@ -0,0 +1,32 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"golang.org/x/time/rate"
+)
+
+func TestWaitForRateLimitSpacesCalls(t *testing.T) {
+	const qps = 50
+	const calls = 6
+	limiter := rate.NewLimiter(qps, 1)
+	handlers := request.Handlers{}
+	addRateLimit(&handlers, limiter)
+
+	start := time.Now()
+	for i := 0; i < calls; i++ {
+		r := &request.Request{}
+		handlers.Send.Run(r)
+		if r.Error != nil {
+			t.Fatalf("call %d failed: %v", i, r.Error)
+		}
+	}
+
+	// The first call takes the burst token, every other one waits for a new token
+	min := time.Duration(calls-1) * time.Second / qps
+	if elapsed := time.Since(start); elapsed < min-5*time.Millisecond {
+		t.Errorf("expected %d calls to take at least %v, took %v", calls, min, elapsed)
+	}
+}
@@ -0,0 +1,166 @@
+package aws
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	kubeReservedTag   = "k8s.io/cluster-autoscaler/node-template/kube-reserved"
+	systemReservedTag = "k8s.io/cluster-autoscaler/node-template/system-reserved"
+	evictionHardTag   = "k8s.io/cluster-autoscaler/node-template/eviction-hard"
+)
+
+// evictionSignalResources are the resources whose allocatable the kubelet lowers by the
+// hard eviction threshold of a signal.
+var evictionSignalResources = map[string]apiv1.ResourceName{
+	"memory.available": apiv1.ResourceMemory,
+	"nodefs.available": apiv1.ResourceEphemeralStorage,
+}
+
+// ignoredEvictionSignals are the eviction signals that don't lower the allocatable.
+var ignoredEvictionSignals = map[string]bool{
+	"imagefs.available":           true,
+	"imagefs.inodesFree":          true,
+	"nodefs.inodesFree":           true,
+	"pid.available":               true,
+	"containerfs.available":       true,
+	"containerfs.inodesFree":      true,
+	"allocatableMemory.available": true,
+}
+
+// Reservations are the resources the kubelet of a node group withholds from pods.
+// They are set with tags in the format of the matching kubelet flags: resource lists
+// such as cpu=100m,memory=256Mi for the reservations, and eviction signals such as
+// memory.available<100Mi,nodefs.available<10% for the hard eviction thresholds.
+type Reservations struct {
+	KubeReserved   apiv1.ResourceList
+	SystemReserved apiv1.ResourceList
+	EvictionHard   apiv1.ResourceList
+	// EvictionHardPercentages are the hard eviction thresholds given as a percentage of
+	// the capacity
+	EvictionHardPercentages map[apiv1.ResourceName]float64
+}
+
+// buildReservationsFromAsg parses the reservation tags of the ASG.
+func buildReservationsFromAsg(asg *asg) (*Reservations, error) {
+	reservations := &Reservations{}
+	for tag, target := range map[string]*apiv1.ResourceList{
+		kubeReservedTag:   &reservations.KubeReserved,
+		systemReservedTag: &reservations.SystemReserved,
+	} {
+		value, found := asg.tagValue(tag)
+		if !found {
+			*target = apiv1.ResourceList{}
+			continue
+		}
+		list, err := parseResourceList(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s tag on ASG %q: %v", tag, asg.Name, err)
+		}
+		*target = list
+	}
+
+	value, _ := asg.tagValue(evictionHardTag)
+	evictionHard, percentages, err := parseEvictionHard(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s tag on ASG %q: %v", evictionHardTag, asg.Name, err)
+	}
+	reservations.EvictionHard = evictionHard
+	reservations.EvictionHardPercentages = percentages
+	return reservations, nil
+}
+
+// parseEvictionHard parses hard eviction thresholds in the kubelet format, e.g.
+// memory.available<100Mi,nodefs.available<10%, into the thresholds of the resources of
+// their signals, as quantities or percentages of the capacity.
+func parseEvictionHard(value string) (apiv1.ResourceList, map[apiv1.ResourceName]float64, error) {
+	list := apiv1.ResourceList{}
+	percentages := make(map[apiv1.ResourceName]float64)
+	for _, threshold := range strings.Split(value, ",") {
+		threshold = strings.TrimSpace(threshold)
+		if threshold == "" {
+			continue
+		}
+		parts := strings.SplitN(threshold, "<", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("invalid eviction threshold %q, expected e.g. memory.available<100Mi", threshold)
+		}
+		signal, amount := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		name, found := evictionSignalResources[signal]
+		if !found {
+			if ignoredEvictionSignals[signal] {
+				continue
+			}
+			return nil, nil, fmt.Errorf("unknown eviction signal %q", signal)
+		}
+		if percentage, isPercentage := strings.CutSuffix(amount, "%"); isPercentage {
+			parsed, err := strconv.ParseFloat(percentage, 64)
+			if err != nil || parsed < 0 || parsed > 100 {
+				return nil, nil, fmt.Errorf("invalid percentage of eviction signal %s: %q", signal, amount)
+			}
+			percentages[name] = parsed
+			continue
+		}
+		quantity, err := resource.ParseQuantity(amount)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid quantity of eviction signal %s: %v", signal, err)
+		}
+		list[name] = quantity
+	}
+	return list, percentages, nil
+}
+
+// parseResourceList parses a list of resources in format <name>=<quantity>,...
+func parseResourceList(value string) (apiv1.ResourceList, error) {
+	list := apiv1.ResourceList{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid resource %q, expected <name>=<quantity>", pair)
+		}
+		quantity, err := resource.ParseQuantity(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantity of resource %s: %v", kv[0], err)
+		}
+		list[apiv1.ResourceName(strings.TrimSpace(kv[0]))] = quantity
+	}
+	return list, nil
+}
+
+// allocatable returns the capacity left to pods once the reservations are subtracted.
+func (r *Reservations) allocatable(capacity apiv1.ResourceList) apiv1.ResourceList {
+	evictionHard := apiv1.ResourceList{}
+	for name, quantity := range r.EvictionHard {
+		evictionHard[name] = quantity
+	}
+	for name, percentage := range r.EvictionHardPercentages {
+		if value, found := capacity[name]; found {
+			evictionHard[name] = *resource.NewQuantity(int64(float64(value.Value())*percentage/100), value.Format)
+		}
+	}
+
+	allocatable := capacity.DeepCopy()
+	for _, reserved := range []apiv1.ResourceList{r.KubeReserved, r.SystemReserved, evictionHard} {
+		for name, quantity := range reserved {
+			value, found := allocatable[name]
+			if !found {
+				continue
+			}
+			value.Sub(quantity)
+			if value.Sign() < 0 {
+				value = *resource.NewQuantity(0, value.Format)
+			}
+			allocatable[name] = value
+		}
+	}
+	return allocatable
+}
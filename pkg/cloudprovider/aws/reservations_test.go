@@ -0,0 +1,110 @@
+package aws
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestReservationsMatchTags(t *testing.T) {
+	stubInstanceTypes(t, map[string]string{"asg-1": "m5.xlarge"})
+	group := testGroup("asg-1", 0, 0, 5)
+	withTag(group, kubeReservedTag, "cpu=100m,memory=512Mi")
+	withTag(group, systemReservedTag, "cpu=50m")
+	withTag(group, evictionHardTag, "memory.available<100Mi, nodefs.available<10%,pid.available<1k")
+	withTag(group, ephemeralStorageTag, "20Gi")
+	manager := newTestManager(t, &fakeAutoScaling{groups: []*autoscaling.Group{group}}, nil)
+	nodeGroup := testNodeGroup(t, manager, "asg-1")
+
+	reservations, err := nodeGroup.Reservations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]apiv1.ResourceList{
+		"kube-reserved":   {apiv1.ResourceCPU: resource.MustParse("100m"), apiv1.ResourceMemory: resource.MustParse("512Mi")},
+		"system-reserved": {apiv1.ResourceCPU: resource.MustParse("50m")},
+		"eviction-hard":   {apiv1.ResourceMemory: resource.MustParse("100Mi")},
+	}
+	for name, reported := range map[string]apiv1.ResourceList{
+		"kube-reserved":   reservations.KubeReserved,
+		"system-reserved": reservations.SystemReserved,
+		"eviction-hard":   reservations.EvictionHard,
+	} {
+		if len(reported) != len(expected[name]) {
+			t.Errorf("expected %s %v, got %v", name, expected[name], reported)
+			continue
+		}
+		for resourceName, quantity := range expected[name] {
+			if value := reported[resourceName]; value.Cmp(quantity) != 0 {
+				t.Errorf("expected %s %s of %s, got %s", name, resourceName, quantity.String(), value.String())
+			}
+		}
+	}
+
+	// The template allocatable is the capacity minus the reported reservations
+	node, err := nodeGroup.TemplateNode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cpu := node.Status.Allocatable[apiv1.ResourceCPU]; cpu.MilliValue() != 4000-150 {
+		t.Errorf("expected 3850m allocatable CPU, got %s", cpu.String())
+	}
+	if memory := node.Status.Allocatable[apiv1.ResourceMemory]; memory.Value() != (16384-512-100)*1024*1024 {
+		t.Errorf("expected 15772Mi allocatable memory, got %s", memory.String())
+	}
+	if storage := node.Status.Allocatable[apiv1.ResourceEphemeralStorage]; storage.Value() != 18*1024*1024*1024 {
+		t.Errorf("expected 18Gi allocatable ephemeral storage, got %s", storage.String())
+	}
+}
+
+func TestParseEvictionHard(t *testing.T) {
+	for _, tc := range []struct {
+		value       string
+		expected    apiv1.ResourceList
+		percentages map[apiv1.ResourceName]float64
+		err         string
+	}{
+		{value: "", expected: apiv1.ResourceList{}, percentages: map[apiv1.ResourceName]float64{}},
+		{
+			value:       "memory.available<500Mi,nodefs.available<15%,imagefs.available<15%",
+			expected:    apiv1.ResourceList{apiv1.ResourceMemory: resource.MustParse("500Mi")},
+			percentages: map[apiv1.ResourceName]float64{apiv1.ResourceEphemeralStorage: 15},
+		},
+		// Resource lists are not eviction thresholds
+		{value: "memory=100Mi", err: "invalid eviction threshold"},
+		{value: "cpu.available<100m", err: "unknown eviction signal"},
+		{value: "memory.available<lots", err: "invalid quantity"},
+		{value: "nodefs.available<150%", err: "invalid percentage"},
+	} {
+		list, percentages, err := parseEvictionHard(tc.value)
+		if tc.err != "" {
+			if !errorContains(err, tc.err) {
+				t.Errorf("%q: expected an error containing %q, got %v", tc.value, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.value, err)
+			continue
+		}
+		if !quantitiesEqual(list, tc.expected) || !reflect.DeepEqual(percentages, tc.percentages) {
+			t.Errorf("%q: expected %v and %v, got %v and %v", tc.value, tc.expected, tc.percentages, list, percentages)
+		}
+	}
+}
+
+// quantitiesEqual returns whether the resource lists have the same quantities.
+func quantitiesEqual(list, other apiv1.ResourceList) bool {
+	if len(list) != len(other) {
+		return false
+	}
+	for name, quantity := range list {
+		if otherQuantity, found := other[name]; !found || quantity.Cmp(otherQuantity) != 0 {
+			return false
+		}
+	}
+	return true
+}
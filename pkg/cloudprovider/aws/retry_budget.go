@@ -0,0 +1,80 @@
+package aws
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultRefreshRetryBudget = 100
+)
+
+// retryBudget caps the total number of retries issued by all AWS calls sharing it.
+// It is reset on every refresh, so a single slow refresh can't issue unbounded retries.
+type retryBudget struct {
+	mutex     sync.Mutex
+	max       int
+	remaining int
+}
+
+func newRetryBudget(max int) *retryBudget {
+	return &retryBudget{
+		max:       max,
+		remaining: max,
+	}
+}
+
+// take consumes a retry from the budget. It returns false once the budget is exhausted.
+func (b *retryBudget) take() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.remaining <= 0 {
+		return false
+	}
+	b.remaining--
+	return true
+}
+
+func (b *retryBudget) reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.remaining = b.max
+}
+
+func (b *retryBudget) setMax(max int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.max = max
+	b.remaining = max
+}
+
+// budgetedRetryer is an AWS SDK retryer that stops retrying once its budget is exhausted.
+type budgetedRetryer struct {
+	client.DefaultRetryer
+	budget *retryBudget
+}
+
+func newBudgetedRetryer(budget *retryBudget) request.Retryer {
+	return budgetedRetryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: client.DefaultRetryerMaxNumRetries},
+		budget:         budget,
+	}
+}
+
+// ShouldRetry returns true if the request should be retried and the budget allows it.
+func (r budgetedRetryer) ShouldRetry(req *request.Request) bool {
+	if !r.DefaultRetryer.ShouldRetry(req) {
+		return false
+	}
+	if !r.budget.take() {
+		klog.Warningf("Retry budget exhausted, not retrying %s: %v", req.Operation.Name, req.Error)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package aws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRefreshFailsOnceRetryBudgetIsExhausted(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	setFakeCredentials(t)
+	sess, err := createAWSSDKSession("us-east-1", []serviceOverride{{
+		Service: "autoscaling",
+		Region:  "us-east-1",
+		URL:     server.URL,
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	manager, err := newAwsManager(newAwsWrapper(sess), InstanceTypes, InstanceTypeSourceStatic, []string{testAutoDiscoverySpec})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := manager.SetRefreshRetryBudget(2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for refresh := 1; refresh <= 2; refresh++ {
+		if err := manager.forceRefresh(context.Background()); err == nil {
+			t.Fatalf("expected refresh %d to fail", refresh)
+		}
+		// Every refresh gets the whole budget: the first attempt and 2 retries
+		if got := requests.Load(); got != int32(3*refresh) {
+			t.Errorf("expected %d requests after refresh %d, got %d", 3*refresh, refresh, got)
+		}
+	}
+}
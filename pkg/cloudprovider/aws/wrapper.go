@@ -1,29 +1,705 @@
 package aws
 
 import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/eks"
+	"golang.org/x/time/rate"
+	apiv1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
 )
 
 // autoScalingI is the interface abstracting specific API calls of the auto-scaling service provided by AWS SDK for use in CA
 type autoScalingI interface {
-	DescribeAutoScalingGroupsPages(input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool) error
+	AttachInstancesWithContext(ctx aws.Context, input *autoscaling.AttachInstancesInput, opts ...request.Option) (*autoscaling.AttachInstancesOutput, error)
+	CompleteLifecycleActionWithContext(ctx aws.Context, input *autoscaling.CompleteLifecycleActionInput, opts ...request.Option) (*autoscaling.CompleteLifecycleActionOutput, error)
+	DescribeAutoScalingGroupsPagesWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool, opts ...request.Option) error
+	DescribeAutoScalingInstancesPagesWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingInstancesInput, fn func(*autoscaling.DescribeAutoScalingInstancesOutput, bool) bool, opts ...request.Option) error
 	DescribeLaunchConfigurations(*autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error)
-	DescribeScalingActivities(*autoscaling.DescribeScalingActivitiesInput) (*autoscaling.DescribeScalingActivitiesOutput, error)
-	SetDesiredCapacity(input *autoscaling.SetDesiredCapacityInput) (*autoscaling.SetDesiredCapacityOutput, error)
-	TerminateInstanceInAutoScalingGroup(input *autoscaling.TerminateInstanceInAutoScalingGroupInput) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error)
+	DescribeLifecycleHooksWithContext(ctx aws.Context, input *autoscaling.DescribeLifecycleHooksInput, opts ...request.Option) (*autoscaling.DescribeLifecycleHooksOutput, error)
+	DescribeScalingActivitiesWithContext(ctx aws.Context, input *autoscaling.DescribeScalingActivitiesInput, opts ...request.Option) (*autoscaling.DescribeScalingActivitiesOutput, error)
+	DetachInstancesWithContext(ctx aws.Context, input *autoscaling.DetachInstancesInput, opts ...request.Option) (*autoscaling.DetachInstancesOutput, error)
+	DescribeWarmPoolPagesWithContext(ctx aws.Context, input *autoscaling.DescribeWarmPoolInput, fn func(*autoscaling.DescribeWarmPoolOutput, bool) bool, opts ...request.Option) error
+	ResumeProcessesWithContext(ctx aws.Context, input *autoscaling.ScalingProcessQuery, opts ...request.Option) (*autoscaling.ResumeProcessesOutput, error)
+	SetDesiredCapacityWithContext(ctx aws.Context, input *autoscaling.SetDesiredCapacityInput, opts ...request.Option) (*autoscaling.SetDesiredCapacityOutput, error)
+	SuspendProcessesWithContext(ctx aws.Context, input *autoscaling.ScalingProcessQuery, opts ...request.Option) (*autoscaling.SuspendProcessesOutput, error)
+	TerminateInstanceInAutoScalingGroupWithContext(ctx aws.Context, input *autoscaling.TerminateInstanceInAutoScalingGroupInput, opts ...request.Option) (*autoscaling.TerminateInstanceInAutoScalingGroupOutput, error)
+}
+
+// ec2I is the interface abstracting specific API calls of the EC2 service provided by AWS SDK for use in CA
+type ec2I interface {
+	CreateFleetWithContext(ctx aws.Context, input *ec2.CreateFleetInput, opts ...request.Option) (*ec2.CreateFleetOutput, error)
+	TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error)
+	CreateTagsWithContext(ctx aws.Context, input *ec2.CreateTagsInput, opts ...request.Option) (*ec2.CreateTagsOutput, error)
+	DescribeInstancesPagesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool, opts ...request.Option) error
+	DescribeLaunchTemplateVersionsWithContext(ctx aws.Context, input *ec2.DescribeLaunchTemplateVersionsInput, opts ...request.Option) (*ec2.DescribeLaunchTemplateVersionsOutput, error)
+	DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstanceTypeOfferingsPages(input *ec2.DescribeInstanceTypeOfferingsInput, fn func(*ec2.DescribeInstanceTypeOfferingsOutput, bool) bool) error
+	DescribeInstanceTypesPages(input *ec2.DescribeInstanceTypesInput, fn func(*ec2.DescribeInstanceTypesOutput, bool) bool) error
+}
+
+// eksI is the interface abstracting specific API calls of the EKS service provided by AWS SDK for use in CA
+type eksI interface {
+	DescribeNodegroupWithContext(ctx aws.Context, input *eks.DescribeNodegroupInput, opts ...request.Option) (*eks.DescribeNodegroupOutput, error)
 }
 
 // awsWrapper provides several utility methods over the services provided by the AWS SDK
 type awsWrapper struct {
 	autoScalingI
+	ec2I
+	eksI
+
+	// retryBudget is shared by the retries of all the AWS calls, may be nil
+	retryBudget *retryBudget
+	// rateLimiter is shared by all the AWS calls, retries included, may be nil
+	rateLimiter *rate.Limiter
+	// region the AWS services are called in, may be empty
+	region string
 }
 
 func (m *awsWrapper) getInstanceTypesForAsgs(asgs []*asg) (map[string]string, error) {
 	return nil, nil
 }
 
-func (m *awsWrapper) getAutoscalingGroupsByNames(names []string) ([]*autoscaling.Group, error) {
-	return nil, nil
+// getAutoscalingGroupsByNames describes the named ASGs, failing if any batch can't be described.
+func (m *awsWrapper) getAutoscalingGroupsByNames(ctx context.Context, names []string) ([]*autoscaling.Group, error) {
+	asgs := make([]*autoscaling.Group, 0)
+	if len(names) == 0 {
+		return asgs, nil
+	}
+
+	// AWS only accepts up to 100 ASG names as input, describe them in batches
+	for i := 0; i < len(names); i += maxAsgNamesPerDescribe {
+		end := i + maxAsgNamesPerDescribe
+
+		if end > len(names) {
+			end = len(names)
+		}
+
+		input := &autoscaling.DescribeAutoScalingGroupsInput{
+			AutoScalingGroupNames: aws.StringSlice(names[i:end]),
+			MaxRecords:            aws.Int64(maxRecordsReturnedByAPI),
+		}
+		// The pager follows NextToken until the last page, MaxRecords only bounds the page size
+		err := m.DescribeAutoScalingGroupsPagesWithContext(ctx, input, func(output *autoscaling.DescribeAutoScalingGroupsOutput, _ bool) bool {
+			asgs = append(asgs, output.AutoScalingGroups...)
+			// We return true while we want to be called with the next page of
+			// results, if any.
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return asgs, nil
+}
+
+// getAutoscalingGroupsByNamesIsolatingFailures is like getAutoscalingGroupsByNames, but
+// describes the ASGs of a failed batch one by one, so that a single ASG that can't be
+// described doesn't hide the others. The described ASGs are returned along with the error.
+func (m *awsWrapper) getAutoscalingGroupsByNamesIsolatingFailures(ctx context.Context, names []string) ([]*autoscaling.Group, error) {
+	asgs := make([]*autoscaling.Group, 0)
+	var errs []error
+	for i := 0; i < len(names); i += maxAsgNamesPerDescribe {
+		end := i + maxAsgNamesPerDescribe
+		if end > len(names) {
+			end = len(names)
+		}
+
+		batch, err := m.getAutoscalingGroupsByNames(ctx, names[i:end])
+		if err == nil {
+			asgs = append(asgs, batch...)
+			continue
+		}
+		if end-i == 1 {
+			errs = append(errs, fmt.Errorf("failed to describe ASG %s: %v", names[i], err))
+			continue
+		}
+
+		klog.Warningf("Failed to describe %d ASGs at once, describing them one by one: %v", end-i, err)
+		for _, name := range names[i:end] {
+			groups, err := m.getAutoscalingGroupsByNames(ctx, []string{name})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to describe ASG %s: %v", name, err))
+				continue
+			}
+			asgs = append(asgs, groups...)
+		}
+	}
+
+	return asgs, utilerrors.NewAggregate(errs)
+}
+
+func (m *awsWrapper) getAutoscalingGroupsByTags(ctx context.Context, tags map[string]string) ([]*autoscaling.Group, error) {
+	asgs := make([]*autoscaling.Group, 0)
+	if len(tags) == 0 {
+		return asgs, nil
+	}
+
+	filters := make([]*autoscaling.Filter, 0)
+	for key, value := range tags {
+		if value != "" {
+			filters = append(filters, &autoscaling.Filter{
+				Name:   aws.String(fmt.Sprintf("tag:%s", key)),
+				Values: []*string{aws.String(value)},
+			})
+		} else {
+			filters = append(filters, &autoscaling.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(key)},
+			})
+		}
+	}
+
+	input := &autoscaling.DescribeAutoScalingGroupsInput{
+		Filters:    filters,
+		MaxRecords: aws.Int64(maxRecordsReturnedByAPI),
+	}
+
+	// AWS applies the filters, the ASGs are checked again here in case the endpoint
+	// ignored some of them, e.g. an API compatible mock or proxy.
+	err := m.DescribeAutoScalingGroupsPagesWithContext(ctx, input, func(output *autoscaling.DescribeAutoScalingGroupsOutput, _ bool) bool {
+		for _, group := range output.AutoScalingGroups {
+			if asgHasTags(group, tags) {
+				asgs = append(asgs, group)
+			}
+		}
+		// We return true while we want to be called with the next page of
+		// results, if any.
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return asgs, nil
+}
+
+// getAutoScalingInstances describes the given ASG instances by instance ID. Instances
+// that aren't part of an ASG are omitted.
+func (m *awsWrapper) getAutoScalingInstances(ctx context.Context, instanceIds []string) (map[string]*autoscaling.InstanceDetails, error) {
+	instances := make(map[string]*autoscaling.InstanceDetails, len(instanceIds))
+
+	// AWS only accepts up to 50 instance IDs as input, describe them in batches
+	for i := 0; i < len(instanceIds); i += maxInstanceIdsPerDescribe {
+		end := i + maxInstanceIdsPerDescribe
+		if end > len(instanceIds) {
+			end = len(instanceIds)
+		}
+
+		input := &autoscaling.DescribeAutoScalingInstancesInput{
+			InstanceIds: aws.StringSlice(instanceIds[i:end]),
+		}
+		err := m.DescribeAutoScalingInstancesPagesWithContext(ctx, input, func(output *autoscaling.DescribeAutoScalingInstancesOutput, _ bool) bool {
+			for _, instance := range output.AutoScalingInstances {
+				instances[aws.StringValue(instance.InstanceId)] = instance
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return instances, nil
+}
+
+// launchInstantFleet launches count on-demand instances from the launch template in one
+// of the given subnets, with an instant fleet that only launches instances if all of
+// them can be. The IDs of the launched instances are returned along with any error.
+func (m *awsWrapper) launchInstantFleet(ctx context.Context, launchTemplate *launchTemplate, subnetIds []string, count int) ([]string, error) {
+	config := &ec2.FleetLaunchTemplateConfigRequest{
+		LaunchTemplateSpecification: &ec2.FleetLaunchTemplateSpecificationRequest{
+			LaunchTemplateName: aws.String(launchTemplate.name),
+			Version:            aws.String(launchTemplate.version),
+		},
+	}
+	for _, subnetId := range subnetIds {
+		config.Overrides = append(config.Overrides, &ec2.FleetLaunchTemplateOverridesRequest{SubnetId: aws.String(subnetId)})
+	}
+
+	output, err := m.CreateFleetWithContext(ctx, &ec2.CreateFleetInput{
+		Type:                  aws.String(ec2.FleetTypeInstant),
+		LaunchTemplateConfigs: []*ec2.FleetLaunchTemplateConfigRequest{config},
+		TargetCapacitySpecification: &ec2.TargetCapacitySpecificationRequest{
+			TotalTargetCapacity:       aws.Int64(int64(count)),
+			DefaultTargetCapacityType: aws.String(ec2.DefaultTargetCapacityTypeOnDemand),
+		},
+		// The minimum capacity makes the fleet all-or-nothing, it requires a single
+		// instance type and zone
+		OnDemandOptions: &ec2.OnDemandOptionsRequest{
+			MinTargetCapacity:      aws.Int64(int64(count)),
+			SingleInstanceType:     aws.Bool(true),
+			SingleAvailabilityZone: aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	instanceIds := []string{}
+	for _, instance := range output.Instances {
+		instanceIds = append(instanceIds, aws.StringValueSlice(instance.InstanceIds)...)
+	}
+	if len(instanceIds) < count {
+		reasons := []string{}
+		for _, fleetErr := range output.Errors {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", aws.StringValue(fleetErr.ErrorCode), aws.StringValue(fleetErr.ErrorMessage)))
+		}
+		return instanceIds, fmt.Errorf("fleet launched %d of %d instances: %s", len(instanceIds), count, strings.Join(reasons, "; "))
+	}
+	return instanceIds, nil
+}
+
+// terminateInstances terminates the given EC2 instances, which aren't part of an ASG.
+func (m *awsWrapper) terminateInstances(ctx context.Context, instanceIds []string) error {
+	_, err := m.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: aws.StringSlice(instanceIds),
+	})
+	return err
+}
+
+// resumeProcesses resumes the given scaling processes of the ASG.
+func (m *awsWrapper) resumeProcesses(ctx context.Context, asgName string, processes []string) error {
+	_, err := m.ResumeProcessesWithContext(ctx, &autoscaling.ScalingProcessQuery{
+		AutoScalingGroupName: aws.String(asgName),
+		ScalingProcesses:     aws.StringSlice(processes),
+	})
+	return err
+}
+
+// suspendProcesses suspends the given scaling processes of the ASG.
+func (m *awsWrapper) suspendProcesses(ctx context.Context, asgName string, processes []string) error {
+	_, err := m.SuspendProcessesWithContext(ctx, &autoscaling.ScalingProcessQuery{
+		AutoScalingGroupName: aws.String(asgName),
+		ScalingProcesses:     aws.StringSlice(processes),
+	})
+	return err
+}
+
+// getEksNodegroup describes the EKS managed node group of the cluster.
+func (m *awsWrapper) getEksNodegroup(ctx context.Context, clusterName, nodegroupName string) (*eks.Nodegroup, error) {
+	output, err := m.DescribeNodegroupWithContext(ctx, &eks.DescribeNodegroupInput{
+		ClusterName:   aws.String(clusterName),
+		NodegroupName: aws.String(nodegroupName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.Nodegroup == nil {
+		return nil, fmt.Errorf("node group %s of EKS cluster %s not found", nodegroupName, clusterName)
+	}
+	return output.Nodegroup, nil
+}
+
+// getTerminationLifecycleHooks returns the names of the lifecycle hooks of the ASG that
+// hold terminating instances.
+func (m *awsWrapper) getTerminationLifecycleHooks(ctx context.Context, asgName string) ([]string, error) {
+	output, err := m.DescribeLifecycleHooksWithContext(ctx, &autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: aws.String(asgName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	hooks := []string{}
+	for _, hook := range output.LifecycleHooks {
+		if aws.StringValue(hook.LifecycleTransition) == "autoscaling:EC2_INSTANCE_TERMINATING" {
+			hooks = append(hooks, aws.StringValue(hook.LifecycleHookName))
+		}
+	}
+	return hooks, nil
+}
+
+// tagInstance sets the given tags on the EC2 instance.
+func (m *awsWrapper) tagInstance(ctx context.Context, instanceId string, tags map[string]string) error {
+	input := &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(instanceId)},
+	}
+	for key, value := range tags {
+		input.Tags = append(input.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	_, err := m.CreateTagsWithContext(ctx, input)
+	return err
+}
+
+// asgHasTags returns whether the ASG has all the tag keys, with the same value for the
+// tags with a non-empty value.
+func asgHasTags(group *autoscaling.Group, tags map[string]string) bool {
+	groupTags := make(map[string]string, len(group.Tags))
+	for _, tag := range group.Tags {
+		groupTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	for key, value := range tags {
+		groupValue, found := groupTags[key]
+		if !found || (value != "" && groupValue != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *awsWrapper) getAutoscalingGroupsByNamePatterns(ctx context.Context, patterns []*regexp.Regexp) ([]*autoscaling.Group, error) {
+	asgs := make([]*autoscaling.Group, 0)
+	if len(patterns) == 0 {
+		return asgs, nil
+	}
+
+	// Name patterns can't be expressed as API filters, describe all ASGs and match them here
+	input := &autoscaling.DescribeAutoScalingGroupsInput{
+		MaxRecords: aws.Int64(maxRecordsReturnedByAPI),
+	}
+
+	err := m.DescribeAutoScalingGroupsPagesWithContext(ctx, input, func(output *autoscaling.DescribeAutoScalingGroupsOutput, _ bool) bool {
+		for _, group := range output.AutoScalingGroups {
+			name := aws.StringValue(group.AutoScalingGroupName)
+			for _, pattern := range patterns {
+				if pattern.MatchString(name) {
+					asgs = append(asgs, group)
+					break
+				}
+			}
+		}
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return asgs, nil
+}
+
+func (m *awsWrapper) getWarmPoolInstanceIds(ctx context.Context, asgName string) (map[string]bool, error) {
+	instanceIds := make(map[string]bool)
+
+	input := &autoscaling.DescribeWarmPoolInput{
+		AutoScalingGroupName: aws.String(asgName),
+	}
+
+	err := m.DescribeWarmPoolPagesWithContext(ctx, input, func(output *autoscaling.DescribeWarmPoolOutput, _ bool) bool {
+		for _, instance := range output.Instances {
+			instanceIds[aws.StringValue(instance.InstanceId)] = true
+		}
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return instanceIds, nil
+}
+
+// getInstanceTags returns the tags with the given keys of the given instances, keyed by
+// instance ID. Instances without any of the tags are omitted.
+func (m *awsWrapper) getInstanceTags(ctx context.Context, instanceIds []string, keys []string) (map[string]map[string]string, error) {
+	tags := make(map[string]map[string]string)
+	if len(instanceIds) == 0 || len(keys) == 0 {
+		return tags, nil
+	}
+
+	// Filters don't fail on unknown instances, unlike InstanceIds, but are limited in size
+	for i := 0; i < len(instanceIds); i += maxInstanceIdsPerFilter {
+		end := i + maxInstanceIdsPerFilter
+		if end > len(instanceIds) {
+			end = len(instanceIds)
+		}
+
+		input := &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				{Name: aws.String("instance-id"), Values: aws.StringSlice(instanceIds[i:end])},
+				{Name: aws.String("tag-key"), Values: aws.StringSlice(keys)},
+			},
+		}
+		err := m.DescribeInstancesPagesWithContext(ctx, input, func(output *ec2.DescribeInstancesOutput, _ bool) bool {
+			for _, reservation := range output.Reservations {
+				for _, instance := range reservation.Instances {
+					instanceTags := make(map[string]string)
+					for _, tag := range instance.Tags {
+						for _, key := range keys {
+							if aws.StringValue(tag.Key) == key {
+								instanceTags[key] = aws.StringValue(tag.Value)
+							}
+						}
+					}
+					tags[aws.StringValue(instance.InstanceId)] = instanceTags
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tags, nil
+}
+
+// getInstanceRefByPrivateDnsName returns the instance with the given private DNS name,
+// or nil if there is none.
+func (m *awsWrapper) getInstanceRefByPrivateDnsName(ctx context.Context, dnsName string) (*AwsInstanceRef, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("private-dns-name"),
+			Values: []*string{aws.String(dnsName)},
+		}},
+	}
+	var ref *AwsInstanceRef
+	err := m.DescribeInstancesPagesWithContext(ctx, input, func(output *ec2.DescribeInstancesOutput, _ bool) bool {
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.State != nil && aws.StringValue(instance.State.Name) == ec2.InstanceStateNameTerminated {
+					continue
+				}
+				zone := ""
+				if instance.Placement != nil {
+					zone = aws.StringValue(instance.Placement.AvailabilityZone)
+				}
+				ref = &AwsInstanceRef{
+					ProviderID: fmt.Sprintf("aws:///%s/%s", zone, aws.StringValue(instance.InstanceId)),
+					Name:       aws.StringValue(instance.InstanceId),
+				}
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// getInstanceLaunchTimes returns the launch time of the given EC2 instances. Instances
+// that don't exist or are terminating are omitted.
+func (m *awsWrapper) getInstanceLaunchTimes(ctx context.Context, instanceIds []string) (map[string]time.Time, error) {
+	launchTimes := make(map[string]time.Time, len(instanceIds))
+	for i := 0; i < len(instanceIds); i += maxInstanceIdsPerDescribe {
+		end := i + maxInstanceIdsPerDescribe
+		if end > len(instanceIds) {
+			end = len(instanceIds)
+		}
+
+		// Filtering by instance ID rather than listing the IDs doesn't fail on unknown instances
+		input := &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("instance-id"),
+				Values: aws.StringSlice(instanceIds[i:end]),
+			}},
+		}
+		err := m.DescribeInstancesPagesWithContext(ctx, input, func(output *ec2.DescribeInstancesOutput, _ bool) bool {
+			for _, reservation := range output.Reservations {
+				for _, instance := range reservation.Instances {
+					if instance.State != nil && (aws.StringValue(instance.State.Name) == ec2.InstanceStateNameTerminated ||
+						aws.StringValue(instance.State.Name) == ec2.InstanceStateNameShuttingDown) {
+						continue
+					}
+					if instance.LaunchTime != nil {
+						launchTimes[aws.StringValue(instance.InstanceId)] = *instance.LaunchTime
+					}
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return launchTimes, nil
+}
+
+// instanceExists returns whether the EC2 instance exists and isn't terminated.
+func (m *awsWrapper) instanceExists(instanceId string) (bool, error) {
+	output, err := m.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceId)},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidInstanceID.NotFound" {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			if instance.State != nil && aws.StringValue(instance.State.Name) != ec2.InstanceStateNameTerminated {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *awsWrapper) getLaunchTemplateData(ctx context.Context, templateName string, templateVersion string) (*ec2.ResponseLaunchTemplateData, error) {
+	templateVersionData, err := m.describeLaunchTemplateVersion(ctx, templateName, templateVersion)
+	if err != nil {
+		return nil, err
+	}
+	if templateVersionData.LaunchTemplateData == nil {
+		return nil, fmt.Errorf("no data found for launch template %s, version %s", templateName, templateVersion)
+	}
+
+	return templateVersionData.LaunchTemplateData, nil
+}
+
+func (m *awsWrapper) describeLaunchTemplateVersion(ctx context.Context, templateName string, templateVersion string) (*ec2.LaunchTemplateVersion, error) {
+	describeTemplateInput := &ec2.DescribeLaunchTemplateVersionsInput{
+		LaunchTemplateName: aws.String(templateName),
+		Versions:           []*string{aws.String(templateVersion)},
+	}
+
+	describeData, err := m.DescribeLaunchTemplateVersionsWithContext(ctx, describeTemplateInput)
+	if err != nil {
+		return nil, err
+	}
+	if describeData == nil || len(describeData.LaunchTemplateVersions) == 0 {
+		return nil, fmt.Errorf("unable to find template versions for launch template %s", templateName)
+	}
+
+	return describeData.LaunchTemplateVersions[0], nil
+}
+
+// resolveLaunchTemplateVersion returns the version number that $Latest or $Default
+// currently point to. Any other version is returned as is.
+func (m *awsWrapper) resolveLaunchTemplateVersion(ctx context.Context, launchTemplate *launchTemplate) (string, error) {
+	if launchTemplate.version != "$Latest" && launchTemplate.version != "$Default" {
+		return launchTemplate.version, nil
+	}
+
+	templateVersionData, err := m.describeLaunchTemplateVersion(ctx, launchTemplate.name, launchTemplate.version)
+	if err != nil {
+		return "", err
+	}
+	if templateVersionData.VersionNumber == nil {
+		return "", fmt.Errorf("no version number found for launch template %s, version %s", launchTemplate.name, launchTemplate.version)
+	}
+
+	return strconv.FormatInt(*templateVersionData.VersionNumber, 10), nil
+}
+
+// launchTemplateProperties are the properties of a launch template that affect scaling.
+type launchTemplateProperties struct {
+	// capacityReservationTargeted is true when the launched instances target a specific
+	// capacity reservation or capacity reservation group
+	capacityReservationTargeted bool
+	// ipFamily is the primary IP family of the launched instances
+	ipFamily apiv1.IPFamily
+	// rootVolume is the EBS root volume of the launched instances, nil if not set
+	rootVolume *EbsVolume
+}
+
+// getLaunchTemplateProperties describes the launch template and returns the properties
+// of the instances it launches.
+func (m *awsWrapper) getLaunchTemplateProperties(ctx context.Context, launchTemplate *launchTemplate) (launchTemplateProperties, error) {
+	templateData, err := m.getLaunchTemplateData(ctx, launchTemplate.name, launchTemplate.version)
+	if err != nil {
+		return launchTemplateProperties{ipFamily: apiv1.IPv4Protocol}, err
+	}
+
+	props := launchTemplateProperties{
+		ipFamily:   launchTemplateIPFamily(templateData),
+		rootVolume: launchTemplateRootVolume(templateData),
+	}
+	if spec := templateData.CapacityReservationSpecification; spec != nil && spec.CapacityReservationTarget != nil {
+		target := spec.CapacityReservationTarget
+		props.capacityReservationTargeted = target.CapacityReservationId != nil || target.CapacityReservationResourceGroupArn != nil
+	}
+	return props, nil
+}
+
+// launchTemplateIPFamily returns IPv6 when the launch template gives its instances IPv6
+// addresses or prefixes, or enables the IPv6 endpoint of the instance metadata service,
+// as required by nodes of IPv6 EKS clusters. Anything else is assumed to be IPv4.
+func launchTemplateIPFamily(templateData *ec2.ResponseLaunchTemplateData) apiv1.IPFamily {
+	if options := templateData.MetadataOptions; options != nil && aws.StringValue(options.HttpProtocolIpv6) == ec2.LaunchTemplateInstanceMetadataProtocolIpv6Enabled {
+		return apiv1.IPv6Protocol
+	}
+	for _, ni := range templateData.NetworkInterfaces {
+		if aws.Int64Value(ni.Ipv6AddressCount) > 0 || len(ni.Ipv6Addresses) > 0 ||
+			aws.Int64Value(ni.Ipv6PrefixCount) > 0 || len(ni.Ipv6Prefixes) > 0 || aws.BoolValue(ni.PrimaryIpv6) {
+			return apiv1.IPv6Protocol
+		}
+	}
+	return apiv1.IPv4Protocol
+}
+
+// EbsVolume describes the EBS root volume of the instances of an ASG, for callers that
+// take storage performance into account.
+type EbsVolume struct {
+	// VolumeType is e.g. gp3 or io2, empty when the launch template leaves it to the AMI
+	VolumeType string
+	// Iops is the provisioned IOPS, 0 when not set
+	Iops int64
+	// Throughput is the provisioned throughput in MiB/s of gp3 volumes, 0 when not set
+	Throughput int64
+}
+
+// rootDeviceNames are the usual root device names of AMIs: /dev/xvda for Amazon Linux
+// and Bottlerocket, /dev/sda1 for most others.
+var rootDeviceNames = map[string]bool{"/dev/xvda": true, "/dev/sda1": true}
+
+// launchTemplateRootVolume returns the EBS volume the launch template maps to the root
+// device, or nil if it doesn't override the root volume of the AMI. The root device name
+// of the AMI isn't described, so only the usual root device names are recognized.
+func launchTemplateRootVolume(templateData *ec2.ResponseLaunchTemplateData) *EbsVolume {
+	for _, mapping := range templateData.BlockDeviceMappings {
+		if mapping.Ebs == nil || !rootDeviceNames[aws.StringValue(mapping.DeviceName)] {
+			continue
+		}
+		volume := &EbsVolume{
+			VolumeType: aws.StringValue(mapping.Ebs.VolumeType),
+			Iops:       aws.Int64Value(mapping.Ebs.Iops),
+			Throughput: aws.Int64Value(mapping.Ebs.Throughput),
+		}
+		if *volume == (EbsVolume{}) {
+			return nil
+		}
+		return volume
+	}
+	return nil
+}
+
+func buildLaunchTemplateFromSpec(ltSpec *autoscaling.LaunchTemplateSpecification) *launchTemplate {
+	// NOTE(jaypipes): The LaunchTemplateSpecification.Version is a pointer to
+	// string. When the pointer is nil, EC2 AutoScaling API considers the value
+	// to be "$Default", however aws.StringValue(ltSpec.Version) will return an
+	// empty string (which is not considered the same as "$Default" or a nil
+	// string pointer. So, in order to not pass an empty string as the version
+	// for the launch template when we communicate with the EC2 AutoScaling API
+	// using the information in the launchTemplate, we store the string
+	// "$Default" here when the ltSpec.Version is a nil pointer.
+	//
+	// See:
+	//
+	// https://github.com/kubernetes/autoscaler/issues/1728
+	// https://github.com/aws/aws-sdk-go/blob/81fad3b797f4a9bd1b452a5733dd465eefef1060/service/autoscaling/api.go#L10666-L10671
+	//
+	// A cleaner alternative might be to make launchTemplate.version a string
+	// pointer instead of a string, or even store the aws-sdk-go's
+	// LaunchTemplateSpecification structs directly.
+	var version string
+	if ltSpec.Version == nil {
+		version = "$Default"
+	} else {
+		version = aws.StringValue(ltSpec.Version)
+	}
+	return &launchTemplate{
+		name:    aws.StringValue(ltSpec.LaunchTemplateName),
+		version: version,
+	}
 }
 
 /*
@@ -125,80 +801,6 @@ func (m *awsWrapper) getInstanceTypeByLaunchConfigNames(launchConfigToQuery []*s
 	return launchConfigurationsToInstanceType, nil
 }
 
-func (m *awsWrapper) getAutoscalingGroupsByNames(names []string) ([]*autoscaling.Group, error) {
-	asgs := make([]*autoscaling.Group, 0)
-	if len(names) == 0 {
-		return asgs, nil
-	}
-
-	// AWS only accepts up to 100 ASG names as input, describe them in batches
-	for i := 0; i < len(names); i += maxAsgNamesPerDescribe {
-		end := i + maxAsgNamesPerDescribe
-
-		if end > len(names) {
-			end = len(names)
-		}
-
-		input := &autoscaling.DescribeAutoScalingGroupsInput{
-			AutoScalingGroupNames: aws.StringSlice(names[i:end]),
-			MaxRecords:            aws.Int64(maxRecordsReturnedByAPI),
-		}
-		start := time.Now()
-		err := m.DescribeAutoScalingGroupsPages(input, func(output *autoscaling.DescribeAutoScalingGroupsOutput, _ bool) bool {
-			asgs = append(asgs, output.AutoScalingGroups...)
-			// We return true while we want to be called with the next page of
-			// results, if any.
-			return true
-		})
-		observeAWSRequest("DescribeAutoScalingGroupsPages", err, start)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return asgs, nil
-}
-
-func (m *awsWrapper) getAutoscalingGroupsByTags(tags map[string]string) ([]*autoscaling.Group, error) {
-	asgs := make([]*autoscaling.Group, 0)
-	if len(tags) == 0 {
-		return asgs, nil
-	}
-
-	filters := make([]*autoscaling.Filter, 0)
-	for key, value := range tags {
-		if value != "" {
-			filters = append(filters, &autoscaling.Filter{
-				Name:   aws.String(fmt.Sprintf("tag:%s", key)),
-				Values: []*string{aws.String(value)},
-			})
-		} else {
-			filters = append(filters, &autoscaling.Filter{
-				Name:   aws.String("tag-key"),
-				Values: []*string{aws.String(key)},
-			})
-		}
-	}
-
-	input := &autoscaling.DescribeAutoScalingGroupsInput{
-		Filters:    filters,
-		MaxRecords: aws.Int64(0),
-	}
-
-	err := m.DescribeAutoScalingGroupsPages(input, func(output *autoscaling.DescribeAutoScalingGroupsOutput, _ bool) bool {
-		asgs = append(asgs, output.AutoScalingGroups...)
-		// We return true while we want to be called with the next page of
-		// results, if any.
-		return true
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	return asgs, nil
-}
-
 func (m *awsWrapper) getInstanceTypeByLaunchTemplate(launchTemplate *launchTemplate) (string, error) {
 	templateData, err := m.getLaunchTemplateData(launchTemplate.name, launchTemplate.version)
 	if err != nil {
@@ -247,28 +849,6 @@ func (m *awsWrapper) getInstanceTypeFromRequirementsOverrides(policy *mixedInsta
 	return instanceType, nil
 }
 
-func (m *awsWrapper) getLaunchTemplateData(templateName string, templateVersion string) (*ec2.ResponseLaunchTemplateData, error) {
-	describeTemplateInput := &ec2.DescribeLaunchTemplateVersionsInput{
-		LaunchTemplateName: aws.String(templateName),
-		Versions:           []*string{aws.String(templateVersion)},
-	}
-
-	start := time.Now()
-	describeData, err := m.DescribeLaunchTemplateVersions(describeTemplateInput)
-	observeAWSRequest("DescribeLaunchTemplateVersions", err, start)
-	if err != nil {
-		return nil, err
-	}
-	if describeData == nil || len(describeData.LaunchTemplateVersions) == 0 {
-		return nil, fmt.Errorf("unable to find template versions for launch template %s", templateName)
-	}
-	if describeData.LaunchTemplateVersions[0].LaunchTemplateData == nil {
-		return nil, fmt.Errorf("no data found for launch template %s, version %s", templateName, templateVersion)
-	}
-
-	return describeData.LaunchTemplateVersions[0].LaunchTemplateData, nil
-}
-
 func (m *awsWrapper) getInstanceTypeFromInstanceRequirements(imageId string, requirementsRequest *ec2.InstanceRequirementsRequest) (string, error) {
 	describeImagesInput := &ec2.DescribeImagesInput{
 		ImageIds: []*string{aws.String(imageId)},
@@ -719,34 +1299,4 @@ func (m *awsWrapper) getInstanceTypesForAsgs(asgs []*asg) (map[string]string, er
 
 	return results, nil
 }
-
-func buildLaunchTemplateFromSpec(ltSpec *autoscaling.LaunchTemplateSpecification) *launchTemplate {
-	// NOTE(jaypipes): The LaunchTemplateSpecification.Version is a pointer to
-	// string. When the pointer is nil, EC2 AutoScaling API considers the value
-	// to be "$Default", however aws.StringValue(ltSpec.Version) will return an
-	// empty string (which is not considered the same as "$Default" or a nil
-	// string pointer. So, in order to not pass an empty string as the version
-	// for the launch template when we communicate with the EC2 AutoScaling API
-	// using the information in the launchTemplate, we store the string
-	// "$Default" here when the ltSpec.Version is a nil pointer.
-	//
-	// See:
-	//
-	// https://github.com/kubernetes/autoscaler/issues/1728
-	// https://github.com/aws/aws-sdk-go/blob/81fad3b797f4a9bd1b452a5733dd465eefef1060/service/autoscaling/api.go#L10666-L10671
-	//
-	// A cleaner alternative might be to make launchTemplate.version a string
-	// pointer instead of a string, or even store the aws-sdk-go's
-	// LaunchTemplateSpecification structs directly.
-	var version string
-	if ltSpec.Version == nil {
-		version = "$Default"
-	} else {
-		version = aws.StringValue(ltSpec.Version)
-	}
-	return &launchTemplate{
-		name:    aws.StringValue(ltSpec.LaunchTemplateName),
-		version: version,
-	}
-}
 */
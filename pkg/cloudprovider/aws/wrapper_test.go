@@ -0,0 +1,59 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// largeAccount returns a fake with the given number of ASGs, one in every ten of them
+// tagged for the cluster.
+func largeAccount(asgs int) *fakeAutoScaling {
+	autoScaling := &fakeAutoScaling{pageSize: maxRecordsReturnedByAPI}
+	for i := 0; i < asgs; i++ {
+		group := testGroup(fmt.Sprintf("asg-%d", i), 0, 0, 5)
+		if i%10 != 0 {
+			group.Tags = []*autoscaling.TagDescription{{Key: aws.String("team"), Value: aws.String("other")}}
+		}
+		autoScaling.groups = append(autoScaling.groups, group)
+	}
+	return autoScaling
+}
+
+func TestGetAutoscalingGroupsByTagsFiltersServerSide(t *testing.T) {
+	tags := map[string]string{"k8s.io/cluster-autoscaler/enabled": ""}
+	for _, ignoreFilters := range []bool{false, true} {
+		autoScaling := largeAccount(2000)
+		autoScaling.ignoreFilters = ignoreFilters
+
+		asgs, err := (&awsWrapper{autoScalingI: autoScaling}).getAutoscalingGroupsByTags(context.Background(), tags)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(asgs) != 200 {
+			t.Errorf("expected the 200 tagged ASGs with ignoreFilters=%v, got %d", ignoreFilters, len(asgs))
+		}
+		if input := autoScaling.describeInputs[0]; len(input.Filters) != 1 || aws.StringValue(input.Filters[0].Name) != "tag-key" {
+			t.Errorf("expected a tag-key filter, got %v", input.Filters)
+		}
+	}
+}
+
+func BenchmarkGetAutoscalingGroupsByTags(b *testing.B) {
+	tags := map[string]string{"k8s.io/cluster-autoscaler/enabled": "true"}
+	for _, ignoreFilters := range []bool{false, true} {
+		autoScaling := largeAccount(5000)
+		autoScaling.ignoreFilters = ignoreFilters
+		wrapper := &awsWrapper{autoScalingI: autoScaling}
+		b.Run(fmt.Sprintf("ignoreFilters=%v", ignoreFilters), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := wrapper.getAutoscalingGroupsByTags(context.Background(), tags); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -2,8 +2,15 @@ package vault
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
 
+	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/intelops/go-common/credentials"
 	log "github.com/sirupsen/logrus"
 )
@@ -12,20 +19,156 @@ const (
 	credentialType = "generic"
 )
 
+// RetryConfig bounds the retries of transient Vault errors when reading credentials.
+// The delay doubles after each failed attempt.
+type RetryConfig struct {
+	Attempts  int
+	BaseDelay time.Duration
+}
+
+// DefaultRetry is the retry of transient Vault errors unless WithRetry is given.
+var DefaultRetry = RetryConfig{
+	Attempts:  5,
+	BaseDelay: 500 * time.Millisecond,
+}
+
+// CredentialReader reads generic credentials from a secret store. The go-common Vault
+// reader is used unless another one is given with WithCredentialReader.
+type CredentialReader interface {
+	GetCredential(ctx context.Context, credentialType, entityName, credentialIdentifier string) (map[string]string, error)
+}
+
+type options struct {
+	retry  RetryConfig
+	reader CredentialReader
+}
+
+// An Option configures how credentials are read.
+type Option func(*options)
+
+// WithRetry sets the retry of transient Vault errors, DefaultRetry by default.
+// At least one attempt is always made.
+func WithRetry(retry RetryConfig) Option {
+	return func(o *options) {
+		o.retry = retry
+	}
+}
+
+// WithCredentialReader reads the credentials with the given reader instead of the
+// go-common Vault reader, e.g. to use another secret store.
+func WithCredentialReader(reader CredentialReader) Option {
+	return func(o *options) {
+		o.reader = reader
+	}
+}
+
+func buildOptions(opts []Option) options {
+	o := options{retry: DefaultRetry}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 // GetGenericCredential entity - azsecret/azsecret
 //
-func GetGenericCredential(ctx context.Context, entity, credIdentifier string) (map[string]string, error) {
-	credReader, err := credentials.NewCredentialReader(ctx)
-	if err != nil {
-		log.Errorf("Failed while creating Credential Reader, error : %v", err)
-		return nil, fmt.Errorf("failed while creating Credential Reader, error : %v", err)
+func GetGenericCredential(ctx context.Context, entity, credIdentifier string, opts ...Option) (map[string]string, error) {
+	o := buildOptions(opts)
+	credReader := o.reader
+	if credReader == nil {
+		var err error
+		credReader, err = credentials.NewCredentialReader(ctx)
+		if err != nil {
+			log.WithError(err).Error("Failed while creating Credential Reader")
+			return nil, fmt.Errorf("failed while creating Credential Reader, error : %v", err)
+		}
 	}
 
-	cred, err := credReader.GetCredential(context.Background(), credentialType, entity, credIdentifier)
+	cred, err := getCredentialWithRetry(ctx, credReader, entity, credIdentifier, o.retry)
 	if err != nil {
-		log.Errorf("Failed while get credential, error : %v", err)
+		log.WithFields(log.Fields{"entity": entity, "credIdentifier": credIdentifier}).WithError(err).Error("Failed while get credential")
 		return nil, fmt.Errorf("failed while get credential, error : %v", err)
 	}
 
 	return cred, nil
 }
+
+func getCredentialWithRetry(ctx context.Context, credReader CredentialReader, entity, credIdentifier string, retry RetryConfig) (map[string]string, error) {
+	delay := retry.BaseDelay
+	for attempt := 1; ; attempt++ {
+		cred, err := credReader.GetCredential(ctx, credentialType, entity, credIdentifier)
+		if err == nil || attempt >= retry.Attempts || !isTransientError(err) {
+			return cred, err
+		}
+
+		log.WithFields(log.Fields{
+			"entity":         entity,
+			"credIdentifier": credIdentifier,
+			"attempt":        attempt,
+			"attempts":       retry.Attempts,
+			"delay":          delay,
+		}).WithError(err).Warn("Failed to get credential, retrying")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isTransientError returns whether reading a credential failed because of a network
+// error or a Vault error that may go away, e.g. a sealed Vault or rate limiting, as
+// opposed to a missing credential or denied permission. go-common wraps the errors of
+// the Vault client with github.com/pkg/errors, which supports unwrapping.
+func isTransientError(err error) bool {
+	if errors.Is(err, vaultapi.ErrSecretNotFound) {
+		return false
+	}
+	var responseErr *vaultapi.ResponseError
+	if errors.As(err, &responseErr) {
+		switch responseErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+var placeholderRegex = regexp.MustCompile(`\{([A-Za-z0-9_-]+)\}`)
+
+// ExpandCredentialTemplate replaces the {name} placeholders of template, e.g.
+// {cluster}/{region}, with the given values. Unknown placeholders are an error.
+func ExpandCredentialTemplate(template string, values map[string]string) (string, error) {
+	var missing []string
+	expanded := placeholderRegex.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, found := values[name]
+		if !found {
+			missing = append(missing, name)
+			return placeholder
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("no value for placeholders %s of credential template %q", strings.Join(missing, ", "), template)
+	}
+	return expanded, nil
+}
+
+// GetTemplatedGenericCredential is like GetGenericCredential, with the entity and
+// credential identifier expanded from templates by ExpandCredentialTemplate.
+func GetTemplatedGenericCredential(ctx context.Context, entityTemplate, credIdentifierTemplate string, values map[string]string, opts ...Option) (map[string]string, error) {
+	entity, err := ExpandCredentialTemplate(entityTemplate, values)
+	if err != nil {
+		return nil, err
+	}
+	credIdentifier, err := ExpandCredentialTemplate(credIdentifierTemplate, values)
+	if err != nil {
+		return nil, err
+	}
+	return GetGenericCredential(ctx, entity, credIdentifier, opts...)
+}
@@ -0,0 +1,91 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// fakeReader fails the first reads with the given errors, then returns its credential.
+type fakeReader struct {
+	errs  []error
+	cred  map[string]string
+	reads int
+}
+
+func (f *fakeReader) GetCredential(_ context.Context, _, _, _ string) (map[string]string, error) {
+	f.reads++
+	if f.reads <= len(f.errs) {
+		return nil, f.errs[f.reads-1]
+	}
+	return f.cred, nil
+}
+
+var testRetry = RetryConfig{Attempts: 5, BaseDelay: time.Millisecond}
+
+func TestGetCredentialWithRetryAfterTransientErrors(t *testing.T) {
+	sealed := &vaultapi.ResponseError{StatusCode: http.StatusServiceUnavailable}
+	reader := &fakeReader{
+		// go-common wraps the errors of the Vault client
+		errs: []error{sealed, fmt.Errorf("error in reading certificate data from path: %w", sealed)},
+		cred: map[string]string{"key": "value"},
+	}
+
+	cred, err := getCredentialWithRetry(context.Background(), reader, "entity", "id", testRetry)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cred["key"] != "value" || reader.reads != 3 {
+		t.Errorf("expected the credential after 3 reads, got %v after %d reads", cred, reader.reads)
+	}
+}
+
+func TestGetCredentialWithRetryStops(t *testing.T) {
+	notFound := fmt.Errorf("error in reading certificate data from path: %w", vaultapi.ErrSecretNotFound)
+	denied := &vaultapi.ResponseError{StatusCode: http.StatusForbidden}
+	unavailable := &vaultapi.ResponseError{StatusCode: http.StatusServiceUnavailable}
+
+	for _, tc := range []struct {
+		name  string
+		errs  []error
+		reads int
+	}{
+		{"not found", []error{notFound}, 1},
+		{"permission denied", []error{denied}, 1},
+		{"attempts exhausted", []error{unavailable, unavailable, unavailable, unavailable, unavailable, unavailable}, 5},
+	} {
+		reader := &fakeReader{errs: tc.errs}
+		if _, err := getCredentialWithRetry(context.Background(), reader, "entity", "id", testRetry); !errors.Is(err, tc.errs[0]) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.errs[0], err)
+		}
+		if reader.reads != tc.reads {
+			t.Errorf("%s: expected %d reads, got %d", tc.name, tc.reads, reader.reads)
+		}
+	}
+}
+
+func TestGetGenericCredentialWithReader(t *testing.T) {
+	reader := &fakeReader{cred: map[string]string{"key": "value"}}
+
+	cred, err := GetGenericCredential(context.Background(), "entity", "id", WithCredentialReader(reader))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cred["key"] != "value" || reader.reads != 1 {
+		t.Errorf("expected the credential of the given reader, got %v after %d reads", cred, reader.reads)
+	}
+}
+
+func TestBuildOptions(t *testing.T) {
+	if o := buildOptions(nil); o.retry != DefaultRetry {
+		t.Errorf("expected the default retry, got %+v", o.retry)
+	}
+	if o := buildOptions([]Option{WithRetry(testRetry)}); o.retry != testRetry {
+		t.Errorf("expected the given retry, got %+v", o.retry)
+	}
+}